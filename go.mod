@@ -3,21 +3,17 @@ module birb
 go 1.21.1
 
 require (
+	github.com/golang-cz/devslog v0.0.4
 	github.com/s0rg/trie v1.2.1
 	github.com/stretchr/testify v1.8.4
 )
 
-require (
-	github.com/golang-cz/devslog v0.0.4 // indirect
-	github.com/zhangyunhao116/fastrand v0.3.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
-)
+require gopkg.in/yaml.v2 v2.4.0 // indirect
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/samber/mo v1.8.0
-	github.com/zhangyunhao116/skipmap v0.10.1
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,150 @@
+package lsm
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+)
+
+// WriteBatch collects writes to be applied to a tree at once with
+// LSMTree.Write. Keys and values are copied, so the caller may reuse its
+// buffers. The zero value is an empty batch ready to use.
+type WriteBatch struct {
+	entries []Entry
+}
+
+func (b *WriteBatch) Put(k, v []byte) {
+	b.entries = append(b.entries,
+		Entry{Key: slices.Clone(k), Value: slices.Clone(v), Kind: KindValue})
+}
+
+func (b *WriteBatch) Delete(k []byte) {
+	b.entries = append(b.entries, Entry{Key: slices.Clone(k), Kind: KindTombstone})
+}
+
+// DeleteRange deletes keys in [start, end), see LSMTree.DeleteRange. The tree
+// fails the whole batch when the range is empty.
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.entries = append(b.entries, Entry{
+		Key:   slices.Clone(start),
+		Value: slices.Clone(end),
+		Kind:  KindRangeDelete,
+	})
+}
+
+// Merge adds a merge operand of k, see LSMTree.Merge. The tree fails the
+// whole batch when it has no merge operator.
+func (b *WriteBatch) Merge(k, operand []byte) {
+	b.entries = append(b.entries,
+		Entry{Key: slices.Clone(k), Value: slices.Clone(operand), Kind: KindMerge})
+}
+
+// Len is the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// Write applies all writes of the batch atomically: they are a single wal
+// record, so either all or none of them survive a crash, and they become
+// visible to readers at once (see LSMTree.seq). Later writes of a key in the
+// batch win over earlier ones.
+func (tree *LSMTree) Write(b *WriteBatch) error {
+	return tree.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write which gives up like PutContext does.
+func (tree *LSMTree) WriteContext(ctx context.Context, b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	for _, e := range b.entries {
+		if e.Kind == KindMerge && tree.opt.MergeOperator == nil {
+			return ErrNoMergeOperator
+		}
+
+		if e.Kind == KindRangeDelete {
+			if err := checkRange(e.Key, e.Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tree.write(ctx, b.entries)
+}
+
+// on disk batch payload representation (see Wal for the record framing):
+// -------------------------------------------------------------------------
+// | type (1B) | seq | count | kind (1B) | key_len | key | value_len | value | ... |
+// -------------------------------------------------------------------------
+// numbers are uvarints, the kind, key and value repeat count times. Entries
+// are numbered from seq on, zero seq leaves them unnumbered. Batches of type
+// walRecordBatch were written before sequence numbers existed and have no
+// seq.
+func encodeWalBatch(entries []Entry) []byte {
+	size := 1 + 2*binary.MaxVarintLen64
+	for _, e := range entries {
+		size += 1 + 2*binary.MaxVarintLen64 + len(e.Key) + len(e.Value)
+	}
+
+	payload := make([]byte, 0, size)
+	payload = append(payload, byte(walRecordSeqBatch))
+	payload = binary.AppendUvarint(payload, entries[0].Seq)
+	payload = binary.AppendUvarint(payload, uint64(len(entries)))
+	for _, e := range entries {
+		payload = append(payload, byte(e.Kind))
+		payload = binary.AppendUvarint(payload, uint64(len(e.Key)))
+		payload = append(payload, e.Key...)
+		payload = binary.AppendUvarint(payload, uint64(len(e.Value)))
+		payload = append(payload, e.Value...)
+	}
+
+	return frameRecord(payload)
+}
+
+// decodeWalBatch decodes the batch payload p of type typ, without the type.
+func decodeWalBatch(typ walRecordType, p []byte) ([]Entry, error) {
+	var seq uint64
+	if typ == walRecordSeqBatch {
+		var read int
+		if seq, read = binary.Uvarint(p); read <= 0 {
+			return nil, errBadWalPayload
+		}
+		p = p[read:]
+	}
+
+	count, read := binary.Uvarint(p)
+	// every entry takes at least 3 bytes, don't trust a count beyond that
+	if read <= 0 || count > uint64(len(p)-read)/3 {
+		return nil, errBadWalPayload
+	}
+	p = p[read:]
+
+	entries := make([]Entry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(p) == 0 {
+			return nil, errBadWalPayload
+		}
+
+		e := Entry{Kind: EntryKind(p[0])}
+		if seq != 0 {
+			e.Seq = seq + i
+		}
+		var err error
+		if e.Key, p, err = uvarintPrefixed(p[1:]); err != nil {
+			return nil, err
+		}
+		if e.Value, p, err = uvarintPrefixed(p); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
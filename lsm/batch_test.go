@@ -0,0 +1,147 @@
+package lsm
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLSMTreeWrite(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+	assert.NoError(t, tree.Put([]byte("b"), []byte("old")))
+
+	var batch WriteBatch
+	key := []byte("a")
+	batch.Put(key, []byte("1"))
+	key[0] = 'c' // the batch holds its own copy
+	batch.Put(key, []byte("2"))
+	batch.Delete([]byte("b"))
+	batch.Put([]byte("a"), []byte("3"))
+
+	// act
+	err = tree.Write(&batch)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, 4, batch.Len())
+
+	v, err := tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), v)
+	v, err = tree.Get([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), v)
+	_, err = tree.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestLSMTreeWriteRecoveredFromWal(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+	opts.WalSync = WalSyncAlways
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tree, err := Recover(ctx, dir, &opts)
+	assert.NoError(t, err)
+
+	var batch WriteBatch
+	for i := 0; i < 10; i++ {
+		batch.Put([]byte("key"+strconv.Itoa(i)), []byte("v"))
+	}
+	batch.Delete([]byte("key3"))
+	assert.NoError(t, tree.Write(&batch))
+
+	// act
+	// no Close, the tree is just abandoned as if the process died
+	cancel()
+	recovered, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	// assert
+	for i := 0; i < 10; i++ {
+		v, err := recovered.Get([]byte("key" + strconv.Itoa(i)))
+		if i == 3 {
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("v"), v)
+		}
+	}
+}
+
+func TestWalReplaySkipsTornBatch(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	wal, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Append([]byte("a"), []byte("1")))
+	assert.NoError(t, wal.AppendBatch([]Entry{put("b", "2"), put("c", "3")}))
+	assert.NoError(t, wal.Close())
+
+	// the batch was cut short by a crash
+	p := wal.segmentPath(wal.seg)
+	stat, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(p, stat.Size()-1))
+
+	// act
+	reopened, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	replayed := make([]string, 0)
+	err = reopened.Replay(func(e Entry) error {
+		replayed = append(replayed, string(e.Key))
+		return nil
+	})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, replayed)
+}
+
+func TestLSMTreeWriteAtomicForIterators(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			var batch WriteBatch
+			v := []byte(strconv.Itoa(i))
+			batch.Put([]byte("a"), v)
+			batch.Put([]byte("b"), v)
+			assert.NoError(t, tree.Write(&batch))
+		}
+	}()
+
+	// act & assert
+	// a and b are always written together, so they must always match
+	for i := 0; i < 200; i++ {
+		it := tree.NewIterator(nil, nil)
+		values := make([]string, 0, 2)
+		for ok := it.First(); ok; ok = it.Next() {
+			values = append(values, string(it.Value()))
+		}
+		assert.NoError(t, it.Close())
+
+		if len(values) > 0 {
+			assert.Len(t, values, 2)
+			assert.Equal(t, values[0], values[1])
+		}
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,423 @@
+package lsm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+// Values of at least Options.BlobThreshold bytes are kept out of sstables in
+// blob files (key-value separation, like in WiscKey or rocksdb BlobDB).
+// Flushes and compactions append such values to blob files and store entries
+// of KindBlobIndex pointing to them in tables instead, so compactions move
+// small pointers around rather than whole values.
+//
+// Blob files are never modified. The MANIFEST lists them together with their
+// garbage: bytes of values no table points to anymore. Compactions count it
+// as they drop or rewrite pointers, and a blob file is removed once it's all
+// garbage. Compactions meeting pointers to a file with more garbage than
+// Options.BlobGCThreshold write their values to new blob files, so that old
+// files drain.
+const blobFileExt = ".blob"
+
+func blobPath(dir string, num uint64) string {
+	return path.Join(dir, fmt.Sprintf("%06d%s", num, blobFileExt))
+}
+
+// on disk blob record representation:
+// -----------------------
+// | value | crc32c (4B) |
+// -----------------------
+// records are just appended to a blob file one after another, the file has
+// no index of its own.
+//
+// blobPointer is the value of a KindBlobIndex entry:
+// ------------------------
+// | file | offset | len |
+// ------------------------
+// numbers are uvarints, offset is the record offset in the file and len is
+// the value length.
+type blobPointer struct {
+	num    uint64
+	offset uint64
+	len    uint64
+}
+
+var errBadBlobPointer = errors.New("malformed blob pointer")
+
+func (p blobPointer) Bytes() []byte {
+	buf := binary.AppendUvarint(nil, p.num)
+	buf = binary.AppendUvarint(buf, p.offset)
+	return binary.AppendUvarint(buf, p.len)
+}
+
+func blobPointerFromBytes(b []byte) (blobPointer, error) {
+	var p blobPointer
+	for _, n := range []*uint64{&p.num, &p.offset, &p.len} {
+		v, read := binary.Uvarint(b)
+		if read <= 0 {
+			return blobPointer{}, errBadBlobPointer
+		}
+		*n, b = v, b[read:]
+	}
+
+	return p, nil
+}
+
+// blobFile is an open blob file. Like SSTable, it's referenced by the tree
+// and by open iterators, and removed with the last reference once obsolete.
+type blobFile struct {
+	num      uint64
+	file     *os.File
+	size     uint64 // bytes of values
+	refs     *atomic.Int32
+	obsolete *atomic.Bool
+}
+
+func newBlobFile(num uint64, file *os.File, size uint64) *blobFile {
+	refs := new(atomic.Int32)
+	refs.Store(1)
+	return &blobFile{
+		num:      num,
+		file:     file,
+		size:     size,
+		refs:     refs,
+		obsolete: new(atomic.Bool),
+	}
+}
+
+func (f *blobFile) Ref() {
+	f.refs.Add(1)
+}
+
+func (f *blobFile) Unref() error {
+	if f.refs.Add(-1) > 0 {
+		return nil
+	}
+
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.obsolete.Load() {
+		return os.Remove(f.file.Name())
+	}
+
+	return nil
+}
+
+// read returns the value p points to.
+func (f *blobFile) read(p blobPointer) ([]byte, error) {
+	buf := make([]byte, p.len+checksumSize)
+	if _, err := f.file.ReadAt(buf, int64(p.offset)); err != nil {
+		return nil, fmt.Errorf("reading blob: %w", err)
+	}
+
+	value, ok := verifyChecksum(buf)
+	if !ok {
+		return nil, &CorruptionError{
+			File:   f.file.Name(),
+			Offset: int64(p.offset),
+			Reason: "blob checksum mismatch",
+		}
+	}
+
+	return value, nil
+}
+
+// BlobStats tell how much space blob files take and how much of it is
+// garbage waiting for compactions to drain it.
+type BlobStats struct {
+	Files   int
+	Size    uint64 // bytes of values
+	Garbage uint64
+}
+
+// blobSet is the set of blob files of a tree.
+type blobSet struct {
+	mu      sync.Mutex
+	files   blobFiles
+	garbage map[uint64]uint64
+}
+
+func newBlobSet() *blobSet {
+	return &blobSet{
+		files:   make(blobFiles),
+		garbage: make(map[uint64]uint64),
+	}
+}
+
+// read returns the value a blob pointer of a KindBlobIndex entry points to.
+func (s *blobSet) read(ptr []byte) ([]byte, error) {
+	p, err := blobPointerFromBytes(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	f, ok := s.files[p.num]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("blob file %d is missing", p.num)
+	}
+
+	return f.read(p)
+}
+
+// blobFiles are blob files by their numbers.
+type blobFiles map[uint64]*blobFile
+
+// read is blobSet.read for files nobody modifies.
+func (fs blobFiles) read(ptr []byte) ([]byte, error) {
+	p, err := blobPointerFromBytes(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	f, ok := fs[p.num]
+	if !ok {
+		return nil, fmt.Errorf("blob file %d is missing", p.num)
+	}
+
+	return f.read(p)
+}
+
+// refAll references all blob files for an iterator, which reads values of
+// the tables it holds on to from them.
+func (s *blobSet) refAll() blobFiles {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make(blobFiles, len(s.files))
+	for num, f := range s.files {
+		f.Ref()
+		files[num] = f
+	}
+
+	return files
+}
+
+// needsGC tells if values of blob file num should move to new blob files.
+func (s *blobSet) needsGC(num uint64, threshold float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[num]
+	return ok && threshold > 0 && f.size > 0 &&
+		float64(s.garbage[num])/float64(f.size) >= threshold
+}
+
+// edit fills the version edit in for blob changes of a flush or compaction.
+// Blob files which become all garbage are removed.
+func (s *blobSet) edit(e *versionEdit, changes blobChanges) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range changes.added {
+		e.addedBlobs = append(e.addedBlobs, blobRef{f.num, f.size})
+	}
+
+	for num, bytes := range changes.garbage {
+		f, ok := s.files[num]
+		if !ok || bytes == 0 {
+			continue
+		}
+
+		e.blobGarbage = append(e.blobGarbage, blobRef{num, bytes})
+		if s.garbage[num]+bytes >= f.size {
+			e.removedBlobs = append(e.removedBlobs, num)
+		}
+	}
+}
+
+// apply makes a logged edit of blob files visible and drops the tree's
+// reference on the removed ones.
+func (s *blobSet) apply(e versionEdit, changes blobChanges) {
+	s.mu.Lock()
+	for _, f := range changes.added {
+		s.files[f.num] = f
+	}
+
+	for _, ref := range e.blobGarbage {
+		s.garbage[ref.num] += ref.bytes
+	}
+
+	removed := make([]*blobFile, 0, len(e.removedBlobs))
+	for _, num := range e.removedBlobs {
+		if f, ok := s.files[num]; ok {
+			removed = append(removed, f)
+		}
+		delete(s.files, num)
+		delete(s.garbage, num)
+	}
+	s.mu.Unlock()
+
+	discardBlobs(removed)
+}
+
+func (s *blobSet) stats() BlobStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := BlobStats{Files: len(s.files)}
+	for num, f := range s.files {
+		stats.Size += f.size
+		stats.Garbage += s.garbage[num]
+	}
+
+	return stats
+}
+
+func (s *blobSet) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, f := range s.files {
+		errs = append(errs, f.Unref())
+	}
+
+	return errors.Join(errs...)
+}
+
+// discardBlobs drops the tree's reference on blob files which are not part
+// of the tree anymore, their files are removed once nobody reads them.
+func discardBlobs(files []*blobFile) {
+	for _, f := range files {
+		f.obsolete.Store(true)
+		f.Unref()
+	}
+}
+
+// blobChanges are blob files written by a flush or compaction and garbage it
+// made of values in older blob files.
+type blobChanges struct {
+	added   []*blobFile
+	garbage map[uint64]uint64
+}
+
+// countPointers adds values of blob pointers to bytes per blob file.
+func countPointers(bytes map[uint64]uint64, e Entry) {
+	if e.Kind != KindBlobIndex {
+		return
+	}
+
+	if p, err := blobPointerFromBytes(e.Value); err == nil {
+		bytes[p.num] += p.len
+	}
+}
+
+// tablesGarbage counts values tables point to, which become garbage once the
+// tables are dropped.
+func tablesGarbage(tables []*SSTable) (map[uint64]uint64, error) {
+	garbage := make(map[uint64]uint64)
+	for _, sst := range tables {
+		it := sst.Iter()
+		for ok := it.First(); ok; ok = it.Next() {
+			countPointers(garbage, it.Value())
+		}
+
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return garbage, nil
+}
+
+// BlobStats reports space taken by blob files.
+func (tree *LSMTree) BlobStats() BlobStats {
+	return tree.blobs.stats()
+}
+
+// blobWriter appends values of a flush or compaction to new blob files, a
+// file is finished once it's Options.BlobFileSize big.
+type blobWriter struct {
+	tree     *LSMTree
+	ctx      context.Context
+	priority IOPriority
+
+	cur    *os.File
+	curNum uint64
+	offset uint64 // bytes written to cur
+	size   uint64 // bytes of values written to cur
+	done   []*blobFile
+}
+
+func newBlobWriter(tree *LSMTree, ctx context.Context, pri IOPriority) *blobWriter {
+	return &blobWriter{tree: tree, ctx: ctx, priority: pri}
+}
+
+// add appends value to the current blob file and returns its pointer.
+func (bw *blobWriter) add(value []byte) (blobPointer, error) {
+	if bw.cur == nil {
+		bw.curNum = bw.tree.nextFile.Add(1) - 1
+		f, err := os.Create(blobPath(bw.tree.dir, bw.curNum))
+		if err != nil {
+			return blobPointer{}, err
+		}
+		bw.cur, bw.offset, bw.size = f, 0, 0
+	}
+
+	record := appendChecksum(append(make([]byte, 0, len(value)+checksumSize), value...))
+	if rl := bw.tree.opt.RateLimiter; rl != nil {
+		if err := rl.Wait(bw.ctx, len(record), bw.priority); err != nil {
+			return blobPointer{}, err
+		}
+	}
+
+	if _, err := bw.cur.Write(record); err != nil {
+		return blobPointer{}, fmt.Errorf("writing blob: %w", err)
+	}
+
+	p := blobPointer{num: bw.curNum, offset: bw.offset, len: uint64(len(value))}
+	bw.offset += uint64(len(record))
+	bw.size += uint64(len(value))
+
+	if size := bw.tree.opt.BlobFileSize; size > 0 && bw.offset >= uint64(size) {
+		if err := bw.finishFile(); err != nil {
+			return blobPointer{}, err
+		}
+	}
+
+	return p, nil
+}
+
+func (bw *blobWriter) finishFile() error {
+	if err := bw.cur.Sync(); err != nil {
+		return fmt.Errorf("syncing blob file: %w", err)
+	}
+
+	bw.done = append(bw.done, newBlobFile(bw.curNum, bw.cur, bw.size))
+	bw.cur = nil
+	return nil
+}
+
+// finish syncs blob files written, they are ready to be added to the tree.
+func (bw *blobWriter) finish() ([]*blobFile, error) {
+	if bw.cur != nil {
+		if err := bw.finishFile(); err != nil {
+			bw.abort()
+			return nil, err
+		}
+	}
+
+	return bw.done, nil
+}
+
+// abort removes blob files written.
+func (bw *blobWriter) abort() {
+	if bw.cur != nil {
+		bw.cur.Close()
+		os.Remove(bw.cur.Name())
+		bw.cur = nil
+	}
+
+	discardBlobs(bw.done)
+	bw.done = nil
+}
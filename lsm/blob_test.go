@@ -0,0 +1,181 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blobTree keeps values of 16 bytes and more in blob files.
+func blobTree(t *testing.T, dir string) *LSMTree {
+	opts := *DefaultOptions
+	opts.BlobThreshold = 16
+	opts.BlobGCThreshold = 0.5
+	tree, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	return tree
+}
+
+func bigValue(c byte) []byte {
+	return bytes.Repeat([]byte{c}, 32)
+}
+
+func blobFilesIn(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(path.Join(dir, "*"+blobFileExt))
+	assert.NoError(t, err)
+
+	return files
+}
+
+func TestBlobGet(t *testing.T) {
+	// arrange
+	tree := blobTree(t, t.TempDir())
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), bigValue('a')))
+	assert.NoError(t, tree.Put([]byte("b"), []byte("small")))
+
+	// act
+	flushAndCompact(t, tree)
+
+	// assert
+	entries := levelEntries(t, tree, 1)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, KindBlobIndex, entries[0].Kind)
+	assert.Equal(t, KindValue, entries[1].Kind)
+
+	v, err := tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, bigValue('a'), v)
+	v, err = tree.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("small"), v)
+
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+	values := make(map[string][]byte)
+	for ok := it.First(); ok; ok = it.Next() {
+		values[string(it.Key())] = it.Value()
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, map[string][]byte{"a": bigValue('a'), "b": []byte("small")}, values)
+
+	assert.Equal(t, BlobStats{Files: 1, Size: 32}, tree.BlobStats())
+}
+
+func TestBlobGC(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := blobTree(t, dir)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), bigValue('a')))
+	assert.NoError(t, tree.Put([]byte("b"), bigValue('b')))
+	flushAndCompact(t, tree)
+	old := blobFilesIn(t, dir)
+
+	// act
+	assert.NoError(t, tree.Put([]byte("a"), bigValue('A')))
+	assert.NoError(t, tree.Del([]byte("b")))
+	flushAndCompact(t, tree)
+
+	// assert
+	// nothing points to the first blob file anymore
+	assert.Len(t, old, 1)
+	assert.NoFileExists(t, old[0])
+	assert.Len(t, blobFilesIn(t, dir), 1)
+	assert.Equal(t, BlobStats{Files: 1, Size: 32}, tree.BlobStats())
+
+	v, err := tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, bigValue('A'), v)
+}
+
+func TestBlobRelocation(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := blobTree(t, dir)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), bigValue('a')))
+	assert.NoError(t, tree.Put([]byte("b"), bigValue('b')))
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Put([]byte("a"), []byte("small")))
+	flushAndCompact(t, tree)
+	halfGarbage := tree.BlobStats()
+
+	// act
+	// the next compaction meeting b moves its value out of the file
+	assert.NoError(t, tree.Put([]byte("a0"), []byte("small")))
+	flushAndCompact(t, tree)
+
+	// assert
+	assert.Equal(t, BlobStats{Files: 1, Size: 64, Garbage: 32}, halfGarbage)
+	assert.Equal(t, BlobStats{Files: 1, Size: 32}, tree.BlobStats())
+	assert.Len(t, blobFilesIn(t, dir), 1)
+
+	v, err := tree.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, bigValue('b'), v)
+}
+
+func TestBlobIteratorOutlivesGC(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := blobTree(t, dir)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), bigValue('a')))
+	flushAndCompact(t, tree)
+	old := blobFilesIn(t, dir)
+	it := tree.NewIterator(nil, nil)
+
+	// act
+	assert.NoError(t, tree.Put([]byte("a"), []byte("small")))
+	flushAndCompact(t, tree)
+	it.First()
+	v := it.Value()
+	assert.NoError(t, it.Close())
+
+	// assert
+	assert.Equal(t, bigValue('a'), v)
+	assert.NoFileExists(t, old[0])
+	assert.Equal(t, BlobStats{}, tree.BlobStats())
+}
+
+func TestBlobRecover(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := blobTree(t, dir)
+	assert.NoError(t, tree.Put([]byte("a"), bigValue('a')))
+	assert.NoError(t, tree.Put([]byte("b"), bigValue('b')))
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Put([]byte("a"), []byte("small")))
+	assert.NoError(t, tree.Put([]byte("c"), bigValue('c')))
+	flushAndCompact(t, tree)
+	stats := tree.BlobStats()
+	assert.NoError(t, tree.Close())
+
+	// a blob file of a flush which didn't make it to the manifest
+	orphan := blobPath(dir, 999)
+	assert.NoError(t, os.WriteFile(orphan, bigValue('x'), 0666))
+
+	// act
+	recovered := blobTree(t, dir)
+	defer recovered.Close()
+
+	// assert
+	assert.Equal(t, stats, recovered.BlobStats())
+	assert.NoFileExists(t, orphan)
+	for k, want := range map[string][]byte{"a": []byte("small"), "b": bigValue('b'), "c": bigValue('c')} {
+		v, err := recovered.Get([]byte(k))
+		assert.NoError(t, err)
+		assert.Equal(t, want, v, k)
+	}
+}
@@ -1,61 +1,163 @@
 package lsm
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"math"
+	"sort"
 )
 
-// Block is lazy, which means only block entry index is loaded into memory,
-// entries are accessed on request.
+// Block is a block of entries read into memory, it's what the block cache
+// holds.
+// on disk Block representation since FormatV4:
+// -----------------------------------------------------
+// | compression type (1B) | FormatV3 body | crc32c (4B) |
+// -----------------------------------------------------
+// the body is compressed by the compressor of the given type (see
+// compression.go), the checksum covers the compressed data.
+//
+// on disk Block representation of FormatV3:
+// ---------------------------------------------------------------------
+// | entries | restart offsets (4B each) | num_restarts (4B) | crc32c (4B) |
+// ---------------------------------------------------------------------
+// Like in leveldb, an entry stores only the part of its key which differs
+// from the key of the previous entry. Every BlockRestartInterval entries the
+// key is stored in full, such entry is a restart point. Lookups binary search
+// restart points and scan entries linearly from there.
+//
+// on disk Block representation of FormatV1 and FormatV2:
+// -------------------------------------------------------------
+// | entries | entry index | meta | crc32c (4B) |
+// -------------------------------------------------------------
+// every key is stored in full, entry index holds offset and length of every
+// entry, and meta holds offsets and lengths of entries and entry index. They
+// are 2B numbers in FormatV1 and 4B numbers in FormatV2. Every entry of such
+// block is a restart point.
+//
+// The checksum covers everything before it.
 type Block struct {
-	file  *io.SectionReader
-	index BlockIndex // TODO make it sparse? (not every entry in index)
+	data     []byte   // entries
+	restarts []uint32 // offsets of entries with full keys, ascending
+	format   FormatVersion
 }
 
-func BlockFromSectReader(r *io.SectionReader) (Block, error) {
-	meta, err := MetaFromSectReader(io.NewSectionReader(r, r.Size()-MetaSize, MetaSize))
-	if err != nil {
-		return Block{}, err
+// BlockFromSectReader verifies the block checksum and loads its restart
+// points. Broken blocks are reported with a *CorruptionError, its offset is
+// relative to r.
+func BlockFromSectReader(r *io.SectionReader, format FormatVersion) (Block, error) {
+	buf := make([]byte, r.Size())
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return Block{}, fmt.Errorf("reading block: %w", err)
 	}
 
-	index := make(BlockIndex, 0, meta.IndexLen/4) // each entry is 4 bytes long
-	endoff := meta.IndexOffset + meta.IndexLen
-	for off := meta.IndexOffset; off < endoff; off = +4 {
-		buf := [4]byte{}
-		_, err := r.ReadAt(buf[:], int64(off))
-		if err != nil {
+	body, ok := verifyChecksum(buf)
+	if !ok {
+		return Block{}, &CorruptionError{Reason: "block checksum mismatch"}
+	}
+
+	if format.compressed() {
+		var err error
+		if body, err = decompressBlock(body); err != nil {
 			return Block{}, err
 		}
+	}
+
+	if format.prefixCompressed() {
+		return blockWithRestarts(body, format)
+	}
+
+	return blockWithEntryIndex(body, format)
+}
+
+// size is the memory the block takes.
+func (b *Block) size() int {
+	return len(b.data) + 4*len(b.restarts)
+}
+
+func blockWithRestarts(body []byte, format FormatVersion) (Block, error) {
+	if len(body) < 4 {
+		return Block{}, &CorruptionError{Reason: "block is too short"}
+	}
+
+	num := int(binary.LittleEndian.Uint32(body[len(body)-4:]))
+	restartsOffset := len(body) - 4 - 4*num
+	if num == 0 || restartsOffset < 0 {
+		return Block{}, &CorruptionError{
+			Offset: int64(len(body) - 4),
+			Reason: "bad number of restart points",
+		}
+	}
+
+	restarts := make([]uint32, 0, num)
+	for off := restartsOffset; off < len(body)-4; off += 4 {
+		restart := binary.LittleEndian.Uint32(body[off:])
+		if int(restart) >= restartsOffset ||
+			(len(restarts) > 0 && restart <= restarts[len(restarts)-1]) {
+			return Block{}, &CorruptionError{
+				Offset: int64(off),
+				Reason: "restart point out of bounds",
+			}
+		}
+
+		restarts = append(restarts, restart)
+	}
 
-		idxval, err := EntryIndexValueFromBytes(buf[:])
+	return Block{body[:restartsOffset], restarts, format}, nil
+}
+
+func blockWithEntryIndex(body []byte, format FormatVersion) (Block, error) {
+	width := format.blockWidth()
+	metaSize := 4 * width
+	if len(body) < metaSize {
+		return Block{}, &CorruptionError{Reason: "block is too short"}
+	}
+
+	meta := metaFromBytes(body[len(body)-metaSize:], width)
+	endoff := meta.IndexOffset + meta.IndexLen
+	if endoff > uint64(len(body)-metaSize) || meta.IndexLen%uint64(2*width) != 0 {
+		return Block{}, &CorruptionError{
+			Offset: int64(len(body) - metaSize),
+			Reason: "block index out of bounds",
+		}
+	}
+
+	restarts := make([]uint32, 0, meta.IndexLen/uint64(2*width))
+	for off := meta.IndexOffset; off < endoff; off += uint64(2 * width) {
+		idxval, err := EntryIndexValueFromBytes(body[off:off+uint64(2*width)], width)
 		if err != nil {
 			return Block{}, err
 		}
 
-		index = append(index, &idxval)
+		if uint64(idxval.offset)+uint64(idxval.len) > meta.IndexOffset ||
+			int(idxval.len) < format.minEntrySize() {
+			return Block{}, &CorruptionError{
+				Offset: int64(off),
+				Reason: "block entry out of bounds",
+			}
+		}
+
+		restarts = append(restarts, idxval.offset)
 	}
 
-	return Block{r, index}, nil
+	return Block{body[:meta.IndexOffset], restarts, format}, nil
 }
 
-type BlockIndex []*BlockIndexValue
-
-func EntryIndexValueFromBytes(buf []byte) (idxval BlockIndexValue, err error) {
-	if len(buf) < 4 {
+// EntryIndexValueFromBytes parses an entry index value of blocks written
+// before FormatV3.
+func EntryIndexValueFromBytes(buf []byte, width int) (idxval BlockIndexValue, err error) {
+	if len(buf) < 2*width {
 		return BlockIndexValue{}, fmt.Errorf("invalid entry index value length")
 	}
 
-	off := binary.LittleEndian.Uint16(buf)
-	len := binary.LittleEndian.Uint16(buf[2:])
-	return BlockIndexValue{offset: off, len: len}, nil
+	off := uintFromBytes(buf, width)
+	len := uintFromBytes(buf[width:], width)
+	return BlockIndexValue{offset: uint32(off), len: uint32(len)}, nil
 }
 
 type BlockIndexValue struct {
-	offset uint16 // TODO: remove offset and len in favor of r?
-	len    uint16
-	r      *io.SectionReader // a ready to read reader with .offset and .len
+	offset uint32
+	len    uint32
 }
 
 // TODO deprecate in favor of Block
@@ -70,99 +172,193 @@ type DeprecatedBlock struct {
 	entries []Entry
 }
 
-// on disk Entry representation:
-// -----------------------------------------------------------------------
-// |                           Entry #1                            | ... |
-// -----------------------------------------------------------------------
-// | key_len (2B) | key (keylen) | value_len (2B) | value (varlen) | ... |
-// -----------------------------------------------------------------------
+type EntryKind byte
+
+const (
+	KindValue EntryKind = iota
+	// KindTombstone marks a deleted key, it carries no value
+	KindTombstone
+	// KindMerge is a merge operand, see MergeOperator
+	KindMerge
+	// KindRangeDelete deletes keys from Key up to Value (exclusive), see
+	// LSMTree.DeleteRange. Tables keep such entries apart from data blocks
+	KindRangeDelete
+	// KindBlobIndex is a value kept in a blob file, Value is a pointer to it.
+	// Tables have them instead of KindValue entries with big values, see
+	// Options.BlobThreshold
+	KindBlobIndex
+)
+
+// on disk Entry representation since FormatV3:
+// -------------------------------------------------------------------------------
+// | shared | unshared | value_len | kind (1B) | seq | key_delta (unshared) | value |
+// -------------------------------------------------------------------------------
+// shared is the length of the prefix the key has in common with the key of
+// the previous entry, only the rest of the key is stored. Lengths and seq are
+// uvarints, seq is there since FormatV5.
+//
+// on disk Entry representation of FormatV1 and FormatV2:
+// -------------------------------------------------------------------------
+// | key_len | key (keylen) | kind (1B) | value_len | value (varlen) |
+// -------------------------------------------------------------------------
+// lengths are 2B numbers in FormatV1 and uvarints in FormatV2.
+//
+// Key, Seq and Kind make up the internal key of an entry. Entries are ordered
+// by user key and newer versions (larger seqs) of a key come first. Entries
+// of formats before FormatV5 have zero seqs.
 type Entry struct {
 	Key   []byte
 	Value []byte
+	Kind  EntryKind
+	Seq   uint64
 }
 
+// Bytes encodes the entry in the latest format as a restart point.
 func (entry Entry) Bytes() []byte {
-	if len(entry.Key) > math.MaxUint16 || len(entry.Value) > math.MaxUint16 {
-		panic("block entry key or value size is larger than max(uint16)")
-	}
-
 	if len(entry.Key) == 0 {
 		panic("block entry key cannot be empty")
 	}
 
-	lenbuf := make([]byte, 2)
-	bytes := make([]byte, 0, 4)
+	return appendEntry(
+		make([]byte, 0, 1+3*binary.MaxVarintLen64+len(entry.Key)+len(entry.Value)),
+		entry, nil, formatLatest)
+}
 
-	binary.LittleEndian.PutUint16(lenbuf, uint16(len(entry.Key)))
-	bytes = append(bytes, lenbuf...)
-	bytes = append(bytes, entry.Key...)
+// EntryFromBytes decodes a restart point entry of the latest format, a
+// malformed one decodes to an empty entry.
+func EntryFromBytes(entry []byte) Entry {
+	e, _, _ := entryFromBytes(entry, nil, formatLatest)
+	return e
+}
 
-	binary.LittleEndian.PutUint16(lenbuf, uint16(len(entry.Value)))
-	bytes = append(bytes, lenbuf...)
-	bytes = append(bytes, entry.Value...)
+// Iter is a positioned iterator over a sorted sequence. A fresh iterator is
+// not positioned, call First, Last or Seek before anything else. Every method
+// moving the iterator reports whether it ended up on an element; Value may be
+// called only while it did.
+type Iter[T any] interface {
+	First() bool
+	Last() bool
+	Seek(k []byte) bool // first element with key >= k
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Value() T
+	Err() error
+}
 
-	return bytes
+// BlockIter walks entries of a block. Keys of entries are rebuilt out of
+// prefixes shared with previous entries, so moving backward means going to
+// the previous restart point and scanning forward from there.
+type BlockIter struct {
+	block *Block
+	off   int // offset of the current entry
+	next  int // offset of the entry after the current one
+	entry Entry
+	valid bool
+	err   error
 }
 
-func EntryFromBytes(entry []byte) Entry {
-	var keyOffset uint16 = 0
-	keyLen := binary.LittleEndian.Uint16(entry[keyOffset:2])
-	start := 2 + keyOffset
-	key := []byte(entry[start : start+keyLen])
+func NewBlockIter(block *Block) *BlockIter {
+	return &BlockIter{block: block}
+}
 
-	valOffset := 2 + keyLen
-	valLen := binary.LittleEndian.Uint16(entry[valOffset : valOffset+2])
-	start = 2 + valOffset
-	val := []byte(entry[start : start+valLen])
+func (it *BlockIter) First() bool {
+	if len(it.block.restarts) == 0 {
+		it.valid = false
+		return false
+	}
 
-	return Entry{Key: key, Value: val}
+	it.toRestart(0)
+	return it.parseNext()
 }
 
-func bytesToUint16(b []byte) uint16 {
-	if len(b) != 2 {
-		panic("bytes to uint16: input size not equals 2")
+func (it *BlockIter) Last() bool {
+	if len(it.block.restarts) == 0 {
+		it.valid = false
+		return false
 	}
 
-	return binary.LittleEndian.Uint16(b)
-}
+	it.toRestart(len(it.block.restarts) - 1)
+	for it.parseNext() {
+		if it.next >= len(it.block.data) {
+			return true
+		}
+	}
 
-func keyFromBytes(b []byte) (key []byte, read int) {
-	keylen := bytesToUint16(b[:2])
-	b = b[2:]
-	return b[:keylen], 2 + int(keylen)
+	return false
 }
 
-func keyFromSect(r *io.SectionReader) []byte {
-	lenbuf := [2]byte{}
-	_, err := r.Read(lenbuf[:])
-	if err != nil {
-		panic(err)
+func (it *BlockIter) Seek(k []byte) bool {
+	// first restart point with key >= k, the key may be right before it
+	i := sort.Search(len(it.block.restarts), func(i int) bool {
+		if it.err != nil {
+			return true
+		}
+
+		e, _, err := entryFromBytes(
+			it.block.data[it.block.restarts[i]:], nil, it.block.format)
+		if err != nil {
+			it.err = &CorruptionError{
+				Offset: int64(it.block.restarts[i]),
+				Reason: err.Error(),
+			}
+			return true
+		}
+
+		return bytes.Compare(e.Key, k) >= 0
+	})
+
+	if it.err != nil || len(it.block.restarts) == 0 {
+		it.valid = false
+		return false
 	}
 
-	keylen := bytesToUint16(lenbuf[:])
-	outbuf := make([]byte, keylen)
-	_, err = r.Read(outbuf)
-	if err != nil {
-		panic(err)
+	it.toRestart(max(i-1, 0))
+	for it.parseNext() {
+		if bytes.Compare(it.entry.Key, k) >= 0 {
+			return true
+		}
 	}
 
-	return outbuf
+	return false
 }
 
-type Iter[T any] interface {
-	Value() T
-	Next() bool
-	Err() error
+func (it *BlockIter) Next() bool {
+	if !it.Valid() {
+		return false
+	}
+
+	return it.parseNext()
 }
 
-type BlockIter struct {
-	block *Block
-	idx   int
-	err   error
+func (it *BlockIter) Prev() bool {
+	if !it.Valid() {
+		return false
+	}
+
+	// last restart point before the current entry
+	cur := it.off
+	i := sort.Search(len(it.block.restarts), func(i int) bool {
+		return int(it.block.restarts[i]) >= cur
+	}) - 1
+
+	if i < 0 {
+		it.valid = false
+		return false
+	}
+
+	it.toRestart(i)
+	for it.parseNext() {
+		if it.next >= cur {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (it *BlockIter) Next() bool {
-	return len(it.block.index) > it.idx && it.err == nil
+func (it *BlockIter) Valid() bool {
+	return it.err == nil && it.valid
 }
 
 func (it *BlockIter) Err() error {
@@ -170,16 +366,32 @@ func (it *BlockIter) Err() error {
 }
 
 func (it *BlockIter) Value() Entry {
-	r := it.block.index[it.idx].r
+	return it.entry
+}
 
-	buf := make([]byte, 0, r.Size())
-	_, err := r.Read(buf)
-	if err != nil {
-		it.err = err
-		return Entry{}
+func (it *BlockIter) toRestart(i int) {
+	it.next = int(it.block.restarts[i])
+	it.entry = Entry{}
+}
+
+// parseNext moves to the entry at it.next, the key of the current entry is
+// the base for its key.
+func (it *BlockIter) parseNext() bool {
+	if it.next >= len(it.block.data) {
+		it.valid = false
+		return false
 	}
 
-	it.idx++
+	e, n, err := entryFromBytes(
+		it.block.data[it.next:], it.entry.Key, it.block.format)
+	if err != nil {
+		it.err = &CorruptionError{Offset: int64(it.next), Reason: err.Error()}
+		it.valid = false
+		return false
+	}
 
-	return EntryFromBytes(buf)
+	it.off, it.next = it.next, it.next+n
+	it.entry = e
+	it.valid = true
+	return true
 }
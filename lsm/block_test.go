@@ -31,3 +31,17 @@ func TestBlockEntryEmptyValue(t *testing.T) {
 	assert.Equal(t, entry.Key, parsedEntry.Key)
 	assert.Equal(t, entry.Value, parsedEntry.Value)
 }
+
+func TestBlockEntryTombstone(t *testing.T) {
+	// arrange
+	entry := Entry{Key: []byte("hello"), Kind: KindTombstone}
+
+	// act
+	bytes := entry.Bytes()
+	parsedEntry := EntryFromBytes(bytes)
+
+	// assert
+	assert.Equal(t, entry.Key, parsedEntry.Key)
+	assert.Equal(t, KindTombstone, parsedEntry.Kind)
+	assert.Empty(t, parsedEntry.Value)
+}
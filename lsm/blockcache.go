@@ -0,0 +1,123 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockCache is a LRU cache of parsed sstable blocks. It's shared by all
+// tables of a tree (or a few trees), so its size limit is a limit on the
+// whole process. Blocks are read fully into memory before getting cached,
+// so a cached block doesn't depend on its table file staying open.
+//
+// A nil *BlockCache is valid and caches nothing.
+type BlockCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	lru      *list.List // front is the most recently used
+	items    map[blockCacheKey]*list.Element
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// blockCacheKey identifies a block by its table and offset in the table file.
+type blockCacheKey struct {
+	table  uint64 // SSTable.id, unique per opened table
+	offset uint64
+}
+
+type blockCacheItem struct {
+	key   blockCacheKey
+	block *Block
+	size  int
+}
+
+// BlockCacheStats is a snapshot of cache counters.
+type BlockCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int // bytes of blocks held now
+	Capacity  int
+}
+
+func NewBlockCache(capacity int) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    make(map[blockCacheKey]*list.Element),
+	}
+}
+
+func (c *BlockCache) Get(key blockCacheKey) (*Block, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	c.lru.MoveToFront(el)
+	return el.Value.(*blockCacheItem).block, true
+}
+
+// Put caches a block of size bytes, evicting least recently used blocks to
+// make room. A block bigger than the whole cache isn't cached.
+func (c *BlockCache) Put(key blockCacheKey, block *Block, size int) {
+	if c == nil || size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		// someone else read the same block concurrently, keep theirs
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	for c.size+size > c.capacity {
+		c.evict(c.lru.Back())
+	}
+
+	c.items[key] = c.lru.PushFront(&blockCacheItem{key, block, size})
+	c.size += size
+}
+
+// caller must hold mu
+func (c *BlockCache) evict(el *list.Element) {
+	item := c.lru.Remove(el).(*blockCacheItem)
+	delete(c.items, item.key)
+	c.size -= item.size
+	c.evictions.Add(1)
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	if c == nil {
+		return BlockCacheStats{}
+	}
+
+	c.mu.Lock()
+	size := c.size
+	c.mu.Unlock()
+
+	return BlockCacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      size,
+		Capacity:  c.capacity,
+	}
+}
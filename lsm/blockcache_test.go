@@ -0,0 +1,63 @@
+package lsm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// arrange
+	cache := NewBlockCache(100)
+	a, b, c := &Block{}, &Block{}, &Block{}
+	cache.Put(blockCacheKey{1, 0}, a, 40)
+	cache.Put(blockCacheKey{1, 40}, b, 40)
+
+	// act
+	cache.Get(blockCacheKey{1, 0}) // a is used more recently than b now
+	cache.Put(blockCacheKey{2, 0}, c, 40)
+
+	// assert
+	got, ok := cache.Get(blockCacheKey{1, 0})
+	assert.True(t, ok)
+	assert.Same(t, a, got)
+
+	_, ok = cache.Get(blockCacheKey{1, 40})
+	assert.False(t, ok)
+
+	got, ok = cache.Get(blockCacheKey{2, 0})
+	assert.True(t, ok)
+	assert.Same(t, c, got)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 80, stats.Size)
+}
+
+func TestSSTableGetUsesBlockCache(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.BlockCache = NewBlockCache(1 << 20)
+	mem := NewMemtable()
+	mem.Apply(put("a", "1"))
+	mem.Apply(put("b", "2"))
+	sst, err := SSTableFromReadonlyMemtable(
+		mem.AsReadonly(), t.TempDir()+"/cache.sst", opts)
+	assert.NoError(t, err)
+
+	// act
+	v1, err1 := sst.Get([]byte("a"))
+	v2, err2 := sst.Get([]byte("b"))
+
+	// assert
+	assert.NoError(t, err1)
+	assert.NoError(t, err2)
+	assert.Equal(t, []byte("1"), v1)
+	assert.Equal(t, []byte("2"), v2)
+
+	stats := opts.BlockCache.Stats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Hits)
+}
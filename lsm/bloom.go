@@ -0,0 +1,67 @@
+package lsm
+
+// BloomFilter tells for sure that a key is not in a set, or that it may be.
+// Like in leveldb, k hash functions are derived from a single hash with
+// double hashing. The last byte of the filter holds k.
+type BloomFilter []byte
+
+// NewBloomFilter builds a filter out of key hashes (see bloomHash). With ~10
+// bits per key the false positive rate is about 1%.
+func NewBloomFilter(hashes []uint32, bitsPerKey int) BloomFilter {
+	// k = ln(2) * bits per key minimizes the false positive rate
+	k := min(max(bitsPerKey*69/100, 1), 30)
+
+	bits := max(len(hashes)*bitsPerKey, 64)
+	nbytes := (bits + 7) / 8
+	bits = nbytes * 8
+
+	filter := make(BloomFilter, nbytes+1)
+	filter[nbytes] = byte(k)
+
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for i := 0; i < k; i++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+
+	return filter
+}
+
+func (f BloomFilter) MayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+
+	bits := uint32(len(f)-1) * 8
+	k := int(f[len(f)-1])
+	if k > 30 {
+		// not something we've written, don't filter anything out
+		return true
+	}
+
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for i := 0; i < k; i++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+
+	return true
+}
+
+// bloomHash is 32-bit FNV-1a.
+func bloomHash(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	return h
+}
@@ -0,0 +1,77 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	// arrange
+	hashes := make([]uint32, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key%d", i))))
+	}
+
+	// act
+	filter := NewBloomFilter(hashes, 10)
+
+	// assert
+	for i := 0; i < 1000; i++ {
+		assert.True(t, filter.MayContain([]byte(fmt.Sprintf("key%d", i))))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.MayContain([]byte(fmt.Sprintf("other%d", i))) {
+			falsePositives++
+		}
+	}
+	// ~1% expected, leave some room
+	assert.Less(t, falsePositives, 300)
+}
+
+func TestSSTableBloomFilter(t *testing.T) {
+	// arrange
+	sst := testSSTable(t, "bloom.sst",
+		Entry{Key: []byte("a"), Value: []byte("1")},
+		Entry{Key: []byte("c"), Kind: KindTombstone},
+		Entry{Key: []byte("e"), Value: []byte("3")},
+	)
+
+	// act
+	reopened, err := SSTableFromFile(sst.file, nil)
+
+	// assert
+	assert.NoError(t, err)
+	assert.NotEmpty(t, reopened.filter)
+	assert.True(t, reopened.Exist([]byte("a")))
+	assert.True(t, reopened.Exist([]byte("c")))
+	assert.False(t, reopened.Exist([]byte("b")))
+	assert.False(t, reopened.Exist([]byte("z")))
+
+	v, err := reopened.Get([]byte("e"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), v)
+}
+
+func TestSSTableWithoutBloomFilter(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.BloomBitsPerKey = 0
+	mem := NewMemtable()
+	mem.Apply(put("a", "1"))
+	sst, err := SSTableFromReadonlyMemtable(
+		mem.AsReadonly(), t.TempDir()+"/nobloom.sst", opts)
+	assert.NoError(t, err)
+
+	// act
+	reopened, err := SSTableFromFile(sst.file, nil)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Nil(t, reopened.filter)
+	assert.True(t, reopened.Exist([]byte("a")))
+	assert.False(t, reopened.Exist([]byte("b")))
+}
@@ -0,0 +1,214 @@
+package lsm
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+)
+
+// Checkpoint writes a consistent copy of the tree to dir, e.g. for backups.
+// dir must not exist yet. Recover on it gives the tree as it was once
+// Checkpoint flushed memtables: tables and blob files are hard linked, or
+// copied when dir is on another file system, and writes which came during the
+// flush go to a wal of the checkpoint.
+//
+// Writers are held back only while the memtable is rotated for the flush,
+// the rest runs alongside writes and compactions. The checkpoint is built in
+// a temporary dir next to dir, which is renamed to dir when it's complete.
+func (tree *LSMTree) Checkpoint(dir string) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(absdir); err == nil {
+		return fmt.Errorf("checkpoint dir %s already exists", absdir)
+	}
+
+	// most of the tree goes to tables this way, the wal of the checkpoint
+	// only gets what's written meanwhile
+	if err := tree.flushMemtable(context.Background()); err != nil {
+		return err
+	}
+
+	// writers go on while the state is taken: writes newer than seq are just
+	// left out. Tables and blob files are referenced, so compactions can't
+	// remove them before they are linked
+	tree.rodataGuard.RLock()
+	if tree.closed {
+		tree.rodataGuard.RUnlock()
+		return ErrClosed
+	}
+
+	seq := tree.seq.Load()
+	edit := tree.manifest.current.snapshot()
+	edit.nextFile = max(edit.nextFile, tree.nextFile.Load())
+	mems := []*Memtable{tree.mem}
+	for _, m := range tree.memro {
+		mems = append(mems, &m.table)
+	}
+
+	tables := slices.Clone(tree.lvl0)
+	for _, lvl := range tree.lvln {
+		tables = append(tables, lvl...)
+	}
+	for _, sst := range tables {
+		sst.Ref()
+	}
+	blobs := tree.blobs.refAll()
+	tree.rodataGuard.RUnlock()
+
+	defer func() {
+		for _, sst := range tables {
+			sst.Unref()
+		}
+		for _, f := range blobs {
+			f.Unref()
+		}
+	}()
+
+	tmp := absdir + ".tmp"
+	if err := os.Mkdir(tmp, 0777); err != nil {
+		return fmt.Errorf("making checkpoint dir: %w", err)
+	}
+
+	err = writeCheckpoint(tmp, edit, tables, blobs, logged(mems, edit.lastSeq, seq))
+	if err == nil {
+		err = os.Rename(tmp, absdir)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(absdir))
+	}
+
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// writeCheckpoint fills dir with files of a tree: tables and blob files of
+// the version edit creates, and entries to replay from the wal.
+func writeCheckpoint(
+	dir string,
+	edit versionEdit,
+	tables []*SSTable,
+	blobs blobFiles,
+	entries []Entry,
+) error {
+	for _, sst := range tables {
+		if err := linkOrCopy(sst.Path(), path.Join(dir, filepath.Base(sst.Path()))); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range blobs {
+		if err := linkOrCopy(f.file.Name(), path.Join(dir, filepath.Base(f.file.Name()))); err != nil {
+			return err
+		}
+	}
+
+	// the wal always goes next to the tables in the checkpoint
+	wal, err := OpenWal(path.Join(dir, "WAL"), Options{WalSync: WalSyncNone})
+	if err != nil {
+		return err
+	}
+
+	// batches carry the seq of their first entry only, so a run of
+	// consecutive seqs goes as one
+	for len(entries) > 0 {
+		n := 1
+		for n < len(entries) && entries[n].Seq == entries[n-1].Seq+1 {
+			n++
+		}
+
+		if err := wal.AppendBatch(entries[:n]); err != nil {
+			wal.Close()
+			return err
+		}
+		entries = entries[n:]
+	}
+
+	if err := wal.Close(); err != nil {
+		return err
+	}
+
+	var v version
+	v.apply(edit)
+	v.walDir = "WAL"
+	num := v.nextFile
+	v.nextFile++
+	m, err := createManifest(dir, num, v)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(m.Close(), syncDir(path.Join(dir, "WAL")), syncDir(dir))
+}
+
+// logged collects entries of memtables in (from, to] ordered by seq, range
+// tombstones included.
+func logged(mems []*Memtable, from, to uint64) []Entry {
+	var entries []Entry
+	keep := func(e Entry) bool {
+		if e.Seq > from && e.Seq <= to {
+			entries = append(entries, e)
+		}
+		return true
+	}
+
+	for _, m := range mems {
+		m.Range(keep)
+		for _, t := range m.rangeTombstones() {
+			keep(t.entry())
+		}
+	}
+
+	slices.SortFunc(entries, func(a, b Entry) int {
+		return cmp.Compare(a.Seq, b.Seq)
+	})
+
+	return entries
+}
+
+// linkOrCopy hard links src to dst, or copies it when linking fails, e.g.
+// across file systems.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("copying %s: %w", src, err)
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
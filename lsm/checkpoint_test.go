@@ -0,0 +1,136 @@
+package lsm
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpoint(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := arrangeRangeTree(t, dir)
+	defer tree.Close()
+	assert.NoError(t, tree.Del([]byte("rec_a2")))
+	ckpt := path.Join(t.TempDir(), "checkpoint")
+
+	// act
+	err := tree.Checkpoint(ckpt)
+	tables, _ := filepath.Glob(path.Join(ckpt, "*"+sstFileExt))
+	linked := make([]bool, 0, len(tables))
+	for _, p := range tables {
+		src, errSrc := os.Stat(path.Join(dir, filepath.Base(p)))
+		dst, errDst := os.Stat(p)
+		linked = append(linked, errSrc == nil && errDst == nil && os.SameFile(src, dst))
+	}
+	// not in the checkpoint
+	assert.NoError(t, tree.Put([]byte("rec_c1"), []byte("1")))
+	flushAndCompact(t, tree)
+
+	// assert
+	// tables are shared with the tree
+	assert.NoError(t, err)
+	assert.NoDirExists(t, ckpt+".tmp")
+	assert.NotEmpty(t, tables)
+	assert.NotContains(t, linked, false)
+
+	recovered, err := Recover(context.Background(), ckpt, DefaultOptions)
+	assert.NoError(t, err)
+	defer recovered.Close()
+
+	it := recovered.NewIterator(nil, nil)
+	defer it.Close()
+	it.First()
+	assert.Equal(t, []string{"rec_a1", "rec_a3", "rec_b1", "rec_b2"}, collectKeys(it, true))
+	assert.NoError(t, it.Err())
+}
+
+func TestCheckpointWal(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	flushAndCompact(t, tree)
+
+	// writes which came while memtables were flushed, the last one came
+	// after the checkpoint took its seq
+	seq := tree.seq.Load()
+	mem := NewMemtable()
+	assert.NoError(t, mem.Apply(Entry{Key: []byte("b"), Value: []byte("1"), Seq: seq + 1}))
+	assert.NoError(t, mem.Apply(Entry{Key: []byte("a"), Value: []byte("b"), Kind: KindRangeDelete, Seq: seq + 2}))
+	assert.NoError(t, mem.Apply(Entry{Key: []byte("c"), Value: []byte("1"), Seq: seq + 3}))
+	assert.NoError(t, mem.Apply(Entry{Key: []byte("d"), Value: []byte("1"), Seq: seq + 4}))
+
+	ckpt := path.Join(t.TempDir(), "checkpoint")
+	assert.NoError(t, os.Mkdir(ckpt, 0777))
+
+	// act
+	tree.rodataGuard.RLock()
+	edit := tree.manifest.current.snapshot()
+	tables := slices.Clone(tree.lvln[0])
+	tree.rodataGuard.RUnlock()
+	entries := logged([]*Memtable{mem}, edit.lastSeq, seq+3)
+	err = writeCheckpoint(ckpt, edit, tables, nil, entries)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	recovered, err := Recover(context.Background(), ckpt, DefaultOptions)
+	assert.NoError(t, err)
+	defer recovered.Close()
+
+	assert.Equal(t, seq+3, recovered.seq.Load())
+	it := recovered.NewIterator(nil, nil)
+	defer it.Close()
+	it.First()
+	assert.Equal(t, []string{"b", "c"}, collectKeys(it, true))
+}
+
+func TestCheckpointBlobs(t *testing.T) {
+	// arrange
+	tree := blobTree(t, t.TempDir())
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), bigValue('a')))
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Put([]byte("b"), bigValue('b')))
+	ckpt := path.Join(t.TempDir(), "checkpoint")
+
+	// act
+	err := tree.Checkpoint(ckpt)
+
+	// assert
+	assert.NoError(t, err)
+	recovered := blobTree(t, ckpt)
+	defer recovered.Close()
+
+	assert.Equal(t, tree.BlobStats(), recovered.BlobStats())
+	for k, want := range map[string][]byte{"a": bigValue('a'), "b": bigValue('b')} {
+		v, err := recovered.Get([]byte(k))
+		assert.NoError(t, err)
+		assert.Equal(t, want, v, k)
+	}
+}
+
+func TestCheckpointExistingDir(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	readOnly, err := OpenReadOnly(tree.dir, nil)
+	assert.NoError(t, err)
+	defer readOnly.Close()
+
+	// act & assert
+	assert.Error(t, tree.Checkpoint(t.TempDir()))
+	assert.ErrorIs(t, readOnly.Checkpoint(path.Join(t.TempDir(), "checkpoint")), ErrReadOnly)
+}
@@ -0,0 +1,83 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ErrCorruption is matched (with errors.Is) by every error reporting data on
+// disk which doesn't pass its checksum or doesn't make sense.
+var ErrCorruption = errors.New("corruption")
+
+// CorruptionError tells where corrupted data was found. File is empty when the
+// data wasn't read from a file directly, Offset is then relative to whatever
+// was read.
+type CorruptionError struct {
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corruption in %s at %d: %s", e.File, e.Offset, e.Reason)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+// checksumSize is the size of crc32c trailer of sstable blocks, index and
+// footer.
+const checksumSize = 4
+
+// appendChecksum appends crc32c of buf to buf.
+func appendChecksum(buf []byte) []byte {
+	return binary.LittleEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+}
+
+// verifyChecksum cuts the crc32c trailer off buf, ok is false when the
+// trailer is missing or doesn't match.
+func verifyChecksum(buf []byte) (body []byte, ok bool) {
+	if len(buf) < checksumSize {
+		return nil, false
+	}
+
+	body = buf[:len(buf)-checksumSize]
+	crc := binary.LittleEndian.Uint32(buf[len(body):])
+	return body, crc32.Checksum(body, crcTable) == crc
+}
+
+// withLocation fills in the file and base offset of a CorruptionError found
+// in a part of the file, other errors are returned as is.
+func withLocation(err error, file string, base int64) error {
+	var cerr *CorruptionError
+	if errors.As(err, &cerr) && cerr.File == "" {
+		return &CorruptionError{
+			File:   file,
+			Offset: base + cerr.Offset,
+			Reason: cerr.Reason,
+		}
+	}
+
+	return err
+}
+
+// withBlockLocation is withLocation for errors found in a block read from
+// file at offset. Offsets within a block are of its decompressed body, which
+// don't map to the file, so the block's own offset is reported and the one
+// within the block goes to the reason.
+func withBlockLocation(err error, file string, offset int64) error {
+	var cerr *CorruptionError
+	if errors.As(err, &cerr) && cerr.File == "" {
+		reason := cerr.Reason
+		if cerr.Offset != 0 {
+			reason = fmt.Sprintf("%s (at %d in the block)", reason, cerr.Offset)
+		}
+
+		return &CorruptionError{File: file, Offset: offset, Reason: reason}
+	}
+
+	return err
+}
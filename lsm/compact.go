@@ -1,22 +1,71 @@
 package lsm
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
-	"strconv"
+	"slices"
+	"sync"
+	"sync/atomic"
 )
 
 type CompactorHandle struct {
-	triggerc chan struct{}
-	waitc    chan struct{}
+	triggerc chan struct{}   // buffered, a pending trigger is enough
+	bg       *sync.WaitGroup // compactions running in background
+	stopc    chan struct{}   // closed to stop the compactor
+	donec    chan struct{}   // closed once the compactor has stopped
+	// flushes readonly memtables on demand, the result is sent back
+	flushc chan chan error
+	ctl    *compactionControl
 }
 
 func (c *CompactorHandle) Triggerc() chan<- struct{} {
 	return c.triggerc
 }
 
-func (c *CompactorHandle) Waitc() chan<- struct{} {
-	return c.waitc
+// trigger makes the compactor run once it's done with what it's doing now,
+// without waiting for it.
+func (c *CompactorHandle) trigger() {
+	select {
+	case c.triggerc <- struct{}{}:
+	default:
+		// already triggered
+	}
+}
+
+// flush makes the compactor flush readonly memtables and run compactions they
+// lead to, then waits for it.
+func (c *CompactorHandle) flush(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case c.flushc <- done:
+	case <-c.stopc:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WaitBackground blocks until background compactions of deeper levels finish.
+func (c *CompactorHandle) WaitBackground() {
+	c.bg.Wait()
+}
+
+// stop makes the compactor return once it's done with the current compaction
+// and waits for that, background compactions included.
+func (c *CompactorHandle) stop() {
+	close(c.stopc)
+	<-c.donec
+	c.bg.Wait()
 }
 
 // TODO stopping/killing program while compacting will put it int inconsistent
@@ -25,9 +74,100 @@ type Compactor struct {
 	handle CompactorHandle
 	tree   *LSMTree
 	opt    Options
+	// compactions of disjoint levels run alongside each other, flushes only
+	// add L0 tables
+	levels *levelLocks
+	// an L0 compaction was skipped as its levels were busy, the compaction
+	// holding them triggers the compactor once it's done
+	l0Pending atomic.Bool
+	// compactions of disjoint levels run concurrently, the compaction filter
+	// is still called by one of them at a time
+	filterMu sync.Mutex
+}
+
+// levelLocks keep compactions of the same levels apart. A compaction locks
+// every level from its shallowest input down to its output, the levels in
+// between must stay empty while it runs.
+type levelLocks struct {
+	mu   sync.Mutex
+	cond *sync.Cond // broadcast when levels are unlocked
+	busy map[int]bool
+}
+
+func newLevelLocks() *levelLocks {
+	l := &levelLocks{busy: make(map[int]bool)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// free tells if none of levels from..to is locked. Caller must hold mu.
+func (l *levelLocks) free(from, to int) bool {
+	for n := from; n <= to; n++ {
+		if l.busy[n] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// take locks levels from..to, caller must hold mu and make sure they're free.
+func (l *levelLocks) take(from, to int) {
+	for n := from; n <= to; n++ {
+		l.busy[n] = true
+	}
+}
+
+// lock waits for levels from..to to be free and locks them.
+func (l *levelLocks) lock(from, to int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for !l.free(from, to) {
+		l.cond.Wait()
+	}
+	l.take(from, to)
+}
+
+func (l *levelLocks) unlock(from, to int) {
+	l.mu.Lock()
+	for n := from; n <= to; n++ {
+		delete(l.busy, n)
+	}
+	l.mu.Unlock()
+
+	l.cond.Broadcast()
+}
+
+// waitIdle blocks until no level is locked.
+func (l *levelLocks) waitIdle() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for len(l.busy) > 0 {
+		l.cond.Wait()
+	}
+}
+
+func newCompactor(tree *LSMTree, opt Options) *Compactor {
+	return &Compactor{
+		handle: CompactorHandle{
+			triggerc: make(chan struct{}, 1),
+			bg:       new(sync.WaitGroup),
+			stopc:    make(chan struct{}),
+			donec:    make(chan struct{}),
+			flushc:   make(chan chan error),
+			ctl:      newCompactionControl(),
+		},
+		tree:   tree,
+		opt:    opt,
+		levels: newLevelLocks(),
+	}
 }
 
 func (c *Compactor) Listen(ctx context.Context) {
+	defer close(c.handle.donec)
+
 	for {
 		select {
 		case <-c.handle.triggerc:
@@ -36,127 +176,851 @@ func (c *Compactor) Listen(ctx context.Context) {
 			// rest of compaction asynchronously (e.g. memro and L0 are full,
 			// we merge L0 and L1, put memro into L0, thus memro is
 			// now free and if L1 needs to be merged into L2, we can do it
-			// asynchronously), in order to release c.waitc faster
-			c.compact()
-		case <-c.handle.waitc:
-			slog.Debug("go go go")
+			// asynchronously), in order to release stalled writers faster
+			if err := c.compact(ctx); err != nil {
+				slog.Error("compaction failed", "err", err)
+			}
+		case done := <-c.handle.flushc:
+			done <- c.compact(ctx)
+		case <-c.handle.stopc:
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (c *Compactor) compact() error {
-	// if L0 has sufficient space, just dump readonly memtables into it
-	if len(c.tree.lvl0)+len(c.tree.memro) <= c.opt.MaxL0Tables {
-		for _, r := range c.tree.memro {
-			sst, err := SSTableFromReadonlyMemtable(
-				*r,
-				"SST_L0_"+strconv.Itoa(len(c.tree.lvl0)), // TODO filename
-				c.opt,
-			)
-			if err != nil {
-				return err
+func (c *Compactor) compact(ctx context.Context) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+
+	// compactions involving L0 run right away: the policy may need them to
+	// keep L0 small, and they can't run alongside flushes since order of L0
+	// tables is the order they were added in
+	if err := c.compactL0(ctx); err != nil {
+		return err
+	}
+
+	// deeper levels are compacted in background. We freed mem, romem, and
+	// L0 space for LSM tree to function properly, there is no need here to
+	// block on full compaction
+	c.handle.bg.Add(1)
+	go func() {
+		defer c.handle.bg.Done()
+		c.compactFull(ctx)
+	}()
+
+	return nil
+}
+
+// compactL0 runs compactions picked by the policy as long as they involve L0
+// and compaction is not paused. It doesn't wait for a compaction of deeper
+// levels which holds L1, as flushes would wait too: that one triggers the
+// compactor again once it's done.
+func (c *Compactor) compactL0(ctx context.Context) error {
+	for !c.handle.ctl.isPaused() {
+		comp, ok := c.next(true, false)
+		if !ok {
+			return nil
+		}
+
+		err := c.run(ctx, comp)
+		c.release(comp.levels())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compactFull runs compactions picked by the policy until the tree is in
+// shape or compaction is paused, the ones involving L0 are left for compactL0.
+func (c *Compactor) compactFull(ctx context.Context) {
+	for !c.handle.ctl.isPaused() {
+		comp, ok := c.next(false, true)
+		if !ok {
+			return
+		}
+		if c.handle.ctl.isPaused() {
+			// paused while waiting for the levels
+			c.release(comp.levels())
+			return
+		}
+
+		err := c.run(ctx, comp)
+		c.release(comp.levels())
+		if err != nil {
+			slog.Error("level compaction failed", "output", comp.Output, "err", err)
+			return
+		}
+	}
+}
+
+// next picks a compaction which involves L0 or not as l0 tells and locks its
+// levels, so the picked tables don't go away before it runs. When other
+// compactions hold the levels, it waits for them and picks again if wait is
+// set, otherwise ok is false. The levels are unlocked with release.
+func (c *Compactor) next(l0, wait bool) (Compaction, bool) {
+	c.levels.mu.Lock()
+	defer c.levels.mu.Unlock()
+
+	for {
+		comp, ok := c.pick()
+		if !ok || comp.involvesL0() != l0 {
+			return Compaction{}, false
+		}
+
+		from, to := comp.levels()
+		if c.levels.free(from, to) {
+			c.levels.take(from, to)
+			return comp, true
+		}
+
+		if !wait {
+			if l0 {
+				c.l0Pending.Store(true)
+			}
+			return Compaction{}, false
+		}
+		c.levels.cond.Wait()
+	}
+}
+
+// release unlocks levels from..to, and triggers the compactor when an L0
+// compaction was skipped while they were locked.
+func (c *Compactor) release(from, to int) {
+	c.levels.unlock(from, to)
+	if c.l0Pending.Swap(false) {
+		c.handle.trigger()
+	}
+}
+
+// pick asks the policy for the next compaction. Caller must hold levels.mu,
+// so the policy is called by one goroutine at a time.
+func (c *Compactor) pick() (Compaction, bool) {
+	c.tree.rodataGuard.RLock()
+	l := Layout{
+		L0:     slices.Clone(c.tree.lvl0),
+		Levels: slices.Clone(c.tree.lvln),
+		Opts:   c.opt,
+	}
+	c.tree.rodataGuard.RUnlock()
+
+	return c.opt.CompactionPolicy.Pick(l)
+}
+
+// run carries out a compaction, caller must hold locks of its levels. Tables
+// of a level are only replaced by the holder of its lock and flushes only add
+// L0 tables, so the input tables are safe to read without holding rodataGuard.
+func (c *Compactor) run(ctx context.Context, comp Compaction) error {
+	c.tree.rodataGuard.RLock()
+	err := comp.check(c.tree.lvl0, c.tree.lvln)
+	var target []*SSTable
+	if !comp.Drop && comp.Output > 0 && comp.Output <= len(c.tree.lvln) {
+		target = c.tree.lvln[comp.Output-1]
+	}
+	bottom := c.isBottom(comp)
+	tables := slices.Clone(c.tree.lvl0)
+	for _, lvl := range c.tree.lvln {
+		tables = append(tables, lvl...)
+	}
+	c.tree.rodataGuard.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	inputs := slices.Clone(comp.Inputs)
+	slices.SortFunc(inputs, func(a, b LevelTables) int { return a.Level - b.Level })
+
+	// tables of the output level overlapping the inputs are merged in too
+	var overlapping []*SSTable
+	if !comp.Drop && comp.Output > 0 {
+		first, last := inputsRange(inputs)
+		for _, sst := range overlappingTables(target, first, last) {
+			if !inputsContain(inputs, comp.Output, sst) {
+				overlapping = append(overlapping, sst)
+			}
+		}
+	}
+
+	var out []*SSTable
+	var blobs blobChanges
+	moved := false
+	switch {
+	case comp.Drop:
+		slog.Debug("dropping tables", "tables", inputsLen(inputs))
+
+		// values dropped tables point to are garbage now
+		var dropped []*SSTable
+		for _, in := range inputs {
+			dropped = append(dropped, in.Tables...)
+		}
+		if blobs.garbage, err = tablesGarbage(dropped); err != nil {
+			return err
+		}
+	case comp.Output > 0 && inputsLen(inputs) == 1 && len(overlapping) == 0 &&
+		inputs[0].Level != comp.Output && inputs[0].Level > 0:
+		// nothing to merge with, the table is just moved down. L0 tables
+		// are rewritten anyway: flushes keep every version and don't
+		// compress as deeper levels do
+		moved = true
+		out = inputs[0].Tables
+		slog.Debug("moving table down", "level", inputs[0].Level,
+			"output", comp.Output, "table", out[0].Path())
+	default:
+		slog.Debug("compacting", "tables", inputsLen(inputs),
+			"overlapping", len(overlapping), "output", comp.Output)
+
+		// newer data must come first in merge: newer L0 tables come later in
+		// the level, while shallower levels are newer than deeper ones
+		children := make([]Iter[Entry], 0)
+		for _, in := range inputs {
+			if in.Level == 0 {
+				for i := len(in.Tables) - 1; i >= 0; i-- {
+					children = append(children, in.Tables[i].Iter())
+				}
+				continue
+			}
+
+			// output level inputs are merged together with overlapping tables,
+			// they are all of the same level
+			tables := slices.Clone(in.Tables)
+			if in.Level == comp.Output {
+				tables = append(tables, overlapping...)
+			}
+			children = append(children, newLevelIter(sortedTables(tables)))
+		}
+		if len(overlapping) > 0 && inputs[len(inputs)-1].Level != comp.Output {
+			children = append(children, newLevelIter(overlapping))
+		}
+
+		// range tombstones go along with the data, the rest of the tree
+		// decides which of them are still needed
+		merging := slices.Clone(overlapping)
+		for _, in := range inputs {
+			merging = append(merging, in.Tables...)
+		}
+		var rangeDels rangeTombstones
+		for _, sst := range merging {
+			rangeDels = append(rangeDels, sst.rangeDels...)
+		}
+		sortRangeTombstones(rangeDels)
+
+		out, blobs, err = c.writeMerged(ctx, children, rangeDels,
+			withoutTables(tables, merging), comp.Output, bottom)
+		if err != nil {
+			return err
+		}
+
+		// the manifest is about to refer to the new files, their dir
+		// entries must survive a crash as well
+		if err := syncDir(c.tree.dir); err != nil {
+			discard(out)
+			discardBlobs(blobs.added)
+			return fmt.Errorf("syncing tree dir: %w", err)
+		}
+	}
+
+	c.tree.rodataGuard.Lock()
+	oldLvl0, oldLvln := c.tree.lvl0, slices.Clone(c.tree.lvln)
+	var edit versionEdit
+	for _, in := range inputs {
+		edit.removed = append(edit.removed, tableRefs(in.Level, in.Tables)...)
+		if in.Level == 0 {
+			c.tree.lvl0 = withoutTables(c.tree.lvl0, in.Tables)
+		} else {
+			c.tree.lvln[in.Level-1] = withoutTables(c.tree.lvln[in.Level-1], in.Tables)
+		}
+	}
+	if !comp.Drop {
+		edit.removed = append(edit.removed, tableRefs(comp.Output, overlapping)...)
+		edit.added = tableRefs(comp.Output, out)
+		if comp.Output == 0 {
+			c.tree.lvl0 = append(c.tree.lvl0, out...)
+		} else {
+			for len(c.tree.lvln) < comp.Output {
+				c.tree.lvln = append(c.tree.lvln, nil)
+			}
+			c.tree.lvln[comp.Output-1] = replaceTables(
+				c.tree.lvln[comp.Output-1], overlapping, out)
+		}
+	}
+	c.tree.blobs.edit(&edit, blobs)
+	err = c.tree.logEdit(edit)
+	if err != nil {
+		c.tree.lvl0, c.tree.lvln = oldLvl0, oldLvln
+	} else {
+		c.tree.blobs.apply(edit, blobs)
+	}
+	c.tree.rodataGuard.Unlock()
+
+	if err != nil {
+		if !moved {
+			discard(out)
+		}
+		discardBlobs(blobs.added)
+		return err
+	}
+
+	c.handle.ctl.compactions.Add(1)
+	c.handle.ctl.notifyChanged()
+	if !moved {
+		c.handle.ctl.bytesWritten.Add(uint64(levelSize(out)))
+		for _, in := range inputs {
+			discard(in.Tables)
+		}
+		discard(overlapping)
+	}
+
+	return nil
+}
+
+// check tells if the compaction refers to tables of the tree and keeps newer
+// data above older one, see Compaction. Caller must hold rodataGuard.
+func (comp Compaction) check(lvl0 []*SSTable, lvln [][]*SSTable) error {
+	level := func(n int) []*SSTable {
+		if n == 0 {
+			return lvl0
+		}
+		if n <= len(lvln) {
+			return lvln[n-1]
+		}
+		return nil
+	}
+
+	if inputsLen(comp.Inputs) == 0 {
+		return errors.New("compaction has no input tables")
+	}
+
+	for _, in := range comp.Inputs {
+		for _, sst := range in.Tables {
+			if !slices.Contains(level(in.Level), sst) {
+				return fmt.Errorf("compaction input %s is not at L%d", sst.Path(), in.Level)
+			}
+		}
+
+		if comp.Drop {
+			continue
+		}
+
+		if in.Level > comp.Output || (comp.Output == 0 && in.Level != 0) {
+			return fmt.Errorf("compaction moves L%d up to L%d", in.Level, comp.Output)
+		}
+		for n := in.Level + 1; n < comp.Output; n++ {
+			if len(level(n)) > 0 {
+				return fmt.Errorf("compaction from L%d to L%d skips non-empty L%d",
+					in.Level, comp.Output, n)
+			}
+		}
+
+		if in.Level != 0 {
+			continue
+		}
+		// L0 inputs must be the newest tables going to L0 and the oldest ones
+		// going deeper
+		var expected []*SSTable
+		if comp.Output == 0 {
+			expected = lvl0[len(lvl0)-min(len(in.Tables), len(lvl0)):]
+		} else {
+			expected = lvl0[:min(len(in.Tables), len(lvl0))]
+		}
+		for _, sst := range expected {
+			if !slices.Contains(in.Tables, sst) {
+				return fmt.Errorf("compaction of L0 into L%d skips %s", comp.Output, sst.Path())
 			}
+		}
+	}
+
+	return nil
+}
+
+// isBottom tells if the compaction output has nothing older below it, so
+// tombstones have nothing to shadow. Caller must hold rodataGuard.
+func (c *Compactor) isBottom(comp Compaction) bool {
+	if comp.Output > 0 {
+		return c.isBottomLevel(comp.Output)
+	}
 
-			c.tree.lvl0 = append(c.tree.lvl0, &sst)
+	// the oldest L0 table must be among inputs when merging into L0
+	for _, in := range comp.Inputs {
+		if len(c.tree.lvl0) > 0 && slices.Contains(in.Tables, c.tree.lvl0[0]) {
+			return c.isBottomLevel(0)
 		}
+	}
+
+	return false
+}
+
+// isBottomLevel tells if nothing is stored below level n (L1 is n=1).
+func (c *Compactor) isBottomLevel(n int) bool {
+	for _, lvl := range c.tree.lvln[min(n, len(c.tree.lvln)):] {
+		if len(lvl) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// flush writes readonly memtables to L0 sstables, then drops them from memro
+// together with their wal segments.
+func (c *Compactor) flush() error {
+	c.tree.rodataGuard.RLock()
+	memro := slices.Clone(c.tree.memro)
+	c.tree.rodataGuard.RUnlock()
 
+	if len(memro) == 0 {
 		return nil
 	}
 
-	// otherwise, dump L0 into L1 first, then put readonly memtables to L0
+	// memro tables are never modified so it's fine to read them unlocked
+	flushed := make([]*SSTable, 0, len(memro))
+	bw := newBlobWriter(c.tree, context.Background(), IOPriorityHigh)
+	var lastSeq uint64
+	for _, r := range memro {
+		lastSeq = max(lastSeq, r.table.lastSeq.Load())
+		if r.Len() == 0 {
+			continue
+		}
+
+		sst, err := flushMemtable(*r, c.tree.newSSTablePath(), c.opt, bw)
+		if err != nil {
+			bw.abort()
+			return err
+		}
+
+		flushed = append(flushed, &sst)
+	}
+
+	added, err := bw.finish()
+	if err != nil {
+		discard(flushed)
+		return err
+	}
+	blobs := blobChanges{added: added}
+
+	// the wal is released once the manifest refers to the new files, their
+	// dir entries must survive a crash as well
+	if err := syncDir(c.tree.dir); err != nil {
+		discard(flushed)
+		discardBlobs(added)
+		return fmt.Errorf("syncing tree dir: %w", err)
+	}
+
+	// seqs of flushed tables are recorded, the wal holding them goes away
+	c.tree.rodataGuard.Lock()
+	edit := versionEdit{
+		lastSeq: lastSeq,
+		added:   tableRefs(0, flushed),
+	}
+	c.tree.blobs.edit(&edit, blobs)
+	err = c.tree.logEdit(edit)
+	if err == nil {
+		c.tree.blobs.apply(edit, blobs)
+		c.tree.lvl0 = append(c.tree.lvl0, flushed...)
+		c.tree.memro = c.tree.memro[len(memro):]
+	}
+	c.tree.rodataGuard.Unlock()
+
+	if err != nil {
+		discard(flushed)
+		discardBlobs(added)
+		return err
+	}
+
+	c.handle.ctl.notifyChanged()
+
+	// now that memtables are in the manifest their wal is not needed anymore
+	return c.tree.wal.Release(memro[len(memro)-1].walSegment)
+}
+
+// writeMerged merges children (from the newest to the oldest) into new
+// sstables of level n, each about the level table threshold in size. L0 output
+// is a single table, a sorted run. Nothing is written once ctx is done.
+//
+// Versions of a key which no reader can see are dropped: live snapshots split
+// seqs into stripes (a snapshot sees everything up to its seq), and only the
+// newest version of a key in every stripe is kept. Snapshots taken after the
+// compaction started see every version of the input, so the newest stripe
+// has them covered. When the output goes to the bottom level, tombstones of
+// the oldest stripe have nothing left to shadow and are dropped, so are
+// entries removed by the compaction filter.
+//
+// Merge operands are combined with the value or tombstone under them in their
+// stripe. Operands with nothing under them are merged into a value at the
+// bottom level, elsewhere they're kept, folded into one by a PartialMerger.
+//
+// Versions deleted by rangeDels (range tombstones of the merged tables) in
+// their stripe are dropped. A range tombstone is dropped as well once it's in
+// the oldest stripe and no table of others (the rest of the tree) has keys
+// in its range, otherwise it goes to the output table its start falls into.
+//
+// Big values are written to new blob files. Values of blob files with enough
+// garbage are read and written again, the rest of the pointers are copied.
+// Values the input points to and the output doesn't are garbage now.
+func (c *Compactor) writeMerged(
+	ctx context.Context,
+	children []Iter[Entry],
+	rangeDels rangeTombstones,
+	others []*SSTable,
+	n int,
+	dropTombstones bool,
+) ([]*SSTable, blobChanges, error) {
 	var (
-		lvl1     = c.tree.lvln[0] // TODO: ensure no panic
-		lvl1Size = uint(0)
-		sst1Size = c.opt.L1Threshold / c.opt.MaxL1Tables
+		out        []*SSTable
+		w          *SSTableWriter
+		last       []byte
+		lastStripe int
+		// the newest version of last in its stripe is written, older ones
+		// are shadowed by it
+		resolved bool
+		// merge operands of last in its stripe, the newest first
+		operands []Entry
+		written  []byte // key of the entry written last
+		merged   int
+		err      error
+		// bytes of values pointed to by the input and by the output per
+		// blob file
+		blobsIn  = make(map[uint64]uint64)
+		blobsOut = make(map[uint64]uint64)
 	)
-	// since L0 isn't fully sorted (data is sorted only in individual
-	// tables, key range of one L0 table may overlap with key range of other L0
-	// table), we can't merge a L0 table into some exact 1-2 L1 tables (like we
-	// do when merging LN tables), one L0 table may eventually be distributed
-	// across multiple L1 tables or even whole L1 level.
-	// So what we do is just load whole L0 and L1 levels into memory and merge
-	// them. It can be done in a more optimized way but this is a toy lsm tree
-	// anyway.
-	lvl1Mem := make([]*Memtable, 0, len(lvl1))
-	for _, sst1 := range lvl1 {
-		lvl1Mem = append(lvl1Mem, MemtableFromSSTable(sst1))
-	}
-
-	for _, sst0 := range c.tree.lvl0 {
-		sst0Mem := MemtableFromSSTable(sst0)
-		newLvl1Mem, err := MergeWithMultiple(sst0Mem, lvl1Mem, sst1Size)
+
+	bw := newBlobWriter(c.tree, ctx, IOPriorityLow)
+	fail := func(err error) ([]*SSTable, blobChanges, error) {
+		if w != nil {
+			w.Abort()
+		}
+		discard(out)
+		bw.abort()
+		return nil, blobChanges{}, err
+	}
+
+	snapshots := c.tree.snapshots.live()
+	stripeOf := func(seq uint64) int {
+		stripe, _ := slices.BinarySearch(snapshots, seq)
+		return stripe
+	}
+
+	var keptDels rangeTombstones
+	for _, t := range rangeDels {
+		if stripeOf(t.seq) > 0 || slices.ContainsFunc(others, t.overlaps) {
+			keptDels = append(keptDels, t)
+		}
+	}
+
+	// covered tells if a range tombstone deletes e for every reader
+	covered := func(e Entry, stripe int) bool {
+		for _, t := range rangeDels {
+			if bytes.Compare(t.start, e.Key) > 0 {
+				break
+			}
+			if t.seq > e.Seq && t.contains(e.Key) && stripeOf(t.seq) == stripe {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// add writes e unless the filter or the tombstone rule drops it
+	add := func(e Entry, stripe int) error {
+		// the filter only sees versions no snapshot can read
+		if c.opt.CompactionFilter != nil && stripe == len(snapshots) &&
+			(e.Kind == KindValue || e.Kind == KindBlobIndex) {
+			var err error
+			if e, err = c.filter(n, e); err != nil {
+				return err
+			}
+		}
+
+		if dropTombstones && e.Kind == KindTombstone && stripe == 0 {
+			return nil
+		}
+
+		// versions of a key never span tables, so a table is cut only once
+		// a new key comes
+		if w != nil && n > 0 && !bytes.Equal(e.Key, written) &&
+			w.Size() >= c.opt.tableThreshold(n) {
+			sst, err := w.Finish()
+			w = nil
+			if err != nil {
+				return err
+			}
+			out = append(out, &sst)
+		}
+
+		if w == nil {
+			w, err = NewSSTableWriter(c.tree.newSSTablePath(), n, c.opt)
+			if err != nil {
+				return err
+			}
+			w.ctx = ctx
+			w.blobs = bw
+		}
+
+		// range tombstones starting up to here go to this table, so tables
+		// of the level stay apart
+		for len(keptDels) > 0 && bytes.Compare(keptDels[0].start, e.Key) <= 0 {
+			w.AddRangeTombstone(keptDels[0])
+			keptDels = keptDels[1:]
+		}
+
+		written = append(written[:0], e.Key...)
+		countPointers(blobsOut, e)
+		return w.Add(e)
+	}
+
+	// addOperands writes operands left without a value under them in their
+	// stripe, bottom tells there's nothing older they may apply to
+	addOperands := func(bottom bool) error {
+		es, err := mergeOperands(c.opt.MergeOperator, operands, bottom)
 		if err != nil {
 			return err
 		}
 
-		lvl1Mem = newLvl1Mem
+		for _, e := range es {
+			if err := add(e, lastStripe); err != nil {
+				return err
+			}
+		}
+		operands = operands[:0]
+
+		return nil
+	}
+
+	it := newMergingIter(children)
+	for ok := it.First(); ok; ok = it.Next() {
+		// ctx is checked once in a while, it's not free
+		if merged++; merged%1024 == 0 && ctx.Err() != nil {
+			return fail(ctx.Err())
+		}
+
+		e := it.Value()
+		stripe := stripeOf(e.Seq)
+		countPointers(blobsIn, e)
+
+		newKey := last == nil || !bytes.Equal(e.Key, last)
+		if newKey || stripe != lastStripe {
+			if err := addOperands(newKey && dropTombstones); err != nil {
+				return fail(err)
+			}
+			last = append(last[:0], e.Key...)
+			lastStripe = stripe
+			resolved = false
+		}
+
+		if resolved {
+			continue // shadowed by a newer version
+		}
+
+		deleted := covered(e, stripe)
+		if deleted {
+			e = Entry{Key: e.Key, Kind: KindTombstone, Seq: e.Seq}
+		}
+
+		if e.Kind == KindMerge {
+			operands = append(operands, e)
+			continue
+		}
+		resolved = true
+
+		// operands on top of a value or a tombstone become a value
+		if len(operands) > 0 && c.opt.MergeOperator != nil {
+			var base []byte
+			switch e.Kind {
+			case KindValue:
+				base = e.Value
+			case KindBlobIndex:
+				v, err := c.tree.blobs.read(e.Value)
+				if err != nil {
+					return fail(err)
+				}
+				base = v
+			}
+
+			v, err := fullMerge(c.opt.MergeOperator, e.Key, base, operandValues(operands))
+			if err != nil {
+				return fail(err)
+			}
+			e = Entry{Key: e.Key, Value: v, Kind: KindValue, Seq: operands[0].Seq}
+			operands = operands[:0]
+		}
+
+		if err := addOperands(false); err != nil {
+			return fail(err)
+		}
+
+		if deleted {
+			continue
+		}
+
+		// values of blob files which are mostly garbage move to new ones, so
+		// the old files drain
+		if e.Kind == KindBlobIndex {
+			p, err := blobPointerFromBytes(e.Value)
+			if err != nil {
+				return fail(err)
+			}
+
+			if c.tree.blobs.needsGC(p.num, c.opt.BlobGCThreshold) {
+				v, err := c.tree.blobs.read(e.Value)
+				if err != nil {
+					return fail(err)
+				}
+				e = Entry{Key: e.Key, Value: v, Kind: KindValue, Seq: e.Seq}
+			}
+		}
+
+		if err := add(e, stripe); err != nil {
+			return fail(err)
+		}
 	}
 
-	newLvl1 := make([]*SSTable, 0, len(lvl1Mem))
-	for i, mem1 := range lvl1Mem {
-		sst1, err := SSTableFromReadonlyMemtable(
-			mem1.AsReadonly(),
-			"SST_L1_"+strconv.Itoa(i), // TODO filename
-			c.opt,
-		)
+	if err := it.Err(); err != nil {
+		return fail(err)
+	}
+
+	if err := addOperands(dropTombstones); err != nil {
+		return fail(err)
+	}
 
+	if len(keptDels) > 0 && w == nil {
+		if w, err = NewSSTableWriter(c.tree.newSSTablePath(), n, c.opt); err != nil {
+			return fail(err)
+		}
+	}
+	for _, t := range keptDels {
+		w.AddRangeTombstone(t)
+	}
+
+	if w != nil {
+		sst, err := w.Finish()
+		w = nil
 		if err != nil {
-			return err
+			return fail(err)
 		}
+		out = append(out, &sst)
+	}
 
-		lvl1Size += sst1.Size()
-		newLvl1 = append(newLvl1, &sst1)
+	// blob files are synced before the tables pointing to them get in
+	added, err := bw.finish()
+	if err != nil {
+		return fail(err)
 	}
 
-	c.tree.lvln[0] = newLvl1
+	garbage := make(map[uint64]uint64, len(blobsIn))
+	for num, size := range blobsIn {
+		garbage[num] = size - blobsOut[num]
+	}
 
-	// finish compaction if L1 has space under threshold
-	if lvl1Size < uint(c.opt.L1Threshold) {
-		return nil
+	return out, blobChanges{added: added, garbage: garbage}, nil
+}
+
+// discard drops the tree's reference on tables which are not part of the tree
+// anymore, their files are removed once nobody reads them.
+func discard(tables []*SSTable) {
+	for _, sst := range tables {
+		sst.MarkObsolete()
+		if err := sst.Unref(); err != nil {
+			slog.Warn("dropping table", "table", sst.Path(), "err", err)
+		}
 	}
+}
 
-	// otherwise run LN compaction. We run it in background since we freed mem,
-	// romem, and L0 space for LSM tree to function properly, there is no need
-	// here to block on full compaction
-	go c.compactFull()
+func levelSize(lvl []*SSTable) uint {
+	size := uint(0)
+	for _, sst := range lvl {
+		size += sst.Size()
+	}
 
-	return nil
+	return size
 }
 
-func (c *Compactor) compactFull() {
+// overlappingTables returns tables of a sorted level which key ranges
+// intersect [first, last].
+func overlappingTables(lvl []*SSTable, first, last []byte) []*SSTable {
+	out := make([]*SSTable, 0)
+	for _, sst := range lvl {
+		if bytes.Compare(sst.LastKey(), first) < 0 ||
+			bytes.Compare(sst.FirstKey(), last) > 0 {
+			continue
+		}
+		out = append(out, sst)
+	}
 
+	return out
 }
 
-// Merges 1 memtable with N memtables producing M memtables where M>=N.
-// Result len is M because memtable size is fixed and will likely
-// overflow into one other memtable while merging.
-func MergeWithMultiple(one *Memtable, other []*Memtable, maxTableSize int) ([]*Memtable, error) {
-	// как колбасу
-	other = append(other, one)
+// withoutTables returns a copy of a level with removed tables taken out, order
+// of the rest is kept.
+func withoutTables(lvl, removed []*SSTable) []*SSTable {
+	out := make([]*SSTable, 0, len(lvl))
+	for _, sst := range lvl {
+		if !slices.Contains(removed, sst) {
+			out = append(out, sst)
+		}
+	}
 
-	bigPile := NewMemtable()
-	for _, t := range other {
-		t.Range(func(key string, value []byte) bool {
-			bigPile.Put([]byte(key), value)
-			return true
-		})
+	return out
+}
+
+// replaceTables returns a copy of a sorted level with removed tables taken out
+// and added ones put in, keeping it sorted by keys.
+func replaceTables(lvl, removed, added []*SSTable) []*SSTable {
+	return sortedTables(append(withoutTables(lvl, removed), added...))
+}
+
+// sortedTables sorts tables of a level by keys.
+func sortedTables(tables []*SSTable) []*SSTable {
+	slices.SortFunc(tables, func(a, b *SSTable) int {
+		return bytes.Compare(a.FirstKey(), b.FirstKey())
+	})
+
+	return tables
+}
+
+func inputsLen(inputs []LevelTables) int {
+	n := 0
+	for _, in := range inputs {
+		n += len(in.Tables)
 	}
 
-	// sadly we have to copy the whole pile 😪 (not gonna optimize it tho)
-	out := make([]*Memtable, 0, len(other))
-	curr := NewMemtable()
-	bigPile.Range(func(key string, value []byte) bool {
-		curr.Put([]byte(key), value)
+	return n
+}
 
-		if curr.Size() >= maxTableSize {
-			out = append(out, curr)
-			curr = NewMemtable()
+// inputsRange returns the smallest and the largest key of input tables. Ends
+// of range tombstones count too, so that the keys they delete at the output
+// level are merged with them.
+func inputsRange(inputs []LevelTables) (first, last []byte) {
+	for _, in := range inputs {
+		for _, sst := range in.Tables {
+			if first == nil || bytes.Compare(sst.FirstKey(), first) < 0 {
+				first = sst.FirstKey()
+			}
+			if last == nil || bytes.Compare(sst.LastKey(), last) > 0 {
+				last = sst.LastKey()
+			}
+			for _, t := range sst.rangeDels {
+				if bytes.Compare(t.end, last) > 0 {
+					last = t.end
+				}
+			}
 		}
+	}
 
-		return true
-	})
+	return first, last
+}
+
+// inputsContain tells if sst is an input table of level n.
+func inputsContain(inputs []LevelTables, n int, sst *SSTable) bool {
+	for _, in := range inputs {
+		if in.Level == n && slices.Contains(in.Tables, sst) {
+			return true
+		}
+	}
 
-	return out, nil
+	return false
 }
@@ -0,0 +1,207 @@
+package lsm
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactFull(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+	opts.L1Threshold = 1 << 6
+	opts.MaxL1Tables = 1
+	opts.MaxLNTablesAdder = 0
+
+	tree, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	setLevels(t, tree, nil,
+		[]*SSTable{
+			treeSSTable(t, tree, put("a", "1"), put("b", "1"), del("c")),
+			treeSSTable(t, tree, put("d", "1"), put("f", "1")),
+		},
+		[]*SSTable{
+			treeSSTable(t, tree, put("b", "2"), put("c", "2"), put("e", "2")),
+		},
+	)
+	obsolete := tree.lvln[1][0].Path()
+
+	c := newCompactor(tree, tree.opt)
+
+	// act
+	c.compactFull(context.Background())
+
+	// assert
+	for i, lvl := range tree.lvln {
+		assert.LessOrEqual(t, levelSize(lvl), uint(opts.levelThreshold(i+1)))
+	}
+
+	expected := map[string]string{"a": "1", "b": "1", "d": "1", "e": "2", "f": "1"}
+	for k, v := range expected {
+		got, err := tree.Get([]byte(k))
+		assert.NoError(t, err)
+		assert.Equal(t, v, string(got))
+	}
+	_, err = tree.Get([]byte("c"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	_, err = os.Stat(obsolete)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	recovered, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+	it := recovered.NewIterator(nil, nil)
+	defer it.Close()
+	for ok := it.First(); ok; ok = it.Next() {
+		assert.Equal(t, expected[string(it.Key())], string(it.Value()))
+		delete(expected, string(it.Key()))
+	}
+	assert.Empty(t, expected)
+}
+
+func TestCompactL0(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+
+	tree, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	setLevels(t, tree,
+		[]*SSTable{
+			treeSSTable(t, tree, put("b", "0"), put("c", "0")),
+			treeSSTable(t, tree, put("b", "1"), del("e")),
+		},
+		[]*SSTable{
+			treeSSTable(t, tree, put("a", "1")),
+			treeSSTable(t, tree, put("c", "1"), put("e", "1")),
+			treeSSTable(t, tree, put("x", "1")),
+		},
+	)
+	untouched := []*SSTable{tree.lvln[0][0], tree.lvln[0][2]}
+
+	c := newCompactor(tree, tree.opt)
+
+	// act
+	c.opt.MaxL0Tables = 0
+	err = c.compactL0(context.Background())
+
+	// assert
+	assert.NoError(t, err)
+	assert.Empty(t, tree.lvl0)
+	assert.Contains(t, tree.lvln[0], untouched[0])
+	assert.Contains(t, tree.lvln[0], untouched[1])
+
+	expected := map[string]string{"a": "1", "b": "1", "c": "0", "x": "1"}
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+	for ok := it.First(); ok; ok = it.Next() {
+		assert.Equal(t, expected[string(it.Key())], string(it.Value()))
+		delete(expected, string(it.Key()))
+	}
+	assert.Empty(t, expected)
+
+	// L1 is the bottom level so the tombstone is gone for good
+	for _, sst := range tree.lvln[0] {
+		sit := sst.Iter()
+		for ok := sit.First(); ok; ok = sit.Next() {
+			assert.NotEqual(t, KindTombstone, sit.Value().Kind)
+		}
+	}
+}
+
+func TestCompactL0AlongsideDeeperLevels(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree,
+		[]*SSTable{treeSSTable(t, tree, put("a", "0"))},
+		[]*SSTable{treeSSTable(t, tree, put("b", "1"))},
+		[]*SSTable{treeSSTable(t, tree, put("c", "2"))},
+	)
+
+	c := newCompactor(tree, tree.opt)
+	c.opt.MaxL0Tables = 0
+
+	// act
+	// a compaction of L2 into L3 is running
+	c.levels.lock(2, 3)
+	done := make(chan error)
+	go func() { done <- c.compactL0(context.Background()) }()
+
+	// assert
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("L0 compaction waits for L2")
+	}
+	assert.Empty(t, tree.lvl0)
+	assert.Len(t, tree.lvln[0], 2)
+	assert.Len(t, tree.lvln[1], 1)
+	c.release(2, 3)
+}
+
+func TestCompactL0SkippedWhileL1Busy(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree,
+		[]*SSTable{treeSSTable(t, tree, put("a", "0"))},
+		[]*SSTable{treeSSTable(t, tree, put("b", "1"))},
+	)
+
+	c := newCompactor(tree, tree.opt)
+	c.opt.MaxL0Tables = 0
+	c.levels.lock(1, 2)
+
+	// act
+	err = c.compactL0(context.Background())
+	triggeredBefore := len(c.handle.triggerc)
+	c.release(1, 2)
+
+	// assert
+	// the compaction holding L1 triggers the skipped one once it's done
+	assert.NoError(t, err)
+	assert.Len(t, tree.lvl0, 1)
+	assert.Zero(t, triggeredBefore)
+	assert.Len(t, c.handle.triggerc, 1)
+}
+
+func TestCompactFullKeepsTablesReadByIterator(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.L1Threshold = 1
+	opts.MaxL1Tables = 1
+
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
+	assert.NoError(t, err)
+
+	setLevels(t, tree, nil,
+		[]*SSTable{treeSSTable(t, tree, put("a", "1"))},
+		[]*SSTable{treeSSTable(t, tree, put("a", "2"), put("b", "2"))},
+	)
+	it := tree.NewIterator(nil, nil)
+
+	c := newCompactor(tree, tree.opt)
+
+	// act
+	c.compactFull(context.Background())
+
+	// assert
+	assert.True(t, it.First())
+	assert.Equal(t, "1", string(it.Value()))
+	assert.True(t, it.Next())
+	assert.Equal(t, "b", string(it.Key()))
+	assert.NoError(t, it.Err())
+	assert.NoError(t, it.Close())
+}
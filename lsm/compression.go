@@ -0,0 +1,192 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CompressionType identifies the codec a block is compressed with, it's
+// stored in every block since FormatV4.
+type CompressionType byte
+
+const (
+	NoCompression CompressionType = iota
+	FlateCompression
+	ZlibCompression
+)
+
+// Compressor compresses sstable blocks. Custom compressors have to be
+// registered with RegisterCompressor before tables written with them are
+// read, so use a type which no built-in compressor has.
+type Compressor interface {
+	Type() CompressionType
+	// Compress appends compressed src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends decompressed src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[CompressionType]Compressor{
+		FlateCompression: NewFlateCompressor(flate.DefaultCompression),
+		ZlibCompression:  NewZlibCompressor(zlib.DefaultCompression),
+	}
+)
+
+// RegisterCompressor makes blocks compressed by c readable. It panics if a
+// compressor of the same type is registered already, like sql.Register does.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	if _, ok := compressors[c.Type()]; ok || c.Type() == NoCompression {
+		panic(fmt.Sprintf("lsm: compressor of type %d is registered twice", c.Type()))
+	}
+	compressors[c.Type()] = c
+}
+
+func compressorOf(t CompressionType) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	c, ok := compressors[t]
+	return c, ok
+}
+
+// NewFlateCompressor compresses blocks with raw DEFLATE, level is one of the
+// compress/flate levels.
+func NewFlateCompressor(level int) Compressor {
+	return &stdCompressor{
+		typ: FlateCompression,
+		newWriter: func(w io.Writer) (resettableWriter, error) {
+			return flate.NewWriter(w, level)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	}
+}
+
+// NewZlibCompressor compresses blocks with zlib, level is one of the
+// compress/zlib levels. It's DEFLATE with a header and an adler32 checksum,
+// so flate is a bit smaller when blocks are checksummed anyway.
+func NewZlibCompressor(level int) Compressor {
+	return &stdCompressor{
+		typ: ZlibCompression,
+		newWriter: func(w io.Writer) (resettableWriter, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		newReader: zlib.NewReader,
+	}
+}
+
+type resettableWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// stdCompressor wraps stdlib codecs. Their writers allocate a lot, so they
+// are reused.
+type stdCompressor struct {
+	typ       CompressionType
+	newWriter func(w io.Writer) (resettableWriter, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+	writers   sync.Pool
+}
+
+func (c *stdCompressor) Type() CompressionType {
+	return c.typ
+}
+
+func (c *stdCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+
+	w, ok := c.writers.Get().(resettableWriter)
+	if ok {
+		w.Reset(buf)
+	} else {
+		var err error
+		if w, err = c.newWriter(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	c.writers.Put(w)
+	return buf.Bytes(), nil
+}
+
+func (c *stdCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	r, err := c.newReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// compressBlock appends the compression type and body compressed by c to
+// buf. The body is stored as is when c is nil or compression doesn't save at
+// least 1/8 of it, like leveldb does.
+func compressBlock(buf, body []byte, c Compressor) ([]byte, error) {
+	if c != nil {
+		compressed, err := c.Compress(append(buf, byte(c.Type())), body)
+		if err != nil {
+			return nil, fmt.Errorf("compressing block: %w", err)
+		}
+
+		if len(compressed)-len(buf)-1 < len(body)-len(body)/8 {
+			return compressed, nil
+		}
+		buf = compressed[:len(buf)]
+	}
+
+	buf = append(buf, byte(NoCompression))
+	return append(buf, body...), nil
+}
+
+// decompressBlock undoes compressBlock.
+func decompressBlock(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, &CorruptionError{Reason: "block is too short"}
+	}
+
+	t := CompressionType(b[0])
+	if t == NoCompression {
+		return b[1:], nil
+	}
+
+	// a compressor that isn't registered can't be told apart from a corrupted
+	// type byte, the reader gets to know which block it is either way
+	c, ok := compressorOf(t)
+	if !ok {
+		return nil, &CorruptionError{
+			Reason: fmt.Sprintf("unknown block compression type %d", t),
+		}
+	}
+
+	body, err := c.Decompress(nil, b[1:])
+	if err != nil {
+		return nil, &CorruptionError{Reason: fmt.Sprintf("decompressing block: %v", err)}
+	}
+
+	return body, nil
+}
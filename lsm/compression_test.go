@@ -0,0 +1,149 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// customCompressor is flate registered under a custom type.
+type customCompressor struct {
+	Compressor
+}
+
+func (customCompressor) Type() CompressionType {
+	return 200
+}
+
+// compressedSSTable writes entries into a table of level 1 compressed by c.
+func compressedSSTable(t *testing.T, name string, c Compressor, entries ...Entry) *SSTable {
+	opts := *DefaultOptions
+	opts.BlockThreshold = 1 << 12
+	opts.Compression = []Compressor{c}
+
+	w, err := NewSSTableWriter(path.Join(t.TempDir(), name), 1, opts)
+	assert.NoError(t, err)
+
+	for _, e := range entries {
+		assert.NoError(t, w.Add(e))
+	}
+	sst, err := w.Finish()
+	assert.NoError(t, err)
+
+	return &sst
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	// arrange
+	src := bytes.Repeat([]byte("rec_com_ns_pk_"), 100)
+
+	for _, c := range []Compressor{
+		NewFlateCompressor(flate.BestSpeed),
+		NewZlibCompressor(zlib.BestCompression),
+	} {
+		// act
+		compressed, err := c.Compress([]byte("prefix"), src)
+		assert.NoError(t, err)
+		decompressed, err := c.Decompress(nil, compressed[len("prefix"):])
+
+		// assert
+		assert.NoError(t, err)
+		assert.Equal(t, "prefix", string(compressed[:len("prefix")]))
+		assert.Less(t, len(compressed), len(src))
+		assert.Equal(t, src, decompressed)
+	}
+}
+
+func TestSSTableCompressedBlocks(t *testing.T) {
+	// arrange
+	entries := prefixedEntries(200)
+
+	for _, c := range []Compressor{
+		NewFlateCompressor(flate.DefaultCompression),
+		NewZlibCompressor(zlib.DefaultCompression),
+	} {
+		// act
+		raw := compressedSSTable(t, "raw.sst", nil, entries...)
+		compressed := compressedSSTable(t, "compressed.sst", c, entries...)
+
+		f, err := os.Open(compressed.Path())
+		assert.NoError(t, err)
+		defer f.Close()
+		reopened, err := SSTableFromFile(f, nil)
+		assert.NoError(t, err)
+
+		// assert
+		assert.Less(t, compressed.meta.DataLen, raw.meta.DataLen)
+		for _, e := range entries {
+			v, err := reopened.Get(e.Key)
+			assert.NoError(t, err)
+			assert.Equal(t, e.Value, v)
+		}
+	}
+}
+
+func TestSSTableIncompressibleBlocksStoredRaw(t *testing.T) {
+	// arrange
+	rnd := rand.New(rand.NewSource(1))
+	a, b := make([]byte, 1<<10), make([]byte, 1<<10)
+	rnd.Read(a)
+	rnd.Read(b)
+	entries := []Entry{put("a", string(a)), put("b", string(b))}
+
+	// act
+	raw := compressedSSTable(t, "raw.sst", nil, entries...)
+	compressed := compressedSSTable(t, "compressed.sst",
+		NewFlateCompressor(flate.BestCompression), entries...)
+
+	// assert
+	assert.Equal(t, raw.meta.DataLen, compressed.meta.DataLen)
+
+	v, err := compressed.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, b, v)
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	// arrange
+	c := customCompressor{NewFlateCompressor(flate.BestSpeed)}
+	t.Cleanup(func() {
+		compressorsMu.Lock()
+		delete(compressors, c.Type())
+		compressorsMu.Unlock()
+	})
+	entries := prefixedEntries(200)
+	sst := compressedSSTable(t, "custom.sst", c, entries...)
+
+	// act
+	_, errUnknown := sst.Get(entries[0].Key)
+	RegisterCompressor(c)
+	v, err := sst.Get(entries[0].Key)
+
+	// assert
+	assert.ErrorContains(t, errUnknown, "unknown block compression type 200")
+	var cerr *CorruptionError
+	assert.ErrorAs(t, errUnknown, &cerr)
+	assert.Equal(t, sst.Path(), cerr.File)
+	assert.Equal(t, int64(sst.index[0].offset), cerr.Offset)
+	assert.NoError(t, err)
+	assert.Equal(t, entries[0].Value, v)
+	assert.Panics(t, func() { RegisterCompressor(c) })
+}
+
+func TestOptionsCompressorPerLevel(t *testing.T) {
+	// arrange
+	flateC := NewFlateCompressor(flate.BestSpeed)
+	opts := Options{Compression: []Compressor{nil, flateC}}
+
+	// act & assert
+	assert.Nil(t, opts.compressor(0))
+	assert.Equal(t, flateC, opts.compressor(1))
+	assert.Equal(t, flateC, opts.compressor(5))
+	assert.Nil(t, Options{}.compressor(3))
+}
@@ -0,0 +1,308 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrCompactRangeUnsupported is returned by CompactRange when the compaction
+// policy keeps data in L0 only, see FIFOPolicy and TieredPolicy.
+var ErrCompactRangeUnsupported = errors.New("compaction policy doesn't support CompactRange")
+
+// CompactionProgress reports what compaction is up to.
+type CompactionProgress struct {
+	Paused bool
+	// compactions run and bytes of tables they've written since the tree
+	// was opened
+	Compactions  uint64
+	BytesWritten uint64
+	// levels the running CompactRange is done with out of the levels it goes
+	// through, both are zero when none is running
+	RangeLevelsDone int
+	RangeLevels     int
+}
+
+// compactionControl is shared by the tree and its compactor, it pauses
+// compactions, counts their progress and tells stalled writers about it.
+type compactionControl struct {
+	mu      sync.Mutex
+	paused  bool
+	resumec chan struct{} // closed on resume, replaced on pause
+	// closed once a flush or a compaction changes levels, then replaced
+	changedc chan struct{}
+
+	// only one CompactRange runs at a time, so its progress makes sense
+	rangeGuard      sync.Mutex
+	rangeLevelsDone int // guarded by mu
+	rangeLevels     int // guarded by mu
+
+	compactions  atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+func newCompactionControl() *compactionControl {
+	resumec := make(chan struct{})
+	close(resumec)
+	return &compactionControl{resumec: resumec, changedc: make(chan struct{})}
+}
+
+// changed returns a channel closed on the next change of levels.
+func (ctl *compactionControl) changed() <-chan struct{} {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	return ctl.changedc
+}
+
+func (ctl *compactionControl) notifyChanged() {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	close(ctl.changedc)
+	ctl.changedc = make(chan struct{})
+}
+
+func (ctl *compactionControl) isPaused() bool {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	return ctl.paused
+}
+
+// waitResumed blocks while compaction is paused.
+func (ctl *compactionControl) waitResumed(ctx context.Context) error {
+	ctl.mu.Lock()
+	resumec := ctl.resumec
+	ctl.mu.Unlock()
+
+	select {
+	case <-resumec:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ctl *compactionControl) setRange(done, levels int) {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	ctl.rangeLevelsDone, ctl.rangeLevels = done, levels
+}
+
+func (ctl *compactionControl) progress() CompactionProgress {
+	ctl.mu.Lock()
+	defer ctl.mu.Unlock()
+
+	return CompactionProgress{
+		Paused:          ctl.paused,
+		Compactions:     ctl.compactions.Load(),
+		BytesWritten:    ctl.bytesWritten.Load(),
+		RangeLevelsDone: ctl.rangeLevelsDone,
+		RangeLevels:     ctl.rangeLevels,
+	}
+}
+
+// PauseCompaction stops compactions from starting until ResumeCompaction,
+// CompactRange included, and waits for the running one to finish. If ctx is
+// done first, compaction stays paused but may still be running. Memtables are
+// still flushed to L0, so writes go on while L0 grows.
+func (tree *LSMTree) PauseCompaction(ctx context.Context) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	ctl := tree.compact.ctl
+	ctl.mu.Lock()
+	if !ctl.paused {
+		ctl.paused = true
+		ctl.resumec = make(chan struct{})
+	}
+	ctl.mu.Unlock()
+
+	// running compactions hold their levels until they're done
+	idle := make(chan struct{})
+	go func() {
+		tree.compactor.levels.waitIdle()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ResumeCompaction lets compactions run again and catches up on the ones
+// skipped while paused.
+func (tree *LSMTree) ResumeCompaction() {
+	if tree.readOnly {
+		return
+	}
+
+	ctl := tree.compact.ctl
+	ctl.mu.Lock()
+	if ctl.paused {
+		ctl.paused = false
+		close(ctl.resumec)
+	}
+	ctl.mu.Unlock()
+
+	tree.compact.trigger()
+}
+
+// CompactionProgress reports what compaction is up to.
+func (tree *LSMTree) CompactionProgress() CompactionProgress {
+	if tree.readOnly {
+		return CompactionProgress{}
+	}
+
+	return tree.compact.ctl.progress()
+}
+
+// CompactRange flushes memtables and then pushes all data in [start, end) down
+// to the bottom level, dropping tombstones and versions nobody can read on
+// the way. Nil start or end leave the range unbounded. It's meant to reclaim
+// space right away, e.g. after a big delete; compaction policy doesn't matter
+// here, data ends up at levels as leveled compaction would put it.
+//
+// It waits while compaction is paused, and stops once ctx is done, leaving
+// the levels it's done with compacted. See CompactionProgress for how far it
+// got.
+//
+// FIFOPolicy only ever drops L0 tables and TieredPolicy only ever merges
+// them, data pushed deeper would be stuck there, so CompactRange fails with
+// ErrCompactRangeUnsupported under either.
+func (tree *LSMTree) CompactRange(ctx context.Context, start, end []byte) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	switch tree.opt.CompactionPolicy.(type) {
+	case FIFOPolicy, *FIFOPolicy, TieredPolicy, *TieredPolicy:
+		return ErrCompactRangeUnsupported
+	}
+
+	ctl := tree.compact.ctl
+	ctl.rangeGuard.Lock()
+	defer ctl.rangeGuard.Unlock()
+
+	if err := tree.flushMemtable(ctx); err != nil {
+		return err
+	}
+
+	tree.rodataGuard.RLock()
+	levels := len(tree.lvln) + 1
+	tree.rodataGuard.RUnlock()
+
+	ctl.setRange(0, levels)
+	defer ctl.setRange(0, 0)
+
+	c := tree.compactor
+	for n := 0; ; n++ {
+		if err := ctl.waitResumed(ctx); err != nil {
+			return err
+		}
+
+		done, err := c.compactRangeLevel(ctx, n, start, end)
+		if err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+		// data may have been pushed a level deeper than there was
+		levels = max(levels, n+2)
+		ctl.setRange(n+1, levels)
+	}
+}
+
+// flushMemtable makes the memtable readonly and waits for the compactor to
+// flush it along with other readonly memtables.
+func (tree *LSMTree) flushMemtable(ctx context.Context) error {
+	tree.rodataGuard.Lock()
+	if tree.closed {
+		tree.rodataGuard.Unlock()
+		return ErrClosed
+	}
+
+	var err error
+	if tree.mem.Len() > 0 {
+		err = tree.rotateMemtable()
+	}
+	tree.rodataGuard.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return tree.compact.flush(ctx)
+}
+
+// compactRangeLevel merges tables of level n (L0 is n=0) overlapping
+// [start, end) into the next level. At the bottom level they are merged in
+// place instead. done is true once the range is compacted at the bottom.
+func (c *Compactor) compactRangeLevel(
+	ctx context.Context,
+	n int,
+	start, end []byte,
+) (done bool, err error) {
+	// the output is level n itself at the bottom
+	c.levels.lock(n, n+1)
+	defer c.release(n, n+1)
+
+	c.tree.rodataGuard.RLock()
+	if c.tree.closed {
+		c.tree.rodataGuard.RUnlock()
+		return false, ErrClosed
+	}
+	var lvl []*SSTable
+	if n == 0 {
+		lvl = c.tree.lvl0
+	} else if n <= len(c.tree.lvln) {
+		lvl = c.tree.lvln[n-1]
+	}
+	inputs := rangeTables(lvl, start, end)
+	if n == 0 && len(inputs) > 0 {
+		// L0 tables may overlap, so L0 goes down as a whole, see leveledPolicy
+		inputs = slices.Clone(lvl)
+	}
+	bottom, nextBottom := c.isBottomLevel(n), c.isBottomLevel(n+1)
+	c.tree.rodataGuard.RUnlock()
+
+	if len(inputs) == 0 {
+		return bottom, nil
+	}
+
+	output := n + 1
+	if bottom && n > 0 {
+		output = n
+	}
+
+	return bottom || nextBottom, c.run(ctx, Compaction{
+		Inputs: []LevelTables{{n, inputs}},
+		Output: output,
+	})
+}
+
+// rangeTables returns tables of a level which key ranges intersect
+// [start, end), nil start or end leave the range unbounded.
+func rangeTables(lvl []*SSTable, start, end []byte) []*SSTable {
+	out := make([]*SSTable, 0)
+	for _, sst := range lvl {
+		if start != nil && bytes.Compare(sst.LastKey(), start) < 0 ||
+			end != nil && bytes.Compare(sst.FirstKey(), end) >= 0 {
+			continue
+		}
+		out = append(out, sst)
+	}
+
+	return out
+}
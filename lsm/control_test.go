@@ -0,0 +1,140 @@
+package lsm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactRange(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree,
+		[]*SSTable{treeSSTable(t, tree, put("a", "0"), del("c"))},
+		[]*SSTable{treeSSTable(t, tree, put("b", "1"), put("c", "1"))},
+		[]*SSTable{
+			treeSSTable(t, tree, put("a", "2"), put("d", "2")),
+			treeSSTable(t, tree, put("x", "2")),
+		},
+	)
+	assert.NoError(t, tree.Del([]byte("d")))
+	assert.NoError(t, tree.Put([]byte("e"), []byte("mem")))
+
+	// act
+	err = tree.CompactRange(context.Background(), []byte("a"), []byte("f"))
+
+	// assert
+	assert.NoError(t, err)
+	assert.Empty(t, tree.lvl0)
+	assert.Empty(t, tree.lvln[0])
+
+	// x is out of the range, so its table is left as it is
+	assert.Len(t, tree.lvln[1], 2)
+	expected := map[string]string{"a": "0", "b": "1", "e": "mem", "x": "2"}
+	for _, sst := range tree.lvln[1] {
+		it := sst.Iter()
+		for ok := it.First(); ok; ok = it.Next() {
+			e := it.Value()
+			assert.Equal(t, KindValue, e.Kind)
+			assert.Equal(t, expected[string(e.Key)], string(e.Value))
+			delete(expected, string(e.Key))
+		}
+	}
+	assert.Empty(t, expected)
+
+	progress := tree.CompactionProgress()
+	assert.NotZero(t, progress.Compactions)
+	assert.NotZero(t, progress.BytesWritten)
+	assert.Zero(t, progress.RangeLevels)
+}
+
+func TestCompactRangeCanceled(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree, []*SSTable{treeSSTable(t, tree, put("a", "0"))})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// act
+	err = tree.CompactRange(ctx, nil, nil)
+
+	// assert
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, tree.lvl0, 1)
+}
+
+func TestCompactRangeL0OnlyPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy CompactionPolicy
+	}{
+		{"fifo", FIFOPolicy{MaxSize: 1 << 20}},
+		{"tiered", &TieredPolicy{MaxRuns: 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			opts := *DefaultOptions
+			opts.CompactionPolicy = tt.policy
+			tree, err := Recover(context.Background(), t.TempDir(), &opts)
+			assert.NoError(t, err)
+			defer tree.Close()
+
+			assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+			assert.NoError(t, tree.flushMemtable(context.Background()))
+
+			// act
+			err = tree.CompactRange(context.Background(), nil, nil)
+
+			// assert
+			// the table stays in L0, the only level the policy looks at
+			assert.ErrorIs(t, err, ErrCompactRangeUnsupported)
+			assert.Len(t, tree.lvl0, 1)
+			for _, lvl := range tree.lvln {
+				assert.Empty(t, lvl)
+			}
+		})
+	}
+}
+
+func TestPauseCompaction(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree, []*SSTable{treeSSTable(t, tree, put("a", "0"))})
+
+	// act
+	assert.NoError(t, tree.PauseCompaction(context.Background()))
+	paused := tree.CompactionProgress()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errPaused := tree.CompactRange(ctx, nil, nil)
+	l0Paused := len(tree.lvl0)
+
+	tree.ResumeCompaction()
+	errResumed := tree.CompactRange(context.Background(), nil, nil)
+
+	// assert
+	assert.True(t, paused.Paused)
+	assert.ErrorIs(t, errPaused, context.DeadlineExceeded)
+	assert.Equal(t, 1, l0Paused)
+
+	assert.NoError(t, errResumed)
+	assert.False(t, tree.CompactionProgress().Paused)
+	assert.Empty(t, tree.lvl0)
+	v, err := tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("0"), v)
+}
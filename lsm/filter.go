@@ -0,0 +1,50 @@
+package lsm
+
+// FilterDecision is what a CompactionFilter wants done with an entry.
+type FilterDecision int
+
+const (
+	FilterKeep FilterDecision = iota
+	// FilterRemove deletes the key. Versions in deeper levels are shadowed
+	// by a tombstone left in place of the entry until it reaches the bottom
+	FilterRemove
+	// FilterChangeValue replaces the value with the one returned
+	FilterChangeValue
+)
+
+// CompactionFilter drops or rewrites entries while they are compacted, e.g.
+// to expire old data, without writing deletes for it. It's called for the
+// newest version of each key compaction writes to level (L1 is 1). Versions
+// live snapshots may read and tombstones are not filtered, nor are flushes.
+// Key and value must not be kept after Filter returns. Compactions of a tree
+// may run concurrently on different levels, but they call it one at a time.
+// A filter shared by trees is called concurrently.
+type CompactionFilter interface {
+	Filter(level int, key, value []byte) (decision FilterDecision, newValue []byte)
+}
+
+// filter applies the compaction filter to e. A removed entry turns into a
+// tombstone, so older versions of the key stay shadowed.
+func (c *Compactor) filter(level int, e Entry) (Entry, error) {
+	// the filter sees values, not pointers to blob files
+	value := e.Value
+	if e.Kind == KindBlobIndex {
+		v, err := c.tree.blobs.read(e.Value)
+		if err != nil {
+			return Entry{}, err
+		}
+		value = v
+	}
+
+	c.filterMu.Lock()
+	decision, newValue := c.opt.CompactionFilter.Filter(level, e.Key, value)
+	c.filterMu.Unlock()
+	switch decision {
+	case FilterRemove:
+		e.Kind, e.Value = KindTombstone, nil
+	case FilterChangeValue:
+		e.Kind, e.Value = KindValue, newValue
+	}
+
+	return e, nil
+}
@@ -0,0 +1,178 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// prefixFilter removes keys starting with "tmp" and uppercases values of
+// keys starting with "up".
+type prefixFilter struct {
+	levels []int
+}
+
+func (f *prefixFilter) Filter(level int, key, value []byte) (FilterDecision, []byte) {
+	f.levels = append(f.levels, level)
+	switch {
+	case bytes.HasPrefix(key, []byte("tmp")):
+		return FilterRemove, nil
+	case bytes.HasPrefix(key, []byte("up")):
+		return FilterChangeValue, bytes.ToUpper(value)
+	}
+
+	return FilterKeep, nil
+}
+
+// levelEntries returns all entries stored at level n (L1 is n=1).
+func levelEntries(t *testing.T, tree *LSMTree, n int) []Entry {
+	entries := make([]Entry, 0)
+	for _, sst := range tree.lvln[n-1] {
+		it := sst.Iter()
+		for ok := it.First(); ok; ok = it.Next() {
+			entries = append(entries, it.Value())
+		}
+		assert.NoError(t, it.Err())
+	}
+
+	return entries
+}
+
+func TestCompactionFilter(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree,
+		[]*SSTable{treeSSTable(t, tree,
+			put("a", "keep"), put("tmp1", "new"), put("up", "value"))},
+		nil,
+		[]*SSTable{treeSSTable(t, tree, put("tmp1", "old"), put("tmp2", "old"))},
+	)
+
+	filter := &prefixFilter{}
+	c := newCompactor(tree, tree.opt)
+	c.opt.CompactionFilter = filter
+
+	// act
+	err = c.run(context.Background(), Compaction{
+		Inputs: []LevelTables{{0, tree.lvl0}},
+		Output: 1,
+	})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 1, 1}, filter.levels)
+
+	// L2 still holds an older tmp1, so a tombstone is left to shadow it
+	l1 := levelEntries(t, tree, 1)
+	assert.Len(t, l1, 3)
+	assert.Equal(t, "tmp1", string(l1[1].Key))
+	assert.Equal(t, KindTombstone, l1[1].Kind)
+
+	v, err := tree.Get([]byte("up"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("VALUE"), v)
+	_, err = tree.Get([]byte("tmp1"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	v, err = tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("keep"), v)
+}
+
+func TestCompactionFilterAtBottom(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree, nil,
+		[]*SSTable{treeSSTable(t, tree, put("a", "1"), put("tmp", "1"))},
+	)
+	tree.compactor.opt.CompactionFilter = &prefixFilter{}
+
+	// act
+	err = tree.CompactRange(context.Background(), nil, nil)
+
+	// assert
+	// nothing is below, so removed entries are just gone
+	assert.NoError(t, err)
+	entries := levelEntries(t, tree, 1)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "a", string(entries[0].Key))
+}
+
+func TestCompactionFilterSkipsSnapshotVersions(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("tmp"), []byte("1")))
+	snap := tree.Snapshot()
+	defer snap.Release()
+	assert.NoError(t, tree.Put([]byte("tmp"), []byte("2")))
+
+	tree.compactor.opt.CompactionFilter = &prefixFilter{}
+
+	// act
+	err = tree.CompactRange(context.Background(), nil, nil)
+
+	// assert
+	assert.NoError(t, err)
+	_, err = tree.Get([]byte("tmp"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	v, err := snap.Get([]byte("tmp"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestCompactionFilterConcurrentCompactions(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree,
+		[]*SSTable{treeSSTable(t, tree, put("a", "0"), put("tmp1", "0"))},
+		nil,
+		[]*SSTable{treeSSTable(t, tree, put("b", "2"), put("up", "2"))},
+		[]*SSTable{treeSSTable(t, tree, put("b", "3"))},
+	)
+
+	// prefixFilter isn't safe for concurrent use
+	filter := &prefixFilter{}
+	c := newCompactor(tree, tree.opt)
+	c.opt.CompactionFilter = filter
+
+	// act
+	// L0 into L1 and L2 into L3 don't share levels, so they run together.
+	// L3 overlaps L2, so its tables are rewritten rather than moved
+	comps := []Compaction{
+		{Inputs: []LevelTables{{0, tree.lvl0}}, Output: 1},
+		{Inputs: []LevelTables{{2, tree.lvln[1]}}, Output: 3},
+	}
+	errs := make(chan error, len(comps))
+	for _, comp := range comps {
+		go func(comp Compaction) {
+			c.levels.lock(comp.levels())
+			defer c.release(comp.levels())
+			errs <- c.run(context.Background(), comp)
+		}(comp)
+	}
+
+	// assert
+	for range comps {
+		assert.NoError(t, <-errs)
+	}
+	assert.ElementsMatch(t, []int{1, 1, 3, 3}, filter.levels)
+
+	v, err := tree.Get([]byte("up"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), v)
+	_, err = tree.Get([]byte("tmp1"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
@@ -0,0 +1,332 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// FormatVersion is the version of sstable on disk format. Tables are always
+// written in the latest version, tables of older versions stay readable.
+type FormatVersion uint32
+
+const (
+	// FormatV1 has 16-bit offsets and lengths everywhere, so neither a table
+	// nor a value may be larger than 64KiB. Its footer is just table meta and
+	// a checksum.
+	FormatV1 FormatVersion = iota + 1
+	// FormatV2 has uvarint lengths in entries and table index, 32-bit offsets
+	// inside of blocks and 64-bit offsets in table meta. Its footer ends with
+	// format version and a magic number.
+	FormatV2
+	// FormatV3 is FormatV2 with keys in blocks prefix compressed, blocks have
+	// restart points instead of entry index.
+	FormatV3
+	// FormatV4 is FormatV3 with blocks starting with a compression type, the
+	// rest of a block may be compressed.
+	FormatV4
+	// FormatV5 is FormatV4 with sequence numbers in entries, a table may hold
+	// several versions of a key.
+	FormatV5
+	// FormatV6 is FormatV5 with a range tombstone block following data
+	// blocks, table meta counts it as data.
+	FormatV6
+	// FormatV7 is FormatV6 with the bloom filter ending with a crc32c
+	// checksum like blocks do.
+	FormatV7
+
+	formatLatest = FormatV7
+)
+
+// tableMagic ends every table since FormatV2, it's "birbsst" followed by 0x02
+// in little endian.
+const tableMagic uint64 = 0x02_74_73_73_62_72_69_62
+
+// on disk footer representation since FormatV2:
+// --------------------------------------------------------------------
+// | meta (4x8B) | format version (4B) | crc32c (4B) | magic (8B)      |
+// --------------------------------------------------------------------
+// the checksum covers meta and format version.
+const (
+	v1FooterSize = 4*2 + checksumSize
+	v2FooterSize = 4*8 + 4 + checksumSize + 8
+)
+
+var errBadEntry = errors.New("malformed entry")
+
+// prefixCompressed tells if keys in blocks are stored as deltas of previous
+// keys.
+func (f FormatVersion) prefixCompressed() bool {
+	return f >= FormatV3
+}
+
+// compressed tells if blocks start with a compression type.
+func (f FormatVersion) compressed() bool {
+	return f >= FormatV4
+}
+
+// hasSeqs tells if entries hold sequence numbers.
+func (f FormatVersion) hasSeqs() bool {
+	return f >= FormatV5
+}
+
+// blockWidth is the size of offsets and lengths in block index and block
+// meta of formats before FormatV3.
+func (f FormatVersion) blockWidth() int {
+	if f == FormatV1 {
+		return 2
+	}
+
+	return 4
+}
+
+// tableWidth is the size of offsets and lengths in table meta.
+func (f FormatVersion) tableWidth() int {
+	if f == FormatV1 {
+		return 2
+	}
+
+	return 8
+}
+
+func (f FormatVersion) footerSize() int {
+	if f == FormatV1 {
+		return v1FooterSize
+	}
+
+	return v2FooterSize
+}
+
+// hasRangeDels tells if tables may hold range tombstones.
+func (f FormatVersion) hasRangeDels() bool {
+	return f >= FormatV6
+}
+
+// filterChecksummed tells if the bloom filter ends with a checksum.
+func (f FormatVersion) filterChecksummed() bool {
+	return f >= FormatV7
+}
+
+// minEntrySize is the size of an entry with 1 byte key and no value, in
+// formats before FormatV3.
+func (f FormatVersion) minEntrySize() int {
+	if f == FormatV1 {
+		return 2 + 1 + 1 + 2
+	}
+
+	return 1 + 1 + 1 + 1
+}
+
+// appendUint appends n as a little endian number of width bytes.
+func appendUint(buf []byte, n uint64, width int) []byte {
+	switch width {
+	case 2:
+		return binary.LittleEndian.AppendUint16(buf, uint16(n))
+	case 4:
+		return binary.LittleEndian.AppendUint32(buf, uint32(n))
+	default:
+		return binary.LittleEndian.AppendUint64(buf, n)
+	}
+}
+
+func uintFromBytes(buf []byte, width int) uint64 {
+	switch width {
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(buf))
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(buf))
+	default:
+		return binary.LittleEndian.Uint64(buf)
+	}
+}
+
+// appendLen appends a length of something which follows it, FormatV1 has
+// 16-bit lengths and later formats have uvarints.
+func appendLen(buf []byte, n int, f FormatVersion) []byte {
+	if f == FormatV1 {
+		return binary.LittleEndian.AppendUint16(buf, uint16(n))
+	}
+
+	return binary.AppendUvarint(buf, uint64(n))
+}
+
+// lenPrefixed cuts a length prefixed field off b.
+func lenPrefixed(b []byte, f FormatVersion) (field, rest []byte, err error) {
+	if f != FormatV1 {
+		return uvarintPrefixed(b)
+	}
+
+	if len(b) < 2 || len(b)-2 < int(binary.LittleEndian.Uint16(b)) {
+		return nil, nil, errBadEntry
+	}
+
+	n := int(binary.LittleEndian.Uint16(b))
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// appendEntry appends on disk representation of e in format f. prevKey is
+// the key of the previous entry in the block, it's nil for restart points.
+func appendEntry(buf []byte, e Entry, prevKey []byte, f FormatVersion) []byte {
+	if !f.prefixCompressed() {
+		buf = appendLen(buf, len(e.Key), f)
+		buf = append(buf, e.Key...)
+		buf = append(buf, byte(e.Kind))
+		buf = appendLen(buf, len(e.Value), f)
+		return append(buf, e.Value...)
+	}
+
+	shared := sharedPrefixLen(prevKey, e.Key)
+	buf = binary.AppendUvarint(buf, uint64(shared))
+	buf = binary.AppendUvarint(buf, uint64(len(e.Key)-shared))
+	buf = binary.AppendUvarint(buf, uint64(len(e.Value)))
+	buf = append(buf, byte(e.Kind))
+	if f.hasSeqs() {
+		buf = binary.AppendUvarint(buf, e.Seq)
+	}
+	buf = append(buf, e.Key[shared:]...)
+	return append(buf, e.Value...)
+}
+
+// entryFromBytes decodes the entry b starts with, and tells how many bytes
+// it took. prevKey is the key of the previous entry in the block, the key of
+// the decoded entry never shares memory with it, so it's fine to keep.
+func entryFromBytes(b []byte, prevKey []byte, f FormatVersion) (Entry, int, error) {
+	if !f.prefixCompressed() {
+		key, rest, err := lenPrefixed(b, f)
+		if err != nil || len(rest) == 0 {
+			return Entry{}, 0, errBadEntry
+		}
+
+		kind := EntryKind(rest[0])
+		val, rest, err := lenPrefixed(rest[1:], f)
+		if err != nil {
+			return Entry{}, 0, errBadEntry
+		}
+
+		return Entry{Key: key, Value: val, Kind: kind}, len(b) - len(rest), nil
+	}
+
+	var lens [3]uint64 // shared, unshared, value_len
+	rest := b
+	for i := range lens {
+		n, read := binary.Uvarint(rest)
+		if read <= 0 {
+			return Entry{}, 0, errBadEntry
+		}
+		lens[i], rest = n, rest[read:]
+	}
+
+	shared, unshared, vlen := lens[0], lens[1], lens[2]
+	if shared > uint64(len(prevKey)) || len(rest) == 0 ||
+		unshared > uint64(len(rest)-1) || vlen > uint64(len(rest)-1)-unshared {
+		return Entry{}, 0, errBadEntry
+	}
+
+	kind := EntryKind(rest[0])
+	rest = rest[1:]
+
+	var seq uint64
+	if f.hasSeqs() {
+		var read int
+		if seq, read = binary.Uvarint(rest); read <= 0 ||
+			unshared+vlen > uint64(len(rest)-read) {
+			return Entry{}, 0, errBadEntry
+		}
+		rest = rest[read:]
+	}
+
+	key := make([]byte, 0, shared+unshared)
+	key = append(key, prevKey[:shared]...)
+	key = append(key, rest[:unshared]...)
+	val := rest[unshared : unshared+vlen]
+
+	return Entry{Key: key, Value: val, Kind: kind, Seq: seq},
+		len(b) - len(rest) + int(unshared+vlen), nil
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return n
+}
+
+// appendMeta appends meta as four numbers of width bytes.
+func appendMeta(buf []byte, m Meta, width int) []byte {
+	buf = appendUint(buf, m.DataOffset, width)
+	buf = appendUint(buf, m.DataLen, width)
+	buf = appendUint(buf, m.IndexOffset, width)
+	return appendUint(buf, m.IndexLen, width)
+}
+
+func metaFromBytes(buf []byte, width int) Meta {
+	return Meta{
+		DataOffset:  uintFromBytes(buf, width),
+		DataLen:     uintFromBytes(buf[width:], width),
+		IndexOffset: uintFromBytes(buf[2*width:], width),
+		IndexLen:    uintFromBytes(buf[3*width:], width),
+	}
+}
+
+// appendFooter appends table footer of format f.
+func appendFooter(buf []byte, m Meta, f FormatVersion) []byte {
+	if f == FormatV1 {
+		return appendChecksum(appendMeta(buf, m, f.tableWidth()))
+	}
+
+	footer := appendMeta(nil, m, f.tableWidth())
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(f))
+	footer = appendChecksum(footer)
+	footer = binary.LittleEndian.AppendUint64(footer, tableMagic)
+	return append(buf, footer...)
+}
+
+// footerFromBytes parses the footer out of tail, the last bytes of a table
+// (up to v2FooterSize of them). Tables ending with the magic number are
+// FormatV2 or later, the rest are FormatV1. Offset of a *CorruptionError is
+// relative to the start of tail.
+func footerFromBytes(tail []byte) (Meta, FormatVersion, error) {
+	f := FormatV1
+	if len(tail) >= v2FooterSize &&
+		binary.LittleEndian.Uint64(tail[len(tail)-8:]) == tableMagic {
+		f = FormatV2
+	}
+
+	if len(tail) < f.footerSize() {
+		return Meta{}, 0, &CorruptionError{Reason: "file is too short"}
+	}
+
+	footerOffset := len(tail) - f.footerSize()
+	footer := tail[footerOffset:]
+	if f != FormatV1 {
+		footer = footer[:len(footer)-8] // magic
+	}
+
+	footer, ok := verifyChecksum(footer)
+	if !ok {
+		return Meta{}, 0, &CorruptionError{
+			Offset: int64(footerOffset),
+			Reason: "footer checksum mismatch",
+		}
+	}
+
+	if f != FormatV1 {
+		f = FormatVersion(binary.LittleEndian.Uint32(footer[len(footer)-4:]))
+		if f < FormatV2 {
+			return Meta{}, 0, &CorruptionError{
+				Offset: int64(footerOffset),
+				Reason: fmt.Sprintf("bad format version %d", f),
+			}
+		}
+
+		if f > formatLatest {
+			return Meta{}, 0, fmt.Errorf("unsupported sstable format version %d", f)
+		}
+	}
+
+	return metaFromBytes(footer, f.tableWidth()), f, nil
+}
@@ -0,0 +1,717 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sort"
+)
+
+// NewIterator returns an iterator over keys in [lower, upper), a nil bound
+// means the range is not bounded from that side.
+// Iterator sees the tree as it was at the moment of the call, later writes are
+// not visible to it. Just like Iter, it needs to be positioned with First,
+// Last or Seek before use. It holds on to the sstables it reads, so it must be
+// closed once done.
+func (tree *LSMTree) NewIterator(lower, upper []byte) *Iterator {
+	return tree.newIterator(lower, upper, tree.seq.Load())
+}
+
+// newIterator returns an iterator seeing versions not newer than seq.
+func (tree *LSMTree) newIterator(lower, upper []byte, seq uint64) *Iterator {
+	tree.rodataGuard.RLock()
+	defer tree.rodataGuard.RUnlock()
+
+	if tree.closed {
+		return &Iterator{iter: newMergingIter(nil), err: ErrClosed}
+	}
+
+	// sources go from the newest to the oldest, so that merging iterator can
+	// tell which version of a key shadows the others
+	children := make([]Iter[Entry], 0,
+		1+len(tree.memro)+len(tree.lvl0)+len(tree.lvln))
+
+	// memtables are read in place, bounds are kept apart from the caller's
+	lower, upper = slices.Clone(lower), slices.Clone(upper)
+	children = append(children, newMemtableIter(tree.mem, lower, upper, seq))
+	for i := len(tree.memro) - 1; i >= 0; i-- {
+		children = append(children,
+			newMemtableIter(&tree.memro[i].table, lower, upper, seq))
+	}
+
+	tables := make([]*SSTable, 0, len(tree.lvl0))
+
+	// L0 tables overlap each other so each one is a separate source
+	for i := len(tree.lvl0) - 1; i >= 0; i-- {
+		children = append(children, tree.lvl0[i].Iter())
+		tables = append(tables, tree.lvl0[i])
+	}
+
+	// tables of a deeper level are sorted and don't overlap, a level is
+	// walked as one long table
+	for _, lvl := range tree.lvln {
+		if len(lvl) > 0 {
+			children = append(children, newLevelIter(slices.Clone(lvl)))
+			tables = append(tables, lvl...)
+		}
+	}
+
+	for _, sst := range tables {
+		sst.Ref()
+	}
+
+	// values the tables point to must outlive compactions as well
+	blobs := tree.blobs.refAll()
+
+	return &Iterator{
+		iter:      newMergingIter(children),
+		tables:    tables,
+		blobs:     blobs,
+		lower:     lower,
+		upper:     upper,
+		seq:       seq,
+		merge:     tree.opt.MergeOperator,
+		rangeDels: tree.visibleRangeTombstones(seq),
+	}
+}
+
+type direction int
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// Iterator walks live keys of the tree in order. Of all versions of a key
+// only the newest one not newer than the iterator seq is visible, keys which
+// visible version is a tombstone are skipped, so are versions deleted by a
+// range tombstone visible to the iterator. Visible merge operands are
+// combined with older versions of the key, a failed merge ends the iteration
+// with the error.
+//
+// Moving forward, the merging iterator underneath sits on the newest version
+// of the current key, unless it had to walk older ones to combine merge
+// operands (pastKey). Moving backward, versions of a key are met oldest
+// first, so the merging iterator has to walk past all of them before the
+// newest one is known: it sits on the entry before the current key.
+type Iterator struct {
+	iter   *mergingIter
+	tables []*SSTable // referenced until Close
+	blobs  blobFiles  // referenced until Close
+	lower  []byte
+	upper  []byte
+	seq    uint64
+	dir    direction
+	valid  bool
+	key    []byte
+	value  []byte
+	merge  MergeOperator
+	// range tombstones visible at seq
+	rangeDels rangeTombstones
+	// merging iterator went past the newest version of the current key
+	pastKey bool
+	err     error // set when the iterator couldn't be created or a merge failed
+}
+
+func (it *Iterator) First() bool {
+	if it.lower != nil {
+		it.iter.Seek(it.lower)
+	} else {
+		it.iter.First()
+	}
+
+	return it.findNextVisible()
+}
+
+func (it *Iterator) Last() bool {
+	if it.upper != nil {
+		if it.iter.Seek(it.upper) {
+			it.iter.Prev()
+		} else if it.iter.Err() == nil {
+			it.iter.Last()
+		}
+	} else {
+		it.iter.Last()
+	}
+
+	return it.findPrevVisible()
+}
+
+// Seek moves to the first key >= k.
+func (it *Iterator) Seek(k []byte) bool {
+	if it.lower != nil && bytes.Compare(k, it.lower) < 0 {
+		k = it.lower
+	}
+
+	it.iter.Seek(k)
+	return it.findNextVisible()
+}
+
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+
+	if it.dir == reverse {
+		it.iter.Seek(it.key)
+	}
+
+	it.skipKey(it.key)
+	return it.findNextVisible()
+}
+
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+
+	if it.dir == forward {
+		if it.pastKey {
+			it.iter.Seek(it.key)
+		}
+		// we're on the newest visible version of the key, one step back and
+		// all of them are behind. Versions too new to be visible are still
+		// ahead, but findPrevVisible skips them
+		it.iter.Prev()
+	}
+
+	return it.findPrevVisible()
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.iter.Err()
+}
+
+// Close releases sstables and blob files held by the iterator, it can't be
+// used after that.
+func (it *Iterator) Close() error {
+	var errs []error
+	for _, sst := range it.tables {
+		errs = append(errs, sst.Unref())
+	}
+	for _, f := range it.blobs {
+		errs = append(errs, f.Unref())
+	}
+
+	it.tables, it.blobs = nil, nil
+	it.valid = false
+	return errors.Join(errs...)
+}
+
+// findNextVisible moves forward until a key which visible version is not a
+// tombstone. Merging iterator must be on the newest version of a key.
+func (it *Iterator) findNextVisible() bool {
+	it.dir = forward
+	it.valid = false
+	it.pastKey = false
+
+	for it.err == nil && it.iter.Valid() {
+		e := it.iter.Value()
+		if it.upper != nil && bytes.Compare(e.Key, it.upper) >= 0 {
+			return false
+		}
+
+		if e.Seq > it.seq {
+			// too new, an older version may be visible
+			it.iter.Next()
+			continue
+		}
+
+		e = it.version(e)
+		r := mergeResolver{op: it.merge, blob: it.blobs.read}
+		if !r.add(e.Key, e) {
+			// a merge operand, older versions it applies to follow
+			k := slices.Clone(e.Key)
+			it.pastKey = true
+			for it.iter.Next() && bytes.Equal(it.iter.Value().Key, k) {
+				if v := it.iter.Value(); v.Seq <= it.seq && r.add(k, it.version(v)) {
+					break
+				}
+			}
+			if !r.done {
+				r.finish(k, nil, false)
+			}
+			e.Key = k
+		}
+
+		if r.err != nil {
+			it.err = r.err
+			return false
+		}
+
+		if r.found {
+			it.key = slices.Clone(e.Key)
+			it.value = r.value
+			it.valid = true
+			return true
+		}
+
+		it.skipKey(e.Key)
+	}
+
+	return false
+}
+
+// findPrevVisible moves backward until a key which visible version is not a
+// tombstone. Merging iterator must be on the oldest version of a key.
+func (it *Iterator) findPrevVisible() bool {
+	it.dir = reverse
+	it.valid = false
+
+	for it.err == nil && it.iter.Valid() {
+		k := slices.Clone(it.iter.Value().Key)
+		if it.lower != nil && bytes.Compare(k, it.lower) < 0 {
+			return false
+		}
+
+		// visible versions from the oldest on, versions older than a value or
+		// a tombstone don't matter
+		var visible []Entry
+		for it.iter.Valid() && bytes.Equal(it.iter.Value().Key, k) {
+			if e := it.iter.Value(); e.Seq <= it.seq {
+				e = it.version(e)
+				if e.Kind != KindMerge {
+					visible = visible[:0]
+				}
+				visible = append(visible, e)
+			}
+			it.iter.Prev()
+		}
+
+		r := mergeResolver{op: it.merge, blob: it.blobs.read}
+		for i := len(visible) - 1; i >= 0; i-- {
+			if r.add(k, visible[i]) {
+				break
+			}
+		}
+		if !r.done {
+			r.finish(k, nil, false)
+		}
+
+		if r.err != nil {
+			it.err = r.err
+			return false
+		}
+
+		if r.found {
+			it.key = k
+			it.value = r.value
+			it.valid = true
+			return true
+		}
+	}
+
+	return false
+}
+
+// version turns e into a tombstone when a range tombstone deletes it.
+func (it *Iterator) version(e Entry) Entry {
+	if len(it.rangeDels) > 0 && e.Seq < it.rangeDels.cover(e.Key, it.seq) {
+		return Entry{Key: e.Key, Kind: KindTombstone, Seq: e.Seq}
+	}
+
+	return e
+}
+
+// skipKey moves forward past all versions of k.
+func (it *Iterator) skipKey(k []byte) {
+	k = slices.Clone(k)
+	for it.iter.Valid() && bytes.Equal(it.iter.Value().Key, k) {
+		it.iter.Next()
+	}
+}
+
+// mergingIter merges sorted children into one sorted sequence. Children may
+// share keys, entries of equal keys are ordered by seq (newer first) and then
+// by the child index, so children have to be passed from the newest to the
+// oldest for the newest version of a key to come first even when seqs are
+// not known (tables of formats before FormatV5).
+//
+// Moving forward, every child is on its smallest entry after the current
+// one. Moving backward, every child is on its largest entry before the
+// current one. Changing direction repositions all children.
+type mergingIter struct {
+	children []Iter[Entry]
+	cur      int // -1 when not positioned
+	dir      direction
+	err      error
+}
+
+func newMergingIter(children []Iter[Entry]) *mergingIter {
+	return &mergingIter{children: children, cur: -1}
+}
+
+func (m *mergingIter) First() bool {
+	for _, c := range m.children {
+		c.First()
+	}
+
+	m.dir = forward
+	return m.pickSmallest()
+}
+
+func (m *mergingIter) Last() bool {
+	for _, c := range m.children {
+		c.Last()
+	}
+
+	m.dir = reverse
+	return m.pickLargest()
+}
+
+func (m *mergingIter) Seek(k []byte) bool {
+	for _, c := range m.children {
+		c.Seek(k)
+	}
+
+	m.dir = forward
+	return m.pickSmallest()
+}
+
+func (m *mergingIter) Next() bool {
+	if !m.Valid() {
+		return false
+	}
+
+	if m.dir != forward {
+		cur := m.Value()
+		cur.Key = slices.Clone(cur.Key)
+		for i, c := range m.children {
+			if i == m.cur {
+				continue
+			}
+
+			// versions of the key which come before the current entry are
+			// stepped over
+			for ok := c.Seek(cur.Key); ok; ok = c.Next() {
+				if compareMerged(c.Value(), i, cur, m.cur) > 0 {
+					break
+				}
+			}
+		}
+
+		m.dir = forward
+	}
+
+	m.children[m.cur].Next()
+	return m.pickSmallest()
+}
+
+func (m *mergingIter) Prev() bool {
+	if !m.Valid() {
+		return false
+	}
+
+	if m.dir != reverse {
+		cur := m.Value()
+		cur.Key = slices.Clone(cur.Key)
+		for i, c := range m.children {
+			if i == m.cur {
+				continue
+			}
+
+			// every child goes to the last entry before the current one:
+			// past versions of the key which come before it, then one step
+			// back
+			ok := c.Seek(cur.Key)
+			for ok && compareMerged(c.Value(), i, cur, m.cur) < 0 {
+				ok = c.Next()
+			}
+
+			if ok {
+				c.Prev()
+			} else if c.Err() == nil {
+				c.Last()
+			}
+		}
+
+		m.dir = reverse
+	}
+
+	m.children[m.cur].Prev()
+	return m.pickLargest()
+}
+
+func (m *mergingIter) Valid() bool {
+	return m.err == nil && m.cur >= 0
+}
+
+func (m *mergingIter) Value() Entry {
+	return m.children[m.cur].Value()
+}
+
+func (m *mergingIter) Err() error {
+	return m.err
+}
+
+func (m *mergingIter) pickSmallest() bool {
+	m.cur = -1
+	for i, c := range m.children {
+		if err := c.Err(); err != nil {
+			m.err = err
+			return false
+		}
+
+		if !c.Valid() {
+			continue
+		}
+
+		if m.cur < 0 ||
+			compareMerged(c.Value(), i, m.children[m.cur].Value(), m.cur) < 0 {
+			m.cur = i
+		}
+	}
+
+	return m.cur >= 0
+}
+
+func (m *mergingIter) pickLargest() bool {
+	m.cur = -1
+	for i, c := range m.children {
+		if err := c.Err(); err != nil {
+			m.err = err
+			return false
+		}
+
+		if !c.Valid() {
+			continue
+		}
+
+		if m.cur < 0 ||
+			compareMerged(c.Value(), i, m.children[m.cur].Value(), m.cur) > 0 {
+			m.cur = i
+		}
+	}
+
+	return m.cur >= 0
+}
+
+// compareMerged orders entry a of child ai and entry b of child bi.
+func compareMerged(a Entry, ai int, b Entry, bi int) int {
+	if c := bytes.Compare(a.Key, b.Key); c != 0 {
+		return c
+	}
+
+	if a.Seq != b.Seq {
+		if a.Seq > b.Seq {
+			return -1
+		}
+		return 1
+	}
+
+	return ai - bi
+}
+
+// levelIter walks a level of sorted non overlapping tables as if it was a
+// single table.
+type levelIter struct {
+	tables []*SSTable
+	idx    int
+	it     *SSTableIter // nil when not positioned
+}
+
+func newLevelIter(tables []*SSTable) *levelIter {
+	return &levelIter{tables: tables, idx: -1}
+}
+
+func (l *levelIter) First() bool {
+	return l.load(0) && l.it.First()
+}
+
+func (l *levelIter) Last() bool {
+	return l.load(len(l.tables)-1) && l.it.Last()
+}
+
+func (l *levelIter) Seek(k []byte) bool {
+	// first table which may hold keys >= k
+	i := sort.Search(len(l.tables), func(i int) bool {
+		return bytes.Compare(l.tables[i].LastKey(), k) >= 0
+	})
+
+	return l.load(i) && l.it.Seek(k)
+}
+
+func (l *levelIter) Next() bool {
+	if l.it == nil {
+		return false
+	}
+
+	if l.it.Next() {
+		return true
+	}
+
+	if l.it.Err() != nil {
+		return false
+	}
+
+	return l.load(l.idx+1) && l.it.First()
+}
+
+func (l *levelIter) Prev() bool {
+	if l.it == nil {
+		return false
+	}
+
+	if l.it.Prev() {
+		return true
+	}
+
+	if l.it.Err() != nil {
+		return false
+	}
+
+	return l.load(l.idx-1) && l.it.Last()
+}
+
+func (l *levelIter) Valid() bool {
+	return l.it != nil && l.it.Valid()
+}
+
+func (l *levelIter) Value() Entry {
+	return l.it.Value()
+}
+
+func (l *levelIter) Err() error {
+	if l.it == nil {
+		return nil
+	}
+
+	return l.it.Err()
+}
+
+func (l *levelIter) load(i int) bool {
+	l.idx = i
+	l.it = nil
+	if i < 0 || i >= len(l.tables) {
+		return false
+	}
+
+	l.it = l.tables[i].Iter()
+	return true
+}
+
+// memtableIter walks versions of keys within [lower, upper) right in the
+// skiplist of a memtable, newer versions of a key first. Versions newer than
+// seq are skipped, the others are all in the memtable by the time the
+// iterator is made, so later writes don't change what it sees.
+type memtableIter struct {
+	list         *skiplist
+	lower, upper []byte
+	seq          uint64
+	node         *skipNode
+	versions     []memValue // versions of node not newer than seq
+	idx          int
+}
+
+func newMemtableIter(m *Memtable, lower, upper []byte, seq uint64) *memtableIter {
+	return &memtableIter{list: m.skiplist, lower: lower, upper: upper, seq: seq}
+}
+
+func (it *memtableIter) First() bool {
+	return it.load(it.list.findGreaterOrEqual(string(it.lower), nil), forward)
+}
+
+func (it *memtableIter) Last() bool {
+	if it.upper == nil {
+		return it.load(it.list.findLast(), reverse)
+	}
+
+	return it.load(it.list.findLess(string(it.upper)), reverse)
+}
+
+func (it *memtableIter) Seek(k []byte) bool {
+	if bytes.Compare(k, it.lower) < 0 {
+		k = it.lower
+	}
+
+	return it.load(it.list.findGreaterOrEqual(string(k), nil), forward)
+}
+
+func (it *memtableIter) Next() bool {
+	if it.node == nil {
+		return false
+	}
+
+	if it.idx+1 < len(it.versions) {
+		it.idx++
+		return true
+	}
+
+	return it.load(it.node.next[0].Load(), forward)
+}
+
+func (it *memtableIter) Prev() bool {
+	if it.node == nil {
+		return false
+	}
+
+	if it.idx > 0 {
+		it.idx--
+		return true
+	}
+
+	return it.load(it.list.findLess(it.node.key), reverse)
+}
+
+func (it *memtableIter) Valid() bool {
+	return it.node != nil
+}
+
+func (it *memtableIter) Value() Entry {
+	v := it.versions[it.idx]
+	return Entry{Key: []byte(it.node.key), Value: v.value, Kind: v.kind, Seq: v.seq}
+}
+
+func (it *memtableIter) Err() error {
+	return nil
+}
+
+// load moves to the newest version of n going forward, or the oldest one
+// going in reverse. Nodes with no version old enough are stepped over in dir,
+// it stops at the bounds.
+func (it *memtableIter) load(n *skipNode, dir direction) bool {
+	for n != nil {
+		if dir == forward && it.upper != nil && n.key >= string(it.upper) {
+			break
+		}
+		if dir == reverse && n.key < string(it.lower) {
+			break
+		}
+
+		// versions are sorted by seq, the newest first
+		vs := *n.vs.versions.Load()
+		i := sort.Search(len(vs), func(i int) bool { return vs[i].seq <= it.seq })
+		if i < len(vs) {
+			it.node, it.versions, it.idx = n, vs[i:], 0
+			if dir == reverse {
+				it.idx = len(it.versions) - 1
+			}
+			return true
+		}
+
+		if dir == forward {
+			n = n.next[0].Load()
+		} else {
+			n = it.list.findLess(n.key)
+		}
+	}
+
+	it.node, it.versions = nil, nil
+	return false
+}
@@ -0,0 +1,448 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectKeys(it *Iterator, forward bool) []string {
+	keys := make([]string, 0)
+	for ok := it.Valid(); ok; {
+		keys = append(keys, string(it.Key()))
+		if forward {
+			ok = it.Next()
+		} else {
+			ok = it.Prev()
+		}
+	}
+
+	return keys
+}
+
+func testSSTable(t *testing.T, name string, entries ...Entry) *SSTable {
+	mem := NewMemtable()
+	for _, e := range entries {
+		mem.Apply(e)
+	}
+
+	sst, err := SSTableFromReadonlyMemtable(
+		mem.AsReadonly(), path.Join(t.TempDir(), name), *DefaultOptions)
+	assert.NoError(t, err)
+
+	return &sst
+}
+
+// treeSSTable writes a table into the tree dir, so it can be put on a level
+// with setLevels.
+func treeSSTable(t *testing.T, tree *LSMTree, entries ...Entry) *SSTable {
+	mem := NewMemtable()
+	for _, e := range entries {
+		mem.Apply(e)
+	}
+
+	sst, err := SSTableFromReadonlyMemtable(
+		mem.AsReadonly(), tree.newSSTablePath(), tree.opt)
+	assert.NoError(t, err)
+
+	return &sst
+}
+
+// setLevels replaces levels of an empty tree and records them in the manifest
+// like a compaction would.
+func setLevels(t *testing.T, tree *LSMTree, lvl0 []*SSTable, lvln ...[]*SSTable) {
+	tree.rodataGuard.Lock()
+	defer tree.rodataGuard.Unlock()
+
+	edit := versionEdit{added: tableRefs(0, lvl0)}
+	for i, lvl := range lvln {
+		edit.added = append(edit.added, tableRefs(i+1, lvl)...)
+	}
+	assert.NoError(t, tree.logEdit(edit))
+
+	tree.lvl0, tree.lvln = lvl0, lvln
+}
+
+func put(k, v string) Entry {
+	return Entry{Key: []byte(k), Value: []byte(v)}
+}
+
+func del(k string) Entry {
+	return Entry{Key: []byte(k), Kind: KindTombstone}
+}
+
+// sliceIter walks a sorted slice of entries, it stands in for sources of a
+// merging iterator.
+type sliceIter struct {
+	entries []Entry
+	idx     int
+}
+
+func (s *sliceIter) First() bool {
+	s.idx = 0
+	return s.Valid()
+}
+
+func (s *sliceIter) Last() bool {
+	s.idx = len(s.entries) - 1
+	return s.Valid()
+}
+
+func (s *sliceIter) Seek(k []byte) bool {
+	s.idx = sort.Search(len(s.entries), func(i int) bool {
+		return bytes.Compare(s.entries[i].Key, k) >= 0
+	})
+
+	return s.Valid()
+}
+
+func (s *sliceIter) Next() bool {
+	s.idx = min(s.idx+1, len(s.entries))
+	return s.Valid()
+}
+
+func (s *sliceIter) Prev() bool {
+	s.idx = max(s.idx-1, -1)
+	return s.Valid()
+}
+
+func (s *sliceIter) Valid() bool {
+	return s.idx >= 0 && s.idx < len(s.entries)
+}
+
+func (s *sliceIter) Value() Entry {
+	return s.entries[s.idx]
+}
+
+func (s *sliceIter) Err() error {
+	return nil
+}
+
+// arrangeIterTree builds a tree where a=3, b=2, d=1 and f=3 are live, while
+// c and e are deleted and a, b and d are shadowed by newer versions.
+func arrangeIterTree(t *testing.T) *LSMTree {
+	tree, err := Recover(context.Background(), t.TempDir(), nil)
+	assert.NoError(t, err)
+
+	setLevels(t, tree,
+		[]*SSTable{
+			treeSSTable(t, tree, put("b", "2"), put("e", "2"), del("c")),
+		},
+		[]*SSTable{
+			treeSSTable(t, tree, put("a", "1"), put("b", "1")),
+			treeSSTable(t, tree, put("c", "1"), put("d", "1")),
+		},
+	)
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("3")))
+	assert.NoError(t, tree.Put([]byte("f"), []byte("3")))
+	assert.NoError(t, tree.Del([]byte("e")))
+
+	return tree
+}
+
+func TestIteratorForward(t *testing.T) {
+	// arrange
+	tree := arrangeIterTree(t)
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+
+	// act
+	it.First()
+	keys := collectKeys(it, true)
+
+	// assert
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{"a", "b", "d", "f"}, keys)
+}
+
+func TestIteratorBackward(t *testing.T) {
+	// arrange
+	tree := arrangeIterTree(t)
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+
+	// act
+	it.Last()
+	keys := collectKeys(it, false)
+
+	// assert
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{"f", "d", "b", "a"}, keys)
+}
+
+func TestIteratorNewestVersion(t *testing.T) {
+	// arrange
+	tree := arrangeIterTree(t)
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+	values := map[string]string{}
+
+	// act
+	for ok := it.First(); ok; ok = it.Next() {
+		values[string(it.Key())] = string(it.Value())
+	}
+
+	// assert
+	assert.Equal(t, map[string]string{"a": "3", "b": "2", "d": "1", "f": "3"},
+		values)
+}
+
+func TestIteratorBounds(t *testing.T) {
+	// arrange
+	tree := arrangeIterTree(t)
+	it := tree.NewIterator([]byte("b"), []byte("f"))
+	defer it.Close()
+
+	// act
+	it.First()
+	forwardKeys := collectKeys(it, true)
+	it.Last()
+	backwardKeys := collectKeys(it, false)
+
+	// assert
+	assert.Equal(t, []string{"b", "d"}, forwardKeys)
+	assert.Equal(t, []string{"d", "b"}, backwardKeys)
+}
+
+func TestIteratorSeekAndTurnAround(t *testing.T) {
+	// arrange
+	tree := arrangeIterTree(t)
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+
+	// act & assert
+	assert.True(t, it.Seek([]byte("c")))
+	assert.Equal(t, "d", string(it.Key()))
+
+	assert.True(t, it.Prev())
+	assert.Equal(t, "b", string(it.Key()))
+
+	assert.True(t, it.Prev())
+	assert.Equal(t, "a", string(it.Key()))
+
+	assert.False(t, it.Prev())
+
+	assert.True(t, it.Seek([]byte("a")))
+	assert.True(t, it.Next())
+	assert.Equal(t, "b", string(it.Key()))
+	assert.Equal(t, "2", string(it.Value()))
+
+	assert.True(t, it.Prev())
+	assert.Equal(t, "a", string(it.Key()))
+
+	assert.True(t, it.Next())
+	assert.Equal(t, "b", string(it.Key()))
+
+	assert.False(t, it.Seek([]byte("g")))
+}
+
+func TestIteratorIgnoresLaterWrites(t *testing.T) {
+	// arrange
+	tree := arrangeIterTree(t)
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+
+	// act
+	assert.NoError(t, tree.Put([]byte("aa"), []byte("later")))
+	it.First()
+	keys := collectKeys(it, true)
+
+	// assert
+	assert.Equal(t, []string{"a", "b", "d", "f"}, keys)
+}
+
+// memtableEntries walks it on from where it was positioned, ok tells if it
+// was, and returns key@seq of entries it sees.
+func memtableEntries(it *memtableIter, ok, forward bool) []string {
+	entries := make([]string, 0)
+	for ok {
+		e := it.Value()
+		entries = append(entries, string(e.Key)+"@"+strconv.FormatUint(e.Seq, 10))
+		if forward {
+			ok = it.Next()
+		} else {
+			ok = it.Prev()
+		}
+	}
+
+	return entries
+}
+
+func TestMemtableIter(t *testing.T) {
+	// arrange
+	at := func(e Entry, seq uint64) Entry {
+		e.Seq = seq
+		return e
+	}
+	mem := NewMemtable()
+	for _, e := range []Entry{at(put("a", "1"), 1), at(put("b", "2"), 2),
+		at(put("c", "3"), 3), at(put("b", "4"), 4), at(del("d"), 5),
+		at(put("e", "6"), 6), at(put("c", "7"), 7)} {
+		assert.NoError(t, mem.Apply(e))
+	}
+	it := newMemtableIter(mem, []byte("b"), []byte("e"), 5)
+
+	// act
+	// versions written later aren't seen, even of keys within the bounds
+	assert.NoError(t, mem.Apply(at(put("bb", "8"), 8)))
+	assert.NoError(t, mem.Apply(at(put("d", "9"), 9)))
+	forward := memtableEntries(it, it.First(), true)
+	backward := memtableEntries(it, it.Last(), false)
+
+	// assert
+	assert.Equal(t, []string{"b@4", "b@2", "c@3", "d@5"}, forward)
+	assert.Equal(t, []string{"d@5", "c@3", "b@2", "b@4"}, backward)
+
+	assert.True(t, it.Seek([]byte("a")))
+	assert.Equal(t, "b", string(it.Value().Key))
+	assert.True(t, it.Seek([]byte("bb")))
+	assert.Equal(t, "c", string(it.Value().Key))
+	assert.True(t, it.Prev())
+	assert.Equal(t, uint64(2), it.Value().Seq)
+	assert.False(t, it.Seek([]byte("e")))
+}
+
+func TestIteratorConcurrentWrites(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	for i := 0; i < 100; i += 2 {
+		assert.NoError(t, tree.Put([]byte(fmt.Sprintf("%03d", i)), []byte("1")))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 100; i += 2 {
+			assert.NoError(t, tree.Put([]byte(fmt.Sprintf("%03d", i)), []byte("2")))
+		}
+	}()
+
+	// act
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+	it.First()
+	forward := collectKeys(it, true)
+	it.Last()
+	backward := collectKeys(it, false)
+	wg.Wait()
+
+	// assert
+	// whatever odd keys it saw, it sees the same ones both ways
+	assert.NoError(t, it.Err())
+	assert.True(t, sort.StringsAreSorted(forward))
+	slices.Reverse(backward)
+	assert.Equal(t, forward, backward)
+	for i := 0; i < 100; i += 2 {
+		assert.Contains(t, forward, fmt.Sprintf("%03d", i))
+	}
+}
+
+func TestMergingIterTies(t *testing.T) {
+	// arrange
+	newer := &sliceIter{entries: []Entry{put("a", "new"), put("c", "new")}}
+	older := &sliceIter{entries: []Entry{put("a", "old"), put("b", "old"),
+		put("c", "old")}}
+	m := newMergingIter([]Iter[Entry]{newer, older})
+
+	values := func(forward bool) []string {
+		out := make([]string, 0)
+		for ok := m.Valid(); ok; {
+			out = append(out, string(m.Value().Key)+"="+string(m.Value().Value))
+			if forward {
+				ok = m.Next()
+			} else {
+				ok = m.Prev()
+			}
+		}
+		return out
+	}
+
+	// act
+	m.First()
+	forwardValues := values(true)
+	m.Last()
+	backwardValues := values(false)
+
+	// assert
+	assert.Equal(t,
+		[]string{"a=new", "a=old", "b=old", "c=new", "c=old"}, forwardValues)
+	assert.Equal(t,
+		[]string{"c=old", "c=new", "b=old", "a=old", "a=new"}, backwardValues)
+}
+
+func TestMergingIterTurnAround(t *testing.T) {
+	// arrange
+	newer := &sliceIter{entries: []Entry{put("a", "new"), put("c", "new")}}
+	older := &sliceIter{entries: []Entry{put("a", "old"), put("b", "old"),
+		put("c", "old")}}
+	m := newMergingIter([]Iter[Entry]{newer, older})
+
+	// act & assert
+	assert.True(t, m.Seek([]byte("c")))
+	assert.Equal(t, "new", string(m.Value().Value))
+
+	assert.True(t, m.Prev())
+	assert.Equal(t, "b", string(m.Value().Key))
+
+	assert.True(t, m.Prev())
+	assert.Equal(t, "old", string(m.Value().Value))
+
+	assert.True(t, m.Next())
+	assert.Equal(t, "b", string(m.Value().Key))
+
+	assert.True(t, m.Next())
+	assert.Equal(t, "c", string(m.Value().Key))
+	assert.Equal(t, "new", string(m.Value().Value))
+
+	assert.True(t, m.Next())
+	assert.Equal(t, "old", string(m.Value().Value))
+
+	assert.True(t, m.Prev())
+	assert.Equal(t, "new", string(m.Value().Value))
+}
+
+func TestMergingIterOrdersBySeq(t *testing.T) {
+	// arrange
+	// versions of a key are spread over children in any order
+	at := func(e Entry, seq uint64) Entry {
+		e.Seq = seq
+		return e
+	}
+	first := &sliceIter{entries: []Entry{at(put("a", "4"), 4), at(put("a", "1"), 1),
+		at(put("b", "2"), 2)}}
+	second := &sliceIter{entries: []Entry{at(put("a", "3"), 3), at(put("b", "5"), 5)}}
+	m := newMergingIter([]Iter[Entry]{first, second})
+
+	// act & assert
+	m.First()
+	for _, v := range []string{"4", "3", "1", "5", "2"} {
+		assert.True(t, m.Valid())
+		assert.Equal(t, v, string(m.Value().Value))
+		m.Next()
+	}
+	assert.False(t, m.Valid())
+
+	assert.True(t, m.Seek([]byte("a")))
+	assert.True(t, m.Next())
+	assert.Equal(t, "3", string(m.Value().Value))
+	assert.True(t, m.Prev())
+	assert.Equal(t, "4", string(m.Value().Value))
+	assert.True(t, m.Next())
+	assert.True(t, m.Next())
+	assert.Equal(t, "1", string(m.Value().Value))
+	assert.True(t, m.Prev())
+	assert.Equal(t, "3", string(m.Value().Value))
+}
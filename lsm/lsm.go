@@ -5,8 +5,8 @@
 package lsm
 
 import (
-	"bufio"
 	"bytes"
+	"compress/flate"
 	"context"
 	"errors"
 	"fmt"
@@ -14,31 +14,89 @@ import (
 	"path"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"log/slog"
 )
 
 // TODO: left to implement:
 // 1. compaction
-// 2. deletion
-// 3. wal
-// 4. iterator
-// 5. add logging with slog (log to file and stdout)
+// 2. add logging with slog (log to file and stdout)
+
+// ErrClosed is returned by reads and writes of a closed tree.
+var ErrClosed = errors.New("lsm tree is closed")
+
+// ErrEmptyKey is returned by writes of an empty key, tables can't hold it.
+var ErrEmptyKey = errors.New("key cannot be empty")
 
 // threshold thing is mostly simplified
 type Options struct {
 	MemtableThreshold    int // memtable thld == memro table thld == lvl0 sstable thld
-	L1Threshold          int // Nth level thld (where N>1) is calculated as (N-1)*NonL0ThresholdMultipler
+	L1Threshold          int // Nth level thld (where N>1) is calculated as L1Threshold*LNThresholdMultipler^(N-1)
 	LNThresholdMultipler int
 
 	BlockThreshold int
+	// every BlockRestartInterval-th key of a block is stored in full, the
+	// rest share a prefix with the previous key. Lookups scan up to that many
+	// entries, 0 stores every key in full
+	BlockRestartInterval int
+	// bits of sstable bloom filter per key, ~10 gives 1% false positives.
+	// 0 disables filters
+	BloomBitsPerKey int
+	// size of the block cache in bytes, it's created in Recover unless
+	// BlockCache is set. 0 disables caching
+	BlockCacheSize int
+	// BlockCache may be set to share one cache between trees
+	BlockCache *BlockCache
+	// Compression of sstable blocks per level, starting with L0. Levels
+	// deeper than the last one use the last compressor, nil compressor stores
+	// blocks as is. Tables don't get recompressed when they are moved to
+	// another level as they are
+	Compression []Compressor
+	// RateLimiter limits bytes per second written by flushes and
+	// compactions, flushes go first. nil means no limit
+	RateLimiter *RateLimiter
+	// CompactionFilter drops or rewrites entries being compacted, nil keeps
+	// them all
+	CompactionFilter CompactionFilter
+	// MergeOperator combines operands written by LSMTree.Merge, merges fail
+	// without it
+	MergeOperator MergeOperator
+	// values of at least BlobThreshold bytes are kept in blob files and
+	// tables only point to them, 0 keeps all values in tables. A blob file is
+	// finished once it's BlobFileSize big, 0 means never. Compaction moves
+	// values out of blob files with at least BlobGCThreshold of them garbage,
+	// 0 leaves blob files until they are all garbage
+	BlobThreshold   int
+	BlobFileSize    int
+	BlobGCThreshold float64
+	// CompactionPolicy picks tables to compact, nil means NewLeveledPolicy.
+	// Thresholds of levels and MaxL0Tables are up to the policy to respect
+	CompactionPolicy CompactionPolicy
 
 	MaxMemroTables   int
 	MaxL0Tables      int
-	MaxL1Tables      int // Nth level len (where N>1) is calculated as (N-1)+MaxNonL0TablesAdder
+	MaxL1Tables      int // Nth level len (where N>1) is calculated as MaxL1Tables+(N-1)*MaxLNTablesAdder
 	MaxLNTablesAdder int
+
+	// writes are slowed down by SlowdownDelay each once there are this many
+	// readonly memtables or L0 tables, so compaction has a chance to catch
+	// up. 0 disables the slowdown
+	SlowdownMemroTables int
+	SlowdownL0Tables    int
+	SlowdownDelay       time.Duration
+	// writes stop until compaction makes room once there are this many L0
+	// tables, 0 disables the limit. They also stop when the memtable is full
+	// and there are MaxMemroTables readonly memtables already
+	StopL0Tables int
+
+	WalSync         WalSyncPolicy
+	WalSyncInterval time.Duration // only used with WalSyncBatch
+	WalSegmentSize  int           // a segment is rolled over once it gets this big, 0 means never
 }
 
 var DefaultOptions = &Options{
@@ -46,145 +104,377 @@ var DefaultOptions = &Options{
 	L1Threshold:          10 << 20,
 	LNThresholdMultipler: 10,
 
-	BlockThreshold: 1 << 6,
+	BlockThreshold:       1 << 6,
+	BlockRestartInterval: 16,
+	BloomBitsPerKey:      10,
+	BlockCacheSize:       8 << 20,
+	// L0 tables are short lived, don't spend cpu on them
+	Compression: []Compressor{nil, NewFlateCompressor(flate.DefaultCompression)},
+
+	BlobFileSize:    64 << 20,
+	BlobGCThreshold: 0.5,
 
 	MaxMemroTables:   2,
 	MaxL0Tables:      2,
 	MaxL1Tables:      3,
 	MaxLNTablesAdder: 2,
+
+	SlowdownMemroTables: 2,
+	SlowdownL0Tables:    20,
+	SlowdownDelay:       time.Millisecond,
+	StopL0Tables:        36,
+
+	WalSync:         WalSyncBatch,
+	WalSyncInterval: 100 * time.Millisecond,
+	WalSegmentSize:  4 << 20,
+}
+
+// compressor returns the compressor of level n (L0 is n=0).
+func (o Options) compressor(n int) Compressor {
+	if len(o.Compression) == 0 {
+		return nil
+	}
+
+	return o.Compression[min(n, len(o.Compression)-1)]
+}
+
+// levelThreshold is the max size of level n (L1 is n=1) in bytes.
+func (o Options) levelThreshold(n int) int {
+	thld := o.L1Threshold
+	for i := 1; i < n; i++ {
+		thld *= o.LNThresholdMultipler
+	}
+
+	return thld
+}
+
+// levelMaxTables is the number of tables level n (L1 is n=1) is split into.
+func (o Options) levelMaxTables(n int) int {
+	return o.MaxL1Tables + (n-1)*o.MaxLNTablesAdder
+}
+
+// tableThreshold is the size of a single table on level n (L1 is n=1).
+func (o Options) tableThreshold(n int) int {
+	return o.levelThreshold(n) / o.levelMaxTables(n)
 }
 
 type LSMTree struct {
+	dir         string
 	mem         *Memtable // TODO: put wal into Memtable struct?
 	wal         *Wal
+	writeGuard  *sync.Mutex   // keeps wal and memtable in the same write order
 	rodataGuard *sync.RWMutex // wlocks memro, lvl0, and lvln during compaction
 	memro       []*ReadonlyMemtable
 	lvl0        []*SSTable
 	lvln        [][]*SSTable
+	blobs       *blobSet
+	nextFile    *atomic.Uint64
+	manifest    *manifest // guarded by rodataGuard
 	compact     CompactorHandle
+	compactor   *Compactor
 	opt         Options
+	closed      bool // guarded by rodataGuard
+	// opened with OpenReadOnly: no wal, manifest or compactor, writeGuard
+	// serializes catch-ups instead of writes
+	readOnly bool
+	// seq is the sequence number of the last write visible to readers. A
+	// write gets its number under writeGuard and becomes visible once it's
+	// in the memtable, a batch becomes visible all at once
+	seq       *atomic.Uint64
+	snapshots *snapshotList
+	stalls    *stallStats
 }
 
 func (tree *LSMTree) Get(k []byte) ([]byte, error) {
+	return tree.get(k, tree.seq.Load())
+}
+
+// get returns the newest version of k not newer than seq. Merge operands on
+// top of it are combined with it, which takes looking further down until a
+// value or a tombstone. Range tombstones of any table may delete k, so all
+// of them are looked at.
+func (tree *LSMTree) get(k []byte, seq uint64) ([]byte, error) {
 	tree.rodataGuard.RLock()
 	defer tree.rodataGuard.RUnlock()
 
-	// try find in memtable
-	val, err := tree.mem.Get(k)
-	if err != nil && !errors.Is(err, ErrKeyNotFound) {
-		return nil, err
-	}
-
-	if err == nil {
-		return val, nil
+	if tree.closed {
+		return nil, ErrClosed
 	}
 
-	// try find in readonly memtables
-	for _, r := range tree.memro {
-		val, err := r.Get(k)
-		if err != nil && !errors.Is(err, ErrKeyNotFound) {
-			return nil, err
+	// versions older than a range tombstone covering k are deleted
+	cover := tree.rangeCover(k, seq)
+	r := mergeResolver{op: tree.opt.MergeOperator, blob: tree.blobs.read}
+	visit := func(e Entry) bool {
+		if e.Seq < cover {
+			e = Entry{Key: k, Kind: KindTombstone, Seq: e.Seq}
 		}
+		return r.add(k, e)
+	}
 
-		if err == nil {
-			return val, nil
-		}
+	// try find in memtable, then in readonly memtables, newest first
+	done := tree.mem.versions(k, seq, visit)
+	for i := len(tree.memro) - 1; !done && i >= 0; i-- {
+		done = tree.memro[i].table.versions(k, seq, visit)
 	}
 
 	// try find in level 0 sstables
-	// level 0 sstables are not sorted by keys so need an O(n) lookup
-	for _, sst := range tree.lvl0 {
-		val, err := sst.Get(k)
-		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+	// level 0 sstables are not sorted by keys so need an O(n) lookup, newest
+	// first. Bloom filters let most of them be skipped without disk reads
+	for i := len(tree.lvl0) - 1; !done && i >= 0; i-- {
+		var err error
+		if done, err = tree.lvl0[i].versions(k, seq, visit); err != nil {
 			return nil, err
 		}
-
-		if err == nil {
-			return val, nil
-		}
 	}
 
 	// try find in sstables
-	var (
-		sst   *SSTable
-		found bool
-	)
 	for _, level := range tree.lvln {
-		i, found := slices.BinarySearchFunc(level, k, func(t *SSTable, k []byte) int {
-			moreThanFirst := bytes.Compare(k, t.FirstKey()) > 0
-			lessThanLast := bytes.Compare(k, t.LastKey()) < 0
+		if done {
+			break
+		}
 
-			if !moreThanFirst {
+		i, found := slices.BinarySearchFunc(level, k, func(t *SSTable, k []byte) int {
+			if bytes.Compare(t.LastKey(), k) < 0 {
 				return -1
 			}
 
-			if !lessThanLast {
+			if bytes.Compare(t.FirstKey(), k) > 0 {
 				return 1
 			}
 
 			return 0
 		})
 
-		if found {
-			sst = level[i]
-			found = true
-			break
+		if !found {
+			continue
+		}
+
+		var err error
+		if done, err = level[i].versions(k, seq, visit); err != nil {
+			return nil, err
 		}
 	}
 
-	if !found {
+	if !r.done {
+		r.finish(k, nil, false)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// a key which newest version is a tombstone is just not found, no
+	// matter what older levels hold
+	if !r.found {
 		return nil, ErrKeyNotFound
 	}
 
-	return sst.Get(k)
+	return r.value, nil
 }
 
 func (tree *LSMTree) Put(k, v []byte) error {
-	tree.rodataGuard.RLock()
+	return tree.PutContext(context.Background(), k, v)
+}
 
-	if tree.mem.Size() < tree.opt.MemtableThreshold {
-		slog.Debug("putting into memtable")
-		// best case: just write to memtable.
-		// most callers will end up here which is ✨blazingly fast✨
-		tree.rodataGuard.RUnlock()
-		return tree.mem.Put(k, v)
+// PutContext is Put which gives up once ctx is done while the write is held
+// back for compaction to catch up, see Options.StopL0Tables.
+func (tree *LSMTree) PutContext(ctx context.Context, k, v []byte) error {
+	return tree.write(ctx, []Entry{{Key: k, Value: v, Kind: KindValue}})
+}
+
+// Del writes a tombstone for k. The tombstone shadows all older versions of the
+// key and is dropped by compaction once it reaches the bottom level.
+func (tree *LSMTree) Del(k []byte) error {
+	return tree.DelContext(context.Background(), k)
+}
+
+// DelContext is Del which gives up like PutContext does.
+func (tree *LSMTree) DelContext(ctx context.Context, k []byte) error {
+	return tree.write(ctx, []Entry{{Key: k, Kind: KindTombstone}})
+}
+
+// write applies entries as one unit, see Write. While compaction falls behind
+// the write is slowed down or waits for it, see writeStall.
+func (tree *LSMTree) write(ctx context.Context, entries []Entry) error {
+	if tree.readOnly {
+		return ErrReadOnly
+	}
+
+	// checked before the wal gets it, a flush would fail on it forever
+	for _, e := range entries {
+		if len(e.Key) == 0 {
+			return ErrEmptyKey
+		}
 	}
 
-	tree.rodataGuard.RUnlock()
+	slowed := false
+	for {
+		// taken before looking at the tree, so a change made right after
+		// isn't missed
+		changed := tree.compact.ctl.changed()
 
-	slog.Debug("waiting on compaction")
-	// worst case: we block here if compaction is still in progress.
-	// it means that memtable and memro tables are full
-	tree.compact.Waitc() <- struct{}{} /// TODO rename Compactor to PartialCompactor?
+		tree.rodataGuard.RLock()
+		if tree.closed {
+			tree.rodataGuard.RUnlock()
+			return ErrClosed
+		}
 
-	tree.rodataGuard.Lock()
-	if len(tree.memro) < tree.opt.MaxMemroTables {
-		slog.Debug("dumping memtable as readonly")
-		// ok case: memtable is full but memro tables (readonly memtables)
-		// are not, just dump memtable to memro tables
-		ro := tree.mem.Clone().AsReadonly() // TODO do i need clone here?
-		tree.memro = append(tree.memro, &ro)
-		tree.mem = NewMemtable()
-
-		// if we reached max memro limit, trigger the compaction right away so
-		// we win time until worst case happens
-		if len(tree.memro) == tree.opt.MaxMemroTables {
+		stall := tree.stall()
+		if stall == writeStop || stall == writeSlowdown && !slowed {
+			tree.rodataGuard.RUnlock()
+			slowed = true
+			if err := tree.waitStall(ctx, stall, changed); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if tree.mem.Size() < tree.opt.MemtableThreshold {
+			slog.Debug("putting into memtable")
+			// best case: just write to memtable.
+			// most callers will end up here which is ✨blazingly fast✨
+			defer tree.rodataGuard.RUnlock()
+			return tree.apply(entries)
+		}
+		tree.rodataGuard.RUnlock()
+
+		tree.rodataGuard.Lock()
+		if tree.closed {
+			tree.rodataGuard.Unlock()
+			return ErrClosed
+		}
+
+		// another writer may have been here first
+		trigger := false
+		if tree.mem.Size() >= tree.opt.MemtableThreshold {
+			if len(tree.memro) >= tree.opt.MaxMemroTables {
+				// memro is full, this is a stall now
+				tree.rodataGuard.Unlock()
+				continue
+			}
+
+			slog.Debug("dumping memtable as readonly")
+			// ok case: memtable is full but memro tables (readonly memtables)
+			// are not, just dump memtable to memro tables
+			if err := tree.rotateMemtable(); err != nil {
+				tree.rodataGuard.Unlock()
+				return err
+			}
+
+			// if we reached max memro limit, trigger the compaction right away
+			// so we win time until worst case happens
+			trigger = len(tree.memro) == tree.opt.MaxMemroTables
+		}
+		err := tree.apply(entries)
+		tree.rodataGuard.Unlock()
+
+		if trigger {
 			slog.Debug("readonly memtable limit reached, triggering compaction")
-			tree.compact.Triggerc() <- struct{}{}
+			tree.compact.trigger()
 		}
+
+		return err
+	}
+}
+
+// rotateMemtable makes the memtable readonly and starts a new one. Its wal
+// segment is sealed along with it, so the segment can go away once the table
+// is flushed. Caller must hold rodataGuard.
+func (tree *LSMTree) rotateMemtable() error {
+	seg, err := tree.wal.Rotate()
+	if err != nil {
+		return err
 	}
-	tree.rodataGuard.Unlock()
 
-	return tree.mem.Put(k, v)
+	ro := tree.mem.Clone().AsReadonly() // TODO do i need clone here?
+	ro.walSegment = seg
+	tree.memro = append(tree.memro, &ro)
+	tree.mem = NewMemtable()
+	return nil
 }
 
-func (t *LSMTree) Del(k []byte) error {
-	panic("unimpl")
+// apply numbers entries, appends them to the wal as a single record and then
+// to the active memtable. They become visible to readers only after all of
+// them are in the memtable. Caller must hold rodataGuard so the memtable is
+// not rotated in between.
+func (tree *LSMTree) apply(entries []Entry) error {
+	tree.writeGuard.Lock()
+	defer tree.writeGuard.Unlock()
+
+	seq := tree.seq.Load()
+	numbered := make([]Entry, len(entries))
+	for i, e := range entries {
+		e.Seq = seq + uint64(i) + 1
+		numbered[i] = e
+	}
+
+	if err := tree.wal.AppendBatch(numbered); err != nil {
+		return err
+	}
+
+	for _, e := range numbered {
+		if err := tree.mem.Apply(e); err != nil {
+			return err
+		}
+	}
+
+	tree.seq.Store(seq + uint64(len(entries)))
+	return nil
+}
+
+// BlockCacheStats reports counters of the block cache used by the tree.
+func (tree *LSMTree) BlockCacheStats() BlockCacheStats {
+	return tree.opt.BlockCache.Stats()
 }
 
-func (t *LSMTree) Close() error {
-	// TODO basically just close all files
-	panic("unimpl")
+// Close shuts the tree down cleanly. New reads and writes are rejected,
+// compaction in progress is waited for, then the memtable and readonly
+// memtables are flushed to L0, so the next Recover has no wal to replay.
+// Files of sstables still read by open iterators are closed when those
+// iterators are closed.
+func (tree *LSMTree) Close() error {
+	tree.rodataGuard.Lock()
+	if tree.closed {
+		tree.rodataGuard.Unlock()
+		return ErrClosed
+	}
+	tree.closed = true
+	tree.rodataGuard.Unlock()
+
+	if tree.readOnly {
+		return tree.closeReadOnly()
+	}
+
+	tree.compact.stop()
+	// CompactRange gives up on the level after the one it's at
+	tree.compactor.levels.waitIdle()
+
+	// with the compactor stopped and writes rejected, memtables are flushed
+	// right here
+	var errs []error
+	if tree.mem.Len() > 0 {
+		if err := tree.rotateMemtable(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		if err := tree.compactor.flush(); err != nil {
+			errs = append(errs, fmt.Errorf("flushing memtables: %w", err))
+		}
+	}
+
+	errs = append(errs, tree.wal.Close(), tree.manifest.Close(), tree.blobs.close())
+	for _, sst := range tree.lvl0 {
+		errs = append(errs, sst.Unref())
+	}
+	for _, lvl := range tree.lvln {
+		for _, sst := range lvl {
+			errs = append(errs, sst.Unref())
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
 func Recover(ctx context.Context, dir string, opts *Options) (*LSMTree, error) {
@@ -192,123 +482,319 @@ func Recover(ctx context.Context, dir string, opts *Options) (*LSMTree, error) {
 		opts = DefaultOptions
 	}
 
+	// options are copied to not share the cache and the policy through
+	// DefaultOptions
+	opt := *opts
+	if opt.BlockCache == nil && opt.BlockCacheSize > 0 {
+		opt.BlockCache = NewBlockCache(opt.BlockCacheSize)
+	}
+	if opt.CompactionPolicy == nil {
+		opt.CompactionPolicy = NewLeveledPolicy()
+	}
+
 	absdir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	// first read manifest file and get paths of wal and sst levels
-	f, err := os.Open(path.Join(dir, "MANIFEST"))
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return nil, err
+	if err := os.MkdirAll(absdir, 0777); err != nil {
+		return nil, fmt.Errorf("making dir: %w", err)
 	}
 
-	if errors.Is(err, os.ErrNotExist) {
-		slog.Debug("MANIFEST not foudn, creating at " +
-			path.Join(absdir, "WAL"))
+	// first read manifest to get the version: wal dir and tables of levels
+	v, err := loadVersion(absdir)
+	fresh := errors.Is(err, os.ErrNotExist)
+	if fresh {
+		slog.Debug("CURRENT not found, starting a new tree at " + absdir)
+		v, err = version{walDir: "WAL", nextFile: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		if err := os.Mkdir(path.Join(absdir), 0777); err != nil {
-			return nil, fmt.Errorf("making dir: %w", err)
-		}
+	// second load sstables of the version, and blob files which go with
+	// them
+	layout, err := openVersion(absdir, v, nil, nil, opt.BlockCache)
+	if err != nil {
+		return nil, err
+	}
 
-		wal, err := os.Create(path.Join(absdir, "WAL"))
-		if err != nil {
-			return nil, fmt.Errorf("creating wal: %w", err)
-		}
+	walPath := v.walDir
+	if !filepath.IsAbs(walPath) {
+		walPath = path.Join(absdir, walPath)
+	}
 
-		defer wal.Close()
+	// third replay wal into a fresh memtable. Its segments stay until the
+	// memtable is rotated and flushed like any other. Nothing in dir is
+	// changed before the wal is open, so a tree which fails here still opens
+	// with older code
+	if err := moveLegacyWal(walPath); err != nil {
+		layout.release()
+		return nil, err
+	}
+	wal, err := OpenWal(walPath, opt)
+	if err != nil {
+		layout.release()
+		return nil, err
+	}
 
-		f, err = os.Create(path.Join(absdir, "MANIFEST"))
-		if err != nil {
-			return nil, fmt.Errorf("creating manifest: %w", err)
+	// records written before sequence numbers existed are numbered in the
+	// order they were written. Records which are in tables already are left
+	// out: a crash between a flush and releasing its wal segments leaves them
+	// there, and merge operands must not be applied twice
+	mem := NewMemtable()
+	seq := v.lastSeq
+	err = wal.Replay(func(e Entry) error {
+		if e.Seq == 0 {
+			e.Seq = seq + 1
 		}
-
-		_, err = fmt.Fprintln(f, path.Join(absdir, "WAL"))
-		if err != nil {
-			return nil, err
+		if e.Seq <= v.lastSeq {
+			return nil
 		}
+		seq = max(seq, e.Seq)
+		return mem.Apply(e)
+	})
+	if err != nil {
+		layout.release()
+		wal.Close()
+		return nil, fmt.Errorf("replaying wal: %w", err)
 	}
 
-	defer f.Close()
+	// a new manifest is started with a snapshot of the version. Tables which
+	// are not in the version were written by a flush or compaction which
+	// didn't make it to the manifest before a crash
+	nextFile := v.nextFile
+	v.nextFile++
+	manifest, err := createManifest(absdir, nextFile, v)
+	if err != nil {
+		layout.release()
+		wal.Close()
+		return nil, err
+	}
+	// with no manifest at all there's nothing to tell orphans by, whatever
+	// is in dir is left alone
+	if !fresh {
+		removeOrphanTables(absdir, v)
+	}
 
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
+	// fourth initialize tree and compaction
+	lvl0, lvln := layout.split()
+	blobs := newBlobSet()
+	blobs.files, blobs.garbage = layout.blobs, layout.garbage
 
-	if !scanner.Scan() {
-		return nil, errors.New("bad manifest")
+	tree := &LSMTree{
+		dir:         absdir,
+		mem:         mem,
+		wal:         wal,
+		writeGuard:  new(sync.Mutex),
+		rodataGuard: new(sync.RWMutex),
+		memro:       make([]*ReadonlyMemtable, 0),
+		lvl0:        lvl0,
+		lvln:        lvln,
+		blobs:       blobs,
+		nextFile:    new(atomic.Uint64),
+		manifest:    manifest,
+		opt:         opt,
+		seq:         new(atomic.Uint64),
+		snapshots:   newSnapshotList(),
+		stalls:      new(stallStats),
 	}
+	tree.nextFile.Store(v.nextFile)
+	tree.seq.Store(seq)
+
+	compactor := newCompactor(tree, opt)
+	tree.compact, tree.compactor = compactor.handle, compactor
+
+	// fifth run compactor in bg and finish
+	go compactor.Listen(ctx)
+
+	return tree, nil
+}
+
+// versionLayout holds tables and blob files of a version, each referenced
+// once by it.
+type versionLayout struct {
+	levels  [][]*SSTable // L0 first, deeper levels are sorted
+	blobs   blobFiles
+	garbage map[uint64]uint64
+}
 
-	walPath := scanner.Text()
-	levelPaths := make([][]string, 0)
-	for scanner.Scan() {
-		line := scanner.Text()
-		tablePaths := strings.Split(line, ",")
-		levelPaths = append(levelPaths, tablePaths)
+// split returns L0 and deeper levels the way LSMTree holds them.
+func (l versionLayout) split() ([]*SSTable, [][]*SSTable) {
+	lvl0 := make([]*SSTable, 0)
+	if len(l.levels) > 0 {
+		lvl0 = l.levels[0]
 	}
 
-	if scanner.Err() != nil {
-		return nil, fmt.Errorf("reading file: %w", err)
+	lvln := make([][]*SSTable, 0)
+	if len(l.levels) > 1 {
+		lvln = l.levels[1:]
 	}
 
-	// TODO implement wal
-	walPath = walPath
+	return lvl0, lvln
+}
 
-	// second read all paths to load sstables
-	lvls := make([][]*SSTable, 0, len(levelPaths))
-	for _, paths := range levelPaths {
-		lvl := make([]*SSTable, 0, len(paths))
-		for _, p := range paths {
-			f, err := os.OpenFile(p, os.O_RDWR, 0666)
-			if err != nil {
-				return nil, fmt.Errorf("opening %s: %w", p, err)
+// openVersion opens tables and blob files of v, the ones already open are
+// taken from tables and blobs and referenced once more.
+func openVersion(
+	dir string,
+	v version,
+	tables map[uint64]*SSTable,
+	blobs blobFiles,
+	cache *BlockCache,
+) (versionLayout, error) {
+	l := versionLayout{
+		levels:  make([][]*SSTable, 0, len(v.levels)),
+		blobs:   make(blobFiles, len(v.blobs)),
+		garbage: make(map[uint64]uint64, len(v.blobs)),
+	}
+
+	for i, nums := range v.levels {
+		l.levels = append(l.levels, make([]*SSTable, 0, len(nums)))
+		for _, num := range nums {
+			sst, ok := tables[num]
+			if ok {
+				sst.Ref()
+			} else {
+				p := sstPath(dir, num)
+				f, err := os.Open(p)
+				if err != nil {
+					l.release()
+					return versionLayout{}, fmt.Errorf("opening %s: %w", p, err)
+				}
+
+				opened, err := SSTableFromFile(f, cache)
+				if err != nil {
+					f.Close()
+					l.release()
+					return versionLayout{}, err
+				}
+				sst = &opened
 			}
+			l.levels[i] = append(l.levels[i], sst)
+		}
 
-			sst, err := SSTableFromFile(f)
+		// tables of L1 and deeper are added to the manifest in no
+		// particular order, but the tree needs them sorted
+		if i > 0 {
+			slices.SortFunc(l.levels[i], func(a, b *SSTable) int {
+				return bytes.Compare(a.FirstKey(), b.FirstKey())
+			})
+		}
+	}
+
+	for num, meta := range v.blobs {
+		bf, ok := blobs[num]
+		if ok {
+			bf.Ref()
+		} else {
+			p := blobPath(dir, num)
+			f, err := os.Open(p)
 			if err != nil {
-				return nil, err
+				l.release()
+				return versionLayout{}, fmt.Errorf("opening %s: %w", p, err)
 			}
+			bf = newBlobFile(num, f, meta.size)
+		}
 
-			lvl = append(lvl, &sst)
-			f.Close()
+		l.blobs[num] = bf
+		l.garbage[num] = meta.garbage
+	}
+
+	return l, nil
+}
+
+// release drops references of the layout.
+func (l versionLayout) release() {
+	for _, lvl := range l.levels {
+		for _, sst := range lvl {
+			sst.Unref()
 		}
-		lvls = append(lvls, lvl)
 	}
+	for _, f := range l.blobs {
+		f.Unref()
+	}
+}
 
-	lvl0 := make([]*SSTable, 0)
-	if len(lvls) > 0 {
-		lvl0 = lvls[0]
+// newSSTablePath reserves a new file number for a sstable.
+func (tree *LSMTree) newSSTablePath() string {
+	return sstPath(tree.dir, tree.nextFile.Add(1)-1)
+}
+
+// logEdit persists a change of levels layout. It must be called before the
+// change is made visible, with rodataGuard held. When it fails, the caller
+// drops the change and a new manifest without it takes over, so files of the
+// change may go. If even that fails, no more changes are persisted.
+func (tree *LSMTree) logEdit(e versionEdit) error {
+	e.nextFile = tree.nextFile.Load()
+	err := tree.manifest.logAndApply(e)
+	if err == nil {
+		return nil
 	}
 
-	lvln := make([][]*SSTable, 0)
-	if len(lvls) > 1 {
-		lvln = lvls[1:]
+	num := tree.nextFile.Add(1) - 1
+	if rerr := tree.manifest.rollover(num, tree.nextFile.Load()); rerr != nil {
+		slog.Error("manifest is unusable", "err", rerr)
+		return errors.Join(err, rerr)
 	}
 
-	// third initialize tree and compaction
-	compactorHandle := CompactorHandle{
-		triggerc: make(chan struct{}),
-		waitc:    make(chan struct{}),
+	return err
+}
+
+const sstFileExt = ".sst"
+
+func sstPath(dir string, num uint64) string {
+	return path.Join(dir, fmt.Sprintf("%06d%s", num, sstFileExt))
+}
+
+// tableRefs refers to tables at level for a version edit.
+func tableRefs(level int, tables []*SSTable) []tableRef {
+	refs := make([]tableRef, 0, len(tables))
+	for _, sst := range tables {
+		refs = append(refs, tableRef{level, sstFileNum(sst.Path())})
 	}
 
-	tree := &LSMTree{
-		mem:         NewMemtable(),
-		wal:         nil,
-		rodataGuard: new(sync.RWMutex),
-		memro:       make([]*ReadonlyMemtable, 0),
-		lvl0:        lvl0,
-		lvln:        lvln,
-		compact:     compactorHandle,
-		opt:         *opts,
+	return refs
+}
+
+// removeOrphanTables removes sstables and blob files in dir which v doesn't
+// know about.
+func removeOrphanTables(dir string, v version) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
 	}
 
-	compactor := Compactor{
-		handle: compactorHandle,
-		tree:   tree,
-		opt:    *opts,
+	for _, e := range entries {
+		var num uint64
+		known := true
+		switch {
+		case strings.HasSuffix(e.Name(), sstFileExt):
+			num = sstFileNum(e.Name())
+			known = v.contains(num)
+		case strings.HasSuffix(e.Name(), blobFileExt):
+			num = blobFileNum(e.Name())
+			_, known = v.blobs[num]
+		}
+		if num == 0 || known {
+			continue
+		}
+
+		slog.Debug("removing orphan file", "file", e.Name())
+		os.Remove(path.Join(dir, e.Name()))
 	}
+}
 
-	// fourth run compactor in bg and finish
-	go compactor.Listen(ctx)
+// blobFileNum is sstFileNum for blob files.
+func blobFileNum(p string) uint64 {
+	name, _ := strings.CutSuffix(filepath.Base(p), blobFileExt)
+	n, _ := strconv.ParseUint(name, 10, 64)
+	return n
+}
 
-	return tree, nil
+// sstFileNum parses number out of sstable file name, 0 when it isn't numbered.
+func sstFileNum(p string) uint64 {
+	name, _ := strings.CutSuffix(filepath.Base(p), sstFileExt)
+	n, _ := strconv.ParseUint(name, 10, 64)
+	return n
 }
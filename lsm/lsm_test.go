@@ -6,9 +6,11 @@ import (
 	"log/slog"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/golang-cz/devslog"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLSMTree(t *testing.T) {
@@ -18,11 +20,11 @@ func TestLSMTree(t *testing.T) {
 	}}
 	slog.SetDefault(slog.New(devslog.NewHandler(os.Stdout, logOpts)))
 
-	opts := DefaultOptions
+	opts := *DefaultOptions
 	opts.MemtableThreshold = 1 << 5
-	tree, err := Recover(context.Background(), "./db", opts)
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
 	if err != nil {
-		t.Errorf("recovering: %s", err.Error())
+		t.Fatalf("recovering: %s", err.Error())
 	}
 
 	for i := 0; i < 100; i++ {
@@ -34,8 +36,221 @@ func TestLSMTree(t *testing.T) {
 
 	value, err := tree.Get([]byte(strconv.Itoa(42)))
 	if err != nil {
-		t.Error("getting: %w", err)
+		t.Errorf("getting: %s", err.Error())
 	}
 
 	t.Logf("value: %s", value)
+	assert.NoError(t, tree.Close())
+}
+
+func TestLSMTreeConcurrentPuts(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 10
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	// act
+	// writers check the memtable size while others apply to it
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				k := []byte(strconv.Itoa(w) + "_" + strconv.Itoa(i))
+				assert.NoError(t, tree.Put(k, bytes.Repeat([]byte("x"), 64)))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// assert
+	for w := 0; w < 4; w++ {
+		_, err := tree.Get([]byte(strconv.Itoa(w) + "_99"))
+		assert.NoError(t, err)
+	}
+}
+
+func TestLSMTreeRecoverFromWal(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+	opts.WalSync = WalSyncAlways
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tree, err := Recover(ctx, dir, &opts)
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		k := []byte("key" + strconv.Itoa(i))
+		assert.NoError(t, tree.Put(k, []byte("v1")))
+	}
+	assert.NoError(t, tree.Put([]byte("key3"), []byte("v2")))
+
+	// act
+	// no Close, the tree is just abandoned as if the process died
+	cancel()
+	recovered, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	// assert
+	for i := 0; i < 10; i++ {
+		v, err := recovered.Get([]byte("key" + strconv.Itoa(i)))
+		assert.NoError(t, err)
+		if i == 3 {
+			assert.Equal(t, []byte("v2"), v)
+		} else {
+			assert.Equal(t, []byte("v1"), v)
+		}
+	}
+}
+
+func TestLSMTreeFlushReleasesWal(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 5
+	opts.MaxMemroTables = 1
+	opts.MaxL0Tables = 1 << 10
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tree, err := Recover(ctx, dir, &opts)
+	assert.NoError(t, err)
+
+	// act
+	for i := 0; i < 20; i++ {
+		k := []byte("key" + strconv.Itoa(i))
+		v := bytes.Repeat([]byte{byte(i)}, 1<<5)
+		assert.NoError(t, tree.Put(k, v))
+	}
+
+	// wait for in-flight compaction to finish
+	assert.NoError(t, tree.compact.flush(context.Background()))
+	cancel()
+	recovered, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	// assert
+	segs, err := walSegments(tree.wal.dir)
+	assert.NoError(t, err)
+	assert.Less(t, len(segs), 20)
+
+	for i := 0; i < 20; i++ {
+		v, err := recovered.Get([]byte("key" + strconv.Itoa(i)))
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1<<5), v)
+	}
+}
+
+func TestLSMTreeEmptyKey(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	var b WriteBatch
+	b.Put([]byte("a"), []byte("1"))
+	b.Put(nil, []byte("1"))
+
+	// act
+	errPut := tree.Put([]byte{}, []byte("1"))
+	errDel := tree.Del(nil)
+	errBatch := tree.Write(&b)
+
+	// assert
+	assert.ErrorIs(t, errPut, ErrEmptyKey)
+	assert.ErrorIs(t, errDel, ErrEmptyKey)
+	assert.ErrorIs(t, errBatch, ErrEmptyKey)
+
+	// nothing got to the wal or the memtable, so flushes still work
+	assert.Zero(t, tree.mem.Len())
+	assert.NoError(t, tree.Put([]byte("b"), []byte("1")))
+	assert.NoError(t, tree.flushMemtable(context.Background()))
+	_, err = tree.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestLSMTreeDel(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 5
+	opts.MaxMemroTables = 1
+	opts.MaxL0Tables = 1 << 10
+
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
+	assert.NoError(t, err)
+
+	old := bytes.Repeat([]byte("x"), 1<<5)
+	assert.NoError(t, tree.Put([]byte("flushed"), old))
+	assert.NoError(t, tree.Put([]byte("fresh"), []byte("v")))
+	// rotate memtable so "flushed" ends up in L0
+	assert.NoError(t, tree.Put([]byte("filler"), old))
+	assert.NoError(t, tree.compact.flush(context.Background()))
+
+	// act
+	errFlushed := tree.Del([]byte("flushed"))
+	errFresh := tree.Del([]byte("fresh"))
+
+	// assert
+	assert.NoError(t, errFlushed)
+	assert.NoError(t, errFresh)
+
+	_, err = tree.Get([]byte("flushed"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = tree.Get([]byte("fresh"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	v, err := tree.Get([]byte("filler"))
+	assert.NoError(t, err)
+	assert.Equal(t, old, v)
+	assert.NoError(t, tree.compact.flush(context.Background()))
+}
+
+func TestLSMTreeClose(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 6
+	opts.MaxMemroTables = 1
+
+	tree, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		k := []byte("key" + strconv.Itoa(i))
+		assert.NoError(t, tree.Put(k, bytes.Repeat([]byte{byte(i)}, 1<<4)))
+	}
+	assert.NoError(t, tree.Del([]byte("key3")))
+
+	// act
+	err = tree.Close()
+
+	// assert
+	assert.NoError(t, err)
+	assert.ErrorIs(t, tree.Put([]byte("key"), []byte("v")), ErrClosed)
+	_, err = tree.Get([]byte("key1"))
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, tree.Close(), ErrClosed)
+
+	// everything is in sstables, there is no wal left to replay
+	segs, err := walSegments(tree.wal.dir)
+	assert.NoError(t, err)
+	assert.Empty(t, segs)
+
+	recovered, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+	assert.Zero(t, recovered.mem.Len())
+
+	for i := 0; i < 20; i++ {
+		v, err := recovered.Get([]byte("key" + strconv.Itoa(i)))
+		if i == 3 {
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 1<<4), v)
+	}
+	assert.NoError(t, recovered.Close())
 }
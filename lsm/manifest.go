@@ -0,0 +1,515 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The layout of the tree (which sstables are on which level, where the wal
+// is) is kept in a MANIFEST file. Like in leveldb, MANIFEST is an append-only
+// log of version edits, replaying all of them gives the current version. Every
+// change of the layout (flush, compaction) is a single edit, which is synced
+// before the change becomes visible, so a crash never loses track of tables.
+//
+// Records of MANIFEST are framed the same way as wal records (len, crc32c,
+// payload) and a torn last record is an edit which never happened.
+//
+// There may be several MANIFEST-<num> files in the dir, a CURRENT file names
+// the one in use. Recover starts a new manifest holding a snapshot of the
+// whole version, then switches CURRENT to it by renaming a temporary file, so
+// manifests don't grow forever and a crash leaves either the old or the new
+// one current.
+const (
+	currentFileName = "CURRENT"
+	manifestPrefix  = "MANIFEST-"
+	// trees written before the edit log have a plain text MANIFEST and no
+	// CURRENT, see loadLegacyManifest
+	legacyManifestName = "MANIFEST"
+)
+
+// version is the layout of the tree in terms of file numbers.
+type version struct {
+	walDir   string // relative to the tree dir unless absolute
+	nextFile uint64
+	lastSeq  uint64     // the largest seq in tables, the wal may hold larger
+	levels   [][]uint64 // L0 tables are kept in the order they were added
+	blobs    map[uint64]blobMeta
+}
+
+type tableRef struct {
+	level int
+	num   uint64
+}
+
+// blobMeta is what the manifest knows about a blob file: bytes of values it
+// holds, and how many of them no table points to anymore.
+type blobMeta struct {
+	size    uint64
+	garbage uint64
+}
+
+// blobRef is a number of bytes of blob file num.
+type blobRef struct {
+	num   uint64
+	bytes uint64
+}
+
+// versionEdit turns one version into the next one. Zero fields are not set.
+type versionEdit struct {
+	walDir   string
+	nextFile uint64
+	lastSeq  uint64
+	added    []tableRef
+	removed  []tableRef
+	// blob files added with their sizes, garbage added to blob files, and
+	// blob files removed
+	addedBlobs   []blobRef
+	blobGarbage  []blobRef
+	removedBlobs []uint64
+}
+
+type editTag byte
+
+const (
+	tagWalDir editTag = iota + 1
+	tagNextFile
+	tagAddTable
+	tagRemoveTable
+	tagLastSeq
+	tagAddBlob
+	tagBlobGarbage
+	tagRemoveBlob
+)
+
+var errBadManifestEdit = errors.New("malformed manifest edit")
+
+func (v *version) apply(e versionEdit) {
+	if e.walDir != "" {
+		v.walDir = e.walDir
+	}
+
+	if e.nextFile != 0 {
+		v.nextFile = e.nextFile
+	}
+
+	if e.lastSeq != 0 {
+		v.lastSeq = e.lastSeq
+	}
+
+	for _, ref := range e.removed {
+		if ref.level < len(v.levels) {
+			v.levels[ref.level] = slices.DeleteFunc(v.levels[ref.level],
+				func(num uint64) bool { return num == ref.num })
+		}
+	}
+
+	for _, ref := range e.added {
+		for len(v.levels) <= ref.level {
+			v.levels = append(v.levels, nil)
+		}
+		v.levels[ref.level] = append(v.levels[ref.level], ref.num)
+	}
+
+	if v.blobs == nil && len(e.addedBlobs) > 0 {
+		v.blobs = make(map[uint64]blobMeta)
+	}
+	for _, ref := range e.addedBlobs {
+		v.blobs[ref.num] = blobMeta{size: ref.bytes}
+	}
+
+	for _, ref := range e.blobGarbage {
+		if meta, ok := v.blobs[ref.num]; ok {
+			meta.garbage += ref.bytes
+			v.blobs[ref.num] = meta
+		}
+	}
+
+	for _, num := range e.removedBlobs {
+		delete(v.blobs, num)
+	}
+}
+
+// snapshot is an edit creating v from scratch.
+func (v *version) snapshot() versionEdit {
+	e := versionEdit{walDir: v.walDir, nextFile: v.nextFile, lastSeq: v.lastSeq}
+	for level, nums := range v.levels {
+		for _, num := range nums {
+			e.added = append(e.added, tableRef{level, num})
+		}
+	}
+
+	for num, meta := range v.blobs {
+		e.addedBlobs = append(e.addedBlobs, blobRef{num, meta.size})
+		if meta.garbage > 0 {
+			e.blobGarbage = append(e.blobGarbage, blobRef{num, meta.garbage})
+		}
+	}
+
+	return e
+}
+
+// contains tells if v references table num on any level.
+func (v *version) contains(num uint64) bool {
+	for _, nums := range v.levels {
+		if slices.Contains(nums, num) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// on disk edit representation is a sequence of fields, each starting with a
+// tag (1B) followed by uvarints:
+// wal dir:      tag | len | dir
+// next file:    tag | num
+// last seq:     tag | seq
+// add table:    tag | level | num
+// remove table: tag | level | num
+// add blob:     tag | num | size
+// blob garbage: tag | num | bytes
+// remove blob:  tag | num
+func (e versionEdit) Bytes() []byte {
+	buf := make([]byte, 0, 64)
+	if e.walDir != "" {
+		buf = append(buf, byte(tagWalDir))
+		buf = binary.AppendUvarint(buf, uint64(len(e.walDir)))
+		buf = append(buf, e.walDir...)
+	}
+
+	if e.nextFile != 0 {
+		buf = append(buf, byte(tagNextFile))
+		buf = binary.AppendUvarint(buf, e.nextFile)
+	}
+
+	if e.lastSeq != 0 {
+		buf = append(buf, byte(tagLastSeq))
+		buf = binary.AppendUvarint(buf, e.lastSeq)
+	}
+
+	for _, ref := range e.removed {
+		buf = append(buf, byte(tagRemoveTable))
+		buf = binary.AppendUvarint(buf, uint64(ref.level))
+		buf = binary.AppendUvarint(buf, ref.num)
+	}
+
+	for _, ref := range e.added {
+		buf = append(buf, byte(tagAddTable))
+		buf = binary.AppendUvarint(buf, uint64(ref.level))
+		buf = binary.AppendUvarint(buf, ref.num)
+	}
+
+	for _, ref := range e.addedBlobs {
+		buf = append(buf, byte(tagAddBlob))
+		buf = binary.AppendUvarint(buf, ref.num)
+		buf = binary.AppendUvarint(buf, ref.bytes)
+	}
+
+	for _, ref := range e.blobGarbage {
+		buf = append(buf, byte(tagBlobGarbage))
+		buf = binary.AppendUvarint(buf, ref.num)
+		buf = binary.AppendUvarint(buf, ref.bytes)
+	}
+
+	for _, num := range e.removedBlobs {
+		buf = append(buf, byte(tagRemoveBlob))
+		buf = binary.AppendUvarint(buf, num)
+	}
+
+	return buf
+}
+
+func versionEditFromBytes(p []byte) (versionEdit, error) {
+	var e versionEdit
+	uvarint := func() uint64 {
+		n, read := binary.Uvarint(p)
+		if read <= 0 {
+			p = nil
+			return 0
+		}
+		p = p[read:]
+		return n
+	}
+
+	for len(p) > 0 {
+		tag := editTag(p[0])
+		p = p[1:]
+
+		switch tag {
+		case tagWalDir:
+			dir, rest, err := uvarintPrefixed(p)
+			if err != nil {
+				return versionEdit{}, errBadManifestEdit
+			}
+			e.walDir, p = string(dir), rest
+		case tagNextFile:
+			e.nextFile = uvarint()
+		case tagLastSeq:
+			e.lastSeq = uvarint()
+		case tagAddTable, tagRemoveTable:
+			ref := tableRef{level: int(uvarint())}
+			ref.num = uvarint()
+			if ref.num == 0 {
+				return versionEdit{}, errBadManifestEdit
+			}
+
+			if tag == tagAddTable {
+				e.added = append(e.added, ref)
+			} else {
+				e.removed = append(e.removed, ref)
+			}
+		case tagAddBlob, tagBlobGarbage:
+			ref := blobRef{num: uvarint()}
+			ref.bytes = uvarint()
+			if ref.num == 0 {
+				return versionEdit{}, errBadManifestEdit
+			}
+
+			if tag == tagAddBlob {
+				e.addedBlobs = append(e.addedBlobs, ref)
+			} else {
+				e.blobGarbage = append(e.blobGarbage, ref)
+			}
+		case tagRemoveBlob:
+			num := uvarint()
+			if num == 0 {
+				return versionEdit{}, errBadManifestEdit
+			}
+			e.removedBlobs = append(e.removedBlobs, num)
+		default:
+			return versionEdit{}, fmt.Errorf("%w: unknown tag %d",
+				errBadManifestEdit, tag)
+		}
+	}
+
+	return e, nil
+}
+
+// manifest is an open MANIFEST file edits are appended to.
+type manifest struct {
+	dir     string
+	f       *os.File
+	current version
+	// set once an append failed, the file may end with the edit or a part
+	// of it and nothing may follow it, see rollover
+	err error
+}
+
+// loadVersion replays the manifest named by CURRENT in dir, or reads the
+// legacy manifest when there's no CURRENT. The error is os.ErrNotExist when
+// dir has neither.
+func loadVersion(dir string) (version, error) {
+	name, err := os.ReadFile(path.Join(dir, currentFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return loadLegacyManifest(dir)
+	}
+	if err != nil {
+		return version{}, err
+	}
+
+	p := path.Join(dir, strings.TrimSpace(string(name)))
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return version{}, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	var v version
+	for off := 0; off < len(buf); {
+		payload, read, ok := walRecordFromBytes(buf[off:])
+		if !ok {
+			slog.Warn("torn manifest record, skipping the rest",
+				"manifest", p, "offset", off)
+			break
+		}
+
+		e, err := versionEditFromBytes(payload)
+		if err != nil {
+			return version{}, fmt.Errorf("manifest %s at %d: %w", p, off, err)
+		}
+
+		v.apply(e)
+		off += read
+	}
+
+	return v, nil
+}
+
+// loadLegacyManifest reads the plain text MANIFEST of dir. Its first line is
+// the wal path, every next line is a comma separated list of sstable paths of
+// one level, starting from L0, an empty line is an empty level. Tables are
+// looked up in dir by their numbers, so a moved dir is fine. The wal path was
+// always WAL in dir, it goes to the version relative like the wal dir does.
+func loadLegacyManifest(dir string) (version, error) {
+	p := path.Join(dir, legacyManifestName)
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return version{}, err
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+	if lines[0] == "" {
+		return version{}, fmt.Errorf("legacy manifest %s: no wal dir", p)
+	}
+
+	v := version{walDir: "WAL", nextFile: 1}
+	for _, line := range lines[1:] {
+		nums := make([]uint64, 0)
+		if line != "" {
+			for _, table := range strings.Split(line, ",") {
+				num := sstFileNum(table)
+				if num == 0 {
+					return version{}, fmt.Errorf("legacy manifest %s: bad table %q", p, table)
+				}
+				nums = append(nums, num)
+				v.nextFile = max(v.nextFile, num+1)
+			}
+		}
+		v.levels = append(v.levels, nums)
+	}
+
+	slog.Info("converting legacy manifest", "manifest", p)
+	return v, nil
+}
+
+// moveLegacyWal renames the WAL file of trees written with the legacy
+// manifest to WAL.legacy, so the wal dir can take its place. Nothing was ever
+// written to that file, it's only kept aside in case it matters to someone.
+func moveLegacyWal(p string) error {
+	info, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) || err == nil && info.IsDir() {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("moving legacy wal file aside", "wal", p)
+	if err := os.Rename(p, p+".legacy"); err != nil {
+		return fmt.Errorf("moving legacy wal aside: %w", err)
+	}
+
+	return syncDir(filepath.Dir(p))
+}
+
+// createManifest writes v into a new manifest numbered num and makes it
+// current, older manifests are removed.
+func createManifest(dir string, num uint64, v version) (*manifest, error) {
+	name := fmt.Sprintf("%s%06d", manifestPrefix, num)
+	f, err := os.OpenFile(path.Join(dir, name),
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("creating manifest: %w", err)
+	}
+
+	m := &manifest{dir: dir, f: f}
+	if err := m.logAndApply(v.snapshot()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := setCurrent(dir, name); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// older manifests are not needed once CURRENT points to the new one
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return m, nil
+	}
+
+	for _, e := range entries {
+		old := strings.HasPrefix(e.Name(), manifestPrefix) || e.Name() == legacyManifestName
+		if old && e.Name() != name {
+			os.Remove(path.Join(dir, e.Name()))
+		}
+	}
+
+	return m, nil
+}
+
+// logAndApply persists e and applies it to the current version. Once it
+// fails the manifest takes no more edits until rollover.
+func (m *manifest) logAndApply(e versionEdit) error {
+	if m.err != nil {
+		return m.err
+	}
+
+	if _, err := m.f.Write(frameRecord(e.Bytes())); err != nil {
+		m.err = fmt.Errorf("writing manifest: %w", err)
+		return m.err
+	}
+
+	if err := m.f.Sync(); err != nil {
+		m.err = fmt.Errorf("syncing manifest: %w", err)
+		return m.err
+	}
+
+	m.current.apply(e)
+	return nil
+}
+
+// rollover replaces a manifest which failed an append with a new one numbered
+// num, holding the current version. The failed edit goes away with the old
+// file, whatever of it made it to disk.
+func (m *manifest) rollover(num, nextFile uint64) error {
+	v := m.current
+	v.nextFile = max(v.nextFile, nextFile)
+	fresh, err := createManifest(m.dir, num, v)
+	if err != nil {
+		return fmt.Errorf("rolling manifest over: %w", err)
+	}
+
+	m.f.Close()
+	*m = *fresh
+	return nil
+}
+
+func (m *manifest) Close() error {
+	return m.f.Close()
+}
+
+func setCurrent(dir, name string) error {
+	tmp := path.Join(dir, currentFileName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("creating CURRENT: %w", err)
+	}
+
+	if _, err := fmt.Fprintln(f, name); err != nil {
+		f.Close()
+		return fmt.Errorf("writing CURRENT: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing CURRENT: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path.Join(dir, currentFileName)); err != nil {
+		return fmt.Errorf("switching CURRENT: %w", err)
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
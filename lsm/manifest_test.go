@@ -0,0 +1,228 @@
+package lsm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionEditRoundTrip(t *testing.T) {
+	// arrange
+	edit := versionEdit{
+		walDir:   "WAL",
+		nextFile: 42,
+		added:    []tableRef{{0, 7}, {2, 9}},
+		removed:  []tableRef{{1, 3}},
+
+		addedBlobs:   []blobRef{{11, 4096}},
+		blobGarbage:  []blobRef{{5, 100}},
+		removedBlobs: []uint64{4},
+	}
+
+	// act
+	got, err := versionEditFromBytes(edit.Bytes())
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, edit, got)
+}
+
+func TestLoadVersionSkipsTornEdit(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	m, err := createManifest(dir, 1, version{walDir: "WAL", nextFile: 2})
+	assert.NoError(t, err)
+	assert.NoError(t, m.logAndApply(versionEdit{
+		nextFile: 4,
+		added:    []tableRef{{0, 2}, {0, 3}},
+	}))
+	assert.NoError(t, m.logAndApply(versionEdit{
+		nextFile: 5,
+		removed:  []tableRef{{0, 2}},
+		added:    []tableRef{{1, 4}},
+	}))
+
+	// cut the last edit in half as if the process died while writing it
+	full := versionEdit{nextFile: 6, removed: []tableRef{{1, 4}}}.Bytes()
+	_, err = m.f.Write(frameRecord(full)[:5])
+	assert.NoError(t, err)
+	assert.NoError(t, m.Close())
+
+	// act
+	v, err := loadVersion(dir)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, m.current, v)
+	assert.Equal(t, [][]uint64{{3}, {4}}, v.levels)
+	assert.Equal(t, uint64(5), v.nextFile)
+}
+
+func TestLogEditFailureRollsManifestOver(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	old := tree.manifest.f.Name()
+	// appends to the manifest fail from now on
+	tree.manifest.f.Close()
+
+	// act
+	tree.rodataGuard.Lock()
+	errFailed := tree.logEdit(versionEdit{added: []tableRef{{0, 100}}})
+	errNext := tree.logEdit(versionEdit{lastSeq: 7})
+	tree.rodataGuard.Unlock()
+
+	// assert
+	assert.Error(t, errFailed)
+	assert.NoError(t, errNext)
+	assert.NoFileExists(t, old)
+
+	v, err := loadVersion(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), v.lastSeq)
+	assert.Empty(t, v.levels)
+}
+
+func TestLSMTreeRecoverLayout(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tree, err := Recover(ctx, dir, &opts)
+	assert.NoError(t, err)
+
+	setLevels(t, tree,
+		[]*SSTable{
+			treeSSTable(t, tree, put("b", "0")),
+			treeSSTable(t, tree, put("a", "0")),
+		},
+		[]*SSTable{
+			treeSSTable(t, tree, put("x", "1")),
+			treeSSTable(t, tree, put("c", "1")),
+		},
+		nil,
+		[]*SSTable{treeSSTable(t, tree, put("z", "3"))},
+	)
+	// a table which was written but didn't make it to the manifest
+	orphan := treeSSTable(t, tree, put("o", "1"))
+
+	// act
+	cancel()
+	recovered, err := Recover(context.Background(), dir, &opts)
+
+	// assert
+	assert.NoError(t, err)
+	paths := func(lvl []*SSTable) []string {
+		ps := make([]string, 0, len(lvl))
+		for _, sst := range lvl {
+			ps = append(ps, path.Base(sst.Path()))
+		}
+		return ps
+	}
+
+	assert.Equal(t, paths(tree.lvl0), paths(recovered.lvl0))
+	assert.Len(t, recovered.lvln, 3)
+	assert.Equal(t,
+		[]string{path.Base(tree.lvln[0][1].Path()), path.Base(tree.lvln[0][0].Path())},
+		paths(recovered.lvln[0]))
+	assert.Empty(t, recovered.lvln[1])
+	assert.Equal(t, paths(tree.lvln[2]), paths(recovered.lvln[2]))
+
+	_, err = os.Stat(orphan.Path())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLSMTreeRecoverLegacyManifest(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	writeTable := func(num int, e Entry) string {
+		p := path.Join(dir, fmt.Sprintf("%06d%s", num, sstFileExt))
+		w, err := NewSSTableWriter(p, 0, *DefaultOptions)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Add(e))
+		sst, err := w.Finish()
+		assert.NoError(t, err)
+		assert.NoError(t, sst.Unref())
+		return p
+	}
+
+	l0 := []string{writeTable(1, put("a", "0")), writeTable(2, put("b", "0"))}
+	l2 := writeTable(5, put("c", "2"))
+	legacy := strings.Join([]string{path.Join(dir, "WAL"), strings.Join(l0, ","), "", l2}, "\n")
+	assert.NoError(t, os.WriteFile(path.Join(dir, legacyManifestName), []byte(legacy+"\n"), 0666))
+	// the legacy tree created its wal as an empty file
+	assert.NoError(t, os.WriteFile(path.Join(dir, "WAL"), nil, 0666))
+
+	// act
+	tree, err := Recover(context.Background(), dir, DefaultOptions)
+
+	// assert
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	for k, want := range map[string]string{"a": "0", "b": "0", "c": "2"} {
+		v, err := tree.Get([]byte(k))
+		assert.NoError(t, err, k)
+		assert.Equal(t, []byte(want), v, k)
+	}
+	for _, p := range append(l0, l2) {
+		assert.FileExists(t, p)
+	}
+	assert.FileExists(t, path.Join(dir, currentFileName))
+	assert.NoFileExists(t, path.Join(dir, legacyManifestName))
+	assert.Greater(t, tree.nextFile.Load(), uint64(5))
+	assert.DirExists(t, path.Join(dir, "WAL"))
+	assert.FileExists(t, path.Join(dir, "WAL.legacy"))
+
+	// writes go to the new wal
+	assert.NoError(t, tree.Put([]byte("d"), []byte("1")))
+	assert.NoError(t, tree.Close())
+	recovered, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+	defer recovered.Close()
+	v, err := recovered.Get([]byte("d"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestLSMTreeRecoverKeepsLegacyManifestOnWalError(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	legacy := path.Join(dir, "WAL") + "\n\n"
+	assert.NoError(t, os.WriteFile(path.Join(dir, legacyManifestName), []byte(legacy), 0666))
+	// the legacy wal file can't be moved aside, a dir is in the way
+	assert.NoError(t, os.WriteFile(path.Join(dir, "WAL"), nil, 0666))
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "WAL.legacy", "x"), 0777))
+
+	// act
+	_, err := Recover(context.Background(), dir, DefaultOptions)
+
+	// assert
+	assert.Error(t, err)
+	assert.FileExists(t, path.Join(dir, legacyManifestName))
+	assert.NoFileExists(t, path.Join(dir, currentFileName))
+}
+
+func TestLSMTreeRecoverFreshKeepsTables(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	stray := path.Join(dir, "000001"+sstFileExt)
+	assert.NoError(t, os.WriteFile(stray, []byte("not ours"), 0666))
+
+	// act
+	tree, err := Recover(context.Background(), dir, DefaultOptions)
+
+	// assert
+	assert.NoError(t, err)
+	defer tree.Close()
+	assert.FileExists(t, stray)
+}
@@ -1,73 +1,170 @@
 package lsm
 
 import (
-	"github.com/zhangyunhao116/skipmap"
+	"sync/atomic"
 )
 
 func NewMemtable() *Memtable {
-	return &Memtable{skipmap.NewString[[]byte](), 0}
+	return &Memtable{
+		skiplist:   newSkiplist(),
+		rangeDels:  new(atomic.Pointer[rangeTombstones]),
+		approxSize: new(atomic.Int64),
+		lastSeq:    new(atomic.Uint64),
+	}
 }
 
+// Memtable keeps every version of a key written to it, so that snapshots
+// can read older ones. Writes are serialized by the tree, reads may run
+// concurrently with them.
 type Memtable struct {
-	skiplist   *skipmap.StringMap[[]byte]
-	approxSize int
+	skiplist *skiplist
+	// range tombstones are kept apart from keys, the slice is replaced on
+	// every write like versions of a key are
+	rangeDels *atomic.Pointer[rangeTombstones]
+	// both are written under the tree's write lock, but read without it,
+	// e.g. to tell whether the memtable is full
+	approxSize *atomic.Int64
+	lastSeq    *atomic.Uint64 // the largest seq applied
 }
 
-func (m *Memtable) Get(k []byte) ([]byte, error) {
-	v, ok := m.skiplist.Load(string(k))
-	if !ok {
+// memVersions are versions of a key, the newest first. Writers replace the
+// slice instead of modifying it, so readers don't need to lock anything.
+type memVersions struct {
+	versions atomic.Pointer[[]memValue]
+}
+
+// memValue is what memtable stores per version of a key, deletion of a key is
+// stored as a tombstone so it shadows the key in older tables.
+type memValue struct {
+	seq   uint64
+	kind  EntryKind
+	value []byte
+}
+
+// Get returns the newest version of k not newer than seq. Merge operands are
+// returned as they are, LSMTree.Get combines them.
+func (m *Memtable) Get(k []byte, seq uint64) ([]byte, error) {
+	var newest Entry
+	if !m.versions(k, seq, func(e Entry) bool { newest = e; return true }) {
 		return nil, ErrKeyNotFound
 	}
 
-	return v, nil
+	if newest.Kind == KindTombstone {
+		return nil, ErrKeyDeleted
+	}
+
+	return newest.Value, nil
 }
 
-func (m *Memtable) Put(k, v []byte) error {
-	m.skiplist.Store(string(k), v)
-	m.approxSize += len(v)
+// versions calls f with versions of k not newer than seq, the newest first,
+// until f returns true. It tells whether f did.
+func (m *Memtable) versions(k []byte, seq uint64, f func(e Entry) bool) bool {
+	vs, ok := m.skiplist.load(string(k))
+	if !ok {
+		return false
+	}
+
+	for _, v := range *vs.versions.Load() {
+		if v.seq > seq {
+			continue
+		}
+
+		if f(Entry{Key: k, Value: v.value, Kind: v.kind, Seq: v.seq}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply stores an entry of any kind as a new version of its key, e.Seq must be
+// larger than seqs applied before.
+func (m *Memtable) Apply(e Entry) error {
+	m.approxSize.Add(int64(len(e.Key) + len(e.Value)))
+	m.lastSeq.Store(max(m.lastSeq.Load(), e.Seq))
+
+	if e.Kind == KindRangeDelete {
+		rangeDels := m.rangeTombstones().insert(rangeTombstoneFromEntry(e))
+		m.rangeDels.Store(&rangeDels)
+		return nil
+	}
+
+	vs := m.skiplist.loadOrStore(string(e.Key))
+	old := *vs.versions.Load()
+	versions := make([]memValue, 0, len(old)+1)
+	versions = append(versions, memValue{e.Seq, e.Kind, e.Value})
+	versions = append(versions, old...)
+	vs.versions.Store(&versions)
+
+	return nil
+}
+
+// rangeTombstones returns range tombstones applied so far.
+func (m *Memtable) rangeTombstones() rangeTombstones {
+	if ts := m.rangeDels.Load(); ts != nil {
+		return *ts
+	}
+
 	return nil
 }
 
 func (m *Memtable) Size() int {
-	return m.approxSize
+	return int(m.approxSize.Load())
+}
+
+// Len is the number of distinct keys and range tombstones.
+func (m *Memtable) Len() int {
+	return m.skiplist.len() + len(m.rangeTombstones())
 }
 
 func (m *Memtable) Clone() *Memtable {
-	clone := skipmap.NewString[[]byte]()
-	m.skiplist.Range(func(k string, v []byte) bool {
-		clone.Store(k, v)
-		return true
-	})
-	size := m.approxSize
+	clone := newSkiplist()
+	for n := m.skiplist.first(); n != nil; n = n.next[0].Load() {
+		clone.loadOrStore(n.key).versions.Store(n.vs.versions.Load())
+	}
 
-	return &Memtable{clone, size}
+	rangeDels := new(atomic.Pointer[rangeTombstones])
+	rangeDels.Store(m.rangeDels.Load())
+
+	approxSize := new(atomic.Int64)
+	approxSize.Store(m.approxSize.Load())
+	lastSeq := new(atomic.Uint64)
+	lastSeq.Store(m.lastSeq.Load())
+
+	return &Memtable{clone, rangeDels, approxSize, lastSeq}
 }
 
-func (m *Memtable) Range(f func(key string, value []byte) bool) {
-	m.skiplist.Range(f)
+// Range calls f for each version of each key in key order, newer versions of
+// a key first. Tombstones are included, range tombstones are not.
+func (m *Memtable) Range(f func(e Entry) bool) {
+	for n := m.skiplist.first(); n != nil; n = n.next[0].Load() {
+		for _, v := range *n.vs.versions.Load() {
+			if !f(Entry{Key: []byte(n.key), Value: v.value, Kind: v.kind, Seq: v.seq}) {
+				return
+			}
+		}
+	}
 }
 
 func (m *Memtable) AsReadonly() ReadonlyMemtable {
-	return ReadonlyMemtable{*m}
+	return ReadonlyMemtable{table: *m}
 }
 
 type ReadonlyMemtable struct {
 	table Memtable
+	// last wal segment holding writes of this table, all segments up to this
+	// one can be released once the table is flushed
+	walSegment uint64
 }
 
-func (m *ReadonlyMemtable) Get(k []byte) ([]byte, error) {
-	v, ok := m.table.skiplist.Load(string(k))
-	if !ok {
-		return nil, ErrKeyNotFound
-	}
-
-	return v, nil
+func (m *ReadonlyMemtable) Get(k []byte, seq uint64) ([]byte, error) {
+	return m.table.Get(k, seq)
 }
 
-func (m ReadonlyMemtable) Range(f func(key string, value []byte) bool) {
-	m.table.Range(f)
+func (m *ReadonlyMemtable) Len() int {
+	return m.table.Len()
 }
 
-func MemtableFromSSTable(sst *SSTable) *Memtable {
-	panic("")
+func (m ReadonlyMemtable) Range(f func(e Entry) bool) {
+	m.table.Range(f)
 }
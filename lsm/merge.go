@@ -0,0 +1,159 @@
+package lsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ErrNoMergeOperator is returned by merges into a tree without
+// Options.MergeOperator.
+var ErrNoMergeOperator = errors.New("no merge operator configured")
+
+// MergeOperator combines merge operands of a key (see LSMTree.Merge) with the
+// value they apply to, e.g. to update counters or append to lists without
+// reading the old value first. Operands are stored as they are and only
+// combined once read, or once compaction meets them.
+//
+// It must be deterministic and is called concurrently by readers and
+// compactions.
+type MergeOperator interface {
+	// Merge applies operands, from the oldest to the newest, to existing,
+	// which is nil when the key has no value or was deleted. An error fails
+	// the read or the compaction which ran into it
+	Merge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// PartialMerger is a MergeOperator which can also combine operands without
+// knowing the value they apply to. Compaction uses it to fold operands into
+// one when the value is in an older level.
+type PartialMerger interface {
+	MergeOperator
+	// PartialMerge combines operands, from the oldest to the newest, into a
+	// single operand, ok is false when they can't be combined
+	PartialMerge(key []byte, operands [][]byte) (operand []byte, ok bool)
+}
+
+// Merge stores operand as a new version of k, to be combined with the older
+// versions by Options.MergeOperator.
+func (tree *LSMTree) Merge(k, operand []byte) error {
+	return tree.MergeContext(context.Background(), k, operand)
+}
+
+// MergeContext is Merge which gives up like PutContext does.
+func (tree *LSMTree) MergeContext(ctx context.Context, k, operand []byte) error {
+	if tree.opt.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+
+	return tree.write(ctx, []Entry{{Key: k, Value: operand, Kind: KindMerge}})
+}
+
+// fullMerge applies operands (the newest first) to base.
+func fullMerge(op MergeOperator, key, base []byte, operands [][]byte) ([]byte, error) {
+	if op == nil {
+		return nil, ErrNoMergeOperator
+	}
+
+	ops := slices.Clone(operands)
+	slices.Reverse(ops)
+
+	v, err := op.Merge(key, base, ops)
+	if err != nil {
+		return nil, fmt.Errorf("merge %q: %w", key, err)
+	}
+
+	return v, nil
+}
+
+// mergeResolver works out the value readers see from versions of a key fed
+// from the newest to the oldest: merge operands pile up until a value or a
+// tombstone they apply to. Values kept in blob files are read with blob.
+type mergeResolver struct {
+	op       MergeOperator
+	blob     func(ptr []byte) ([]byte, error)
+	operands [][]byte // the newest first
+	done     bool
+	found    bool
+	value    []byte
+	err      error
+}
+
+// add feeds the next older version, it returns true once the value is known.
+func (r *mergeResolver) add(key []byte, e Entry) bool {
+	switch e.Kind {
+	case KindMerge:
+		r.operands = append(r.operands, e.Value)
+		return false
+	case KindTombstone:
+		r.finish(key, nil, false)
+	case KindBlobIndex:
+		v, err := r.blob(e.Value)
+		if err != nil {
+			r.done, r.err = true, err
+			return true
+		}
+		r.finish(key, v, true)
+	default:
+		r.finish(key, e.Value, true)
+	}
+
+	return true
+}
+
+// finish applies operands fed so far to base, exists tells whether base is a
+// value. It's called by the caller when versions run out.
+func (r *mergeResolver) finish(key, base []byte, exists bool) {
+	r.done = true
+	if len(r.operands) == 0 {
+		r.value, r.found = base, exists
+		return
+	}
+
+	r.value, r.err = fullMerge(r.op, key, base, r.operands)
+	r.found = r.err == nil
+}
+
+// mergeOperands folds operands of a key (the newest first) with no base
+// value in sight for compaction. When nothing older is left (the bottom
+// level) they are merged into a value, otherwise into a single operand if the
+// operator can do partial merges. Without an operator they stay as they are.
+func mergeOperands(op MergeOperator, operands []Entry, bottom bool) ([]Entry, error) {
+	if op == nil || len(operands) == 0 {
+		return operands, nil
+	}
+
+	key, values := operands[0].Key, operandValues(operands)
+
+	if bottom {
+		v, err := fullMerge(op, key, nil, values)
+		if err != nil {
+			return nil, err
+		}
+
+		return []Entry{{Key: key, Value: v, Kind: KindValue, Seq: operands[0].Seq}}, nil
+	}
+
+	pm, ok := op.(PartialMerger)
+	if !ok || len(operands) < 2 {
+		return operands, nil
+	}
+
+	slices.Reverse(values)
+	v, ok := pm.PartialMerge(key, values)
+	if !ok {
+		return operands, nil
+	}
+
+	return []Entry{{Key: key, Value: v, Kind: KindMerge, Seq: operands[0].Seq}}, nil
+}
+
+func operandValues(operands []Entry) [][]byte {
+	values := make([][]byte, 0, len(operands))
+	for _, e := range operands {
+		values = append(values, e.Value)
+	}
+
+	return values
+}
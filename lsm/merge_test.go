@@ -0,0 +1,274 @@
+package lsm
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// counter adds operands up, values are decimal numbers.
+type counter struct {
+	partial bool // whether PartialMerge works
+}
+
+func (counter) Merge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	sum := 0
+	if existing != nil {
+		n, err := strconv.Atoi(string(existing))
+		if err != nil {
+			return nil, err
+		}
+		sum = n
+	}
+
+	for _, op := range operands {
+		n, err := strconv.Atoi(string(op))
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+
+	return []byte(strconv.Itoa(sum)), nil
+}
+
+func (c counter) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	if !c.partial {
+		return nil, false
+	}
+
+	v, err := c.Merge(key, nil, operands)
+	return v, err == nil
+}
+
+func counterTree(t *testing.T, dir string) *LSMTree {
+	opts := *DefaultOptions
+	opts.MergeOperator = counter{}
+	tree, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	return tree
+}
+
+func TestMergeGet(t *testing.T) {
+	// arrange
+	tree := counterTree(t, t.TempDir())
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, tree.Put([]byte("c"), []byte("7")))
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("2")))
+	assert.NoError(t, tree.Del([]byte("c")))
+	assert.NoError(t, tree.flushMemtable(context.Background()))
+
+	// act
+	// operands are spread over the memtable, L0 and L1
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("3")))
+	assert.NoError(t, tree.Merge([]byte("b"), []byte("5")))
+	assert.NoError(t, tree.Merge([]byte("c"), []byte("1")))
+
+	// assert
+	for k, want := range map[string]string{"a": "6", "b": "5", "c": "1"} {
+		v, err := tree.Get([]byte(k))
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(v), k)
+	}
+}
+
+func TestMergeIterator(t *testing.T) {
+	// arrange
+	tree := counterTree(t, t.TempDir())
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, tree.Put([]byte("b"), []byte("1")))
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("2")))
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("3")))
+	assert.NoError(t, tree.Merge([]byte("c"), []byte("4")))
+
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+
+	// act
+	values := make(map[string]string)
+	for ok := it.First(); ok; ok = it.Next() {
+		values[string(it.Key())] = string(it.Value())
+	}
+	it.Last()
+	backward := collectKeys(it, false)
+	it.Seek([]byte("a"))
+	it.Next()
+	it.Prev()
+	afterTurn := string(it.Key())
+
+	// assert
+	assert.NoError(t, it.Err())
+	assert.Equal(t, map[string]string{"a": "6", "b": "1", "c": "4"}, values)
+	assert.Equal(t, []string{"c", "b", "a"}, backward)
+	assert.Equal(t, "a", afterTurn)
+}
+
+func TestMergeCompaction(t *testing.T) {
+	// arrange
+	tree := counterTree(t, t.TempDir())
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("2")))
+	snap := tree.Snapshot()
+	defer snap.Release()
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("3")))
+	assert.NoError(t, tree.Merge([]byte("b"), []byte("4")))
+	assert.NoError(t, tree.Merge([]byte("b"), []byte("5")))
+
+	// act
+	flushAndCompact(t, tree)
+
+	// assert
+	// operands under the snapshot are merged with the value, the newer one
+	// stays an operand on top. b has nothing older at the bottom, so it
+	// becomes a value
+	entries := levelEntries(t, tree, 1)
+	assert.Equal(t, []Entry{
+		{Key: []byte("a"), Value: []byte("3"), Kind: KindMerge, Seq: 3},
+		{Key: []byte("a"), Value: []byte("3"), Kind: KindValue, Seq: 2},
+		{Key: []byte("b"), Value: []byte("9"), Kind: KindValue, Seq: 5},
+	}, entries)
+
+	v, err := snap.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), v)
+	v, err = tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("6"), v)
+}
+
+func TestMergeCompactionPartial(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       counter
+		operands int // operands left in L1
+	}{
+		{"full merge only", counter{}, 2},
+		{"partial merge", counter{partial: true}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			tree := counterTree(t, t.TempDir())
+			defer tree.Close()
+
+			setLevels(t, tree, nil, nil,
+				[]*SSTable{treeSSTable(t, tree, put("a", "1"))})
+			assert.NoError(t, tree.Merge([]byte("a"), []byte("2")))
+			assert.NoError(t, tree.Merge([]byte("a"), []byte("3")))
+			assert.NoError(t, tree.flushMemtable(context.Background()))
+
+			c := newCompactor(tree, tree.opt)
+			c.opt.MergeOperator = tt.op
+
+			// act
+			// the value is in L2, so operands can't become a value in L1
+			err := c.run(context.Background(), Compaction{
+				Inputs: []LevelTables{{0, tree.lvl0}},
+				Output: 1,
+			})
+
+			// assert
+			assert.NoError(t, err)
+			entries := levelEntries(t, tree, 1)
+			assert.Len(t, entries, tt.operands)
+			for _, e := range entries {
+				assert.Equal(t, KindMerge, e.Kind)
+			}
+
+			v, err := tree.Get([]byte("a"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("6"), v)
+		})
+	}
+}
+
+func TestMergeRecover(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := counterTree(t, dir)
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+
+	var b WriteBatch
+	b.Merge([]byte("a"), []byte("2"))
+	b.Merge([]byte("a"), []byte("3"))
+	assert.NoError(t, tree.Write(&b))
+
+	// act
+	assert.NoError(t, tree.Close())
+	recovered := counterTree(t, dir)
+	defer recovered.Close()
+
+	// assert
+	v, err := recovered.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("6"), v)
+}
+
+func TestMergeRecoverUnreleasedWal(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := counterTree(t, dir)
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("1")))
+	assert.NoError(t, tree.Merge([]byte("a"), []byte("2")))
+
+	segs, err := filepath.Glob(path.Join(dir, "WAL", "*"))
+	assert.NoError(t, err)
+	logged := make(map[string][]byte, len(segs))
+	for _, p := range segs {
+		logged[p], err = os.ReadFile(p)
+		assert.NoError(t, err)
+	}
+
+	// the flush made it to the manifest, but the wal wasn't released before
+	// a crash
+	assert.NoError(t, tree.flushMemtable(context.Background()))
+	assert.NoError(t, tree.Close())
+	for p, buf := range logged {
+		assert.NoError(t, os.WriteFile(p, buf, 0666))
+	}
+
+	// act
+	recovered := counterTree(t, dir)
+	defer recovered.Close()
+
+	// assert
+	v, err := recovered.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), v)
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	var b WriteBatch
+	b.Put([]byte("a"), []byte("1"))
+	b.Merge([]byte("a"), []byte("2"))
+
+	// act
+	errMerge := tree.Merge([]byte("a"), []byte("1"))
+	errBatch := tree.Write(&b)
+
+	// assert
+	assert.ErrorIs(t, errMerge, ErrNoMergeOperator)
+	assert.ErrorIs(t, errBatch, ErrNoMergeOperator)
+	_, err = tree.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
@@ -0,0 +1,250 @@
+package lsm
+
+import (
+	"bytes"
+	"math"
+	"slices"
+)
+
+// CompactionPolicy decides which tables get compacted and where the output
+// goes. The compactor asks it for the next compaction after every flush and
+// after every compaction it runs, until the policy has nothing to offer.
+// Pick is called by one goroutine at a time.
+type CompactionPolicy interface {
+	// Pick returns the next compaction for the layout, ok is false when the
+	// tree is in shape
+	Pick(l Layout) (c Compaction, ok bool)
+}
+
+// Layout is the tree as a policy sees it. Tables must not be modified nor
+// kept around after Pick returns.
+type Layout struct {
+	// L0 tables from the oldest to the newest, their key ranges may overlap
+	L0 []*SSTable
+	// Levels are L1 and deeper, tables of a level are sorted by keys and
+	// don't overlap
+	Levels [][]*SSTable
+	Opts   Options
+}
+
+// Compaction merges its input tables into new tables of the Output level.
+// Tables of the output level overlapping the inputs are merged in as well,
+// so the level stays sorted. A single table of L1 or deeper with nothing to
+// merge with is moved to the output level as it is.
+//
+// Newer data must stay above older data: L0 inputs are the oldest tables of
+// L0 when the output goes deeper, and the newest ones when the output is L0,
+// in which case the output is a single table (a sorted run) taking their
+// place. Levels between an input and the output must be empty.
+type Compaction struct {
+	Inputs []LevelTables
+	Output int
+	// Drop deletes the input tables instead of merging them, Output is
+	// ignored
+	Drop bool
+}
+
+// LevelTables are tables of level Level (L0 is 0).
+type LevelTables struct {
+	Level  int
+	Tables []*SSTable
+}
+
+// involvesL0 tells if the compaction reads or writes L0.
+func (c Compaction) involvesL0() bool {
+	if !c.Drop && c.Output == 0 {
+		return true
+	}
+
+	for _, in := range c.Inputs {
+		if in.Level == 0 && len(in.Tables) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// levels is the range of levels the compaction reads or writes, including
+// the ones in between which must stay empty.
+func (c Compaction) levels() (from, to int) {
+	from, to = math.MaxInt, 0
+	if !c.Drop {
+		from, to = c.Output, c.Output
+	}
+
+	for _, in := range c.Inputs {
+		if len(in.Tables) > 0 {
+			from, to = min(from, in.Level), max(to, in.Level)
+		}
+	}
+
+	return from, to
+}
+
+func layoutSize(l Layout) uint {
+	size := levelSize(l.L0)
+	for _, lvl := range l.Levels {
+		size += levelSize(lvl)
+	}
+
+	return size
+}
+
+// NewLeveledPolicy returns the rocksdb style leveled compaction: once L0 has
+// more than Options.MaxL0Tables tables, all of it is merged into L1. Then one
+// table of the level exceeding its threshold (see Options.L1Threshold) the
+// most is merged into the next level at a time, tables of a level are picked
+// round-robin. This is the default policy.
+func NewLeveledPolicy() CompactionPolicy {
+	return &leveledPolicy{cursors: make(map[int][]byte)}
+}
+
+type leveledPolicy struct {
+	// per level, the last key of the table compacted the last time
+	cursors map[int][]byte
+}
+
+func (p *leveledPolicy) Pick(l Layout) (Compaction, bool) {
+	// Since L0 isn't fully sorted (data is sorted only in individual
+	// tables, key range of one L0 table may overlap with key range of other
+	// L0 table), we can't merge a L0 table into some exact 1-2 L1 tables
+	// (like we do when merging LN tables), one L0 table may eventually be
+	// distributed across multiple L1 tables or even whole L1 level. So the
+	// whole L0 is merged at once
+	if len(l.L0) > 0 && len(l.L0) > l.Opts.MaxL0Tables {
+		return Compaction{Inputs: []LevelTables{{0, l.L0}}, Output: 1}, true
+	}
+
+	// find a level which exceeds its threshold the most
+	n, bestScore := 0, 1.0
+	for i, lvl := range l.Levels {
+		score := float64(levelSize(lvl)) / float64(l.Opts.levelThreshold(i+1))
+		if score > bestScore {
+			n, bestScore = i+1, score
+		}
+	}
+	if n == 0 {
+		return Compaction{}, false
+	}
+
+	picked := p.pickTable(n, l.Levels[n-1])
+	p.cursors[n] = slices.Clone(picked.LastKey())
+
+	return Compaction{
+		Inputs: []LevelTables{{n, []*SSTable{picked}}},
+		Output: n + 1,
+	}, true
+}
+
+// pickTable picks the table of level n following the one compacted last time.
+func (p *leveledPolicy) pickTable(n int, lvl []*SSTable) *SSTable {
+	cursor, ok := p.cursors[n]
+	if !ok {
+		return lvl[0]
+	}
+
+	for _, sst := range lvl {
+		if bytes.Compare(sst.FirstKey(), cursor) > 0 {
+			return sst
+		}
+	}
+
+	return lvl[0]
+}
+
+// TieredPolicy is size-tiered (universal) compaction for write heavy loads.
+// Every L0 table is a sorted run and nothing goes deeper than L0: once there
+// are MaxRuns runs, the newest runs of similar size are merged into one. Data
+// is rewritten fewer times than with leveled compaction, at the cost of more
+// tables to look at on reads and more space taken by old versions. Since all
+// data stays in L0, Options.Compression[0] applies to it.
+//
+// Zero fields get defaults.
+type TieredPolicy struct {
+	// compaction starts once L0 has this many runs, 4 by default
+	MaxRuns int
+	// a run joins the merge when it's at most SizeRatio percent bigger than
+	// all newer runs of the merge together, 1 by default
+	SizeRatio int
+	// the fewest runs merged at once, 2 by default
+	MinMergeWidth int
+	// all runs are merged when runs newer than the oldest one take more
+	// than this percent of its size, 200 by default
+	MaxSizeAmplification int
+}
+
+func (p TieredPolicy) Pick(l Layout) (Compaction, bool) {
+	maxRuns := cmpOr(p.MaxRuns, 4)
+	ratio := uint(cmpOr(p.SizeRatio, 1))
+	width := max(cmpOr(p.MinMergeWidth, 2), 2)
+	amp := uint(cmpOr(p.MaxSizeAmplification, 200))
+
+	runs := l.L0
+	if len(runs) < max(maxRuns, width) {
+		return Compaction{}, false
+	}
+	merge := func(runs []*SSTable) (Compaction, bool) {
+		return Compaction{Inputs: []LevelTables{{0, runs}}, Output: 0}, true
+	}
+
+	// too much space is taken by versions which may be shadowed by newer
+	// ones, merge everything
+	if newer := levelSize(runs[1:]); newer*100 > amp*runs[0].Size() {
+		return merge(runs)
+	}
+
+	// merge the newest runs as long as the next one is about as big as all
+	// of them together
+	i, acc := len(runs)-1, runs[len(runs)-1].Size()
+	for i > 0 && runs[i-1].Size()*100 <= acc*(100+ratio) {
+		i--
+		acc += runs[i].Size()
+	}
+	if len(runs)-i >= width {
+		return merge(runs[i:])
+	}
+
+	// sizes are too far apart, just bring the number of runs under MaxRuns
+	n := min(max(width, len(runs)-maxRuns+2), len(runs))
+	return merge(runs[len(runs)-n:])
+}
+
+// FIFOPolicy never merges anything, it deletes the oldest L0 tables once all
+// tables together take more than MaxSize bytes. It suits data which is only
+// appended and mostly read while fresh, like logs. Overwritten and deleted
+// keys take space until their tables go, and snapshots lose data which is
+// dropped under them. Zero MaxSize means no cap.
+//
+// L0 write limits (see Options.StopL0Tables) apply here too, they should be
+// above the number of tables the cap lets L0 have.
+type FIFOPolicy struct {
+	MaxSize uint
+}
+
+func (p FIFOPolicy) Pick(l Layout) (Compaction, bool) {
+	size := layoutSize(l)
+	if p.MaxSize == 0 || size <= p.MaxSize {
+		return Compaction{}, false
+	}
+
+	n := 0
+	for n < len(l.L0) && size > p.MaxSize {
+		size -= l.L0[n].Size()
+		n++
+	}
+	if n == 0 {
+		return Compaction{}, false
+	}
+
+	return Compaction{Inputs: []LevelTables{{0, l.L0[:n]}}, Drop: true}, true
+}
+
+// cmpOr returns v, or def when v is zero.
+func cmpOr(v, def int) int {
+	if v == 0 {
+		return def
+	}
+
+	return v
+}
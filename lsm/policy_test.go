@@ -0,0 +1,212 @@
+package lsm
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sizedTables makes a table per size, holding a single key with a value of
+// that size.
+func sizedTables(t *testing.T, tree *LSMTree, sizes ...int) []*SSTable {
+	tables := make([]*SSTable, 0, len(sizes))
+	for i, size := range sizes {
+		tables = append(tables, treeSSTable(t, tree,
+			put("key"+strconv.Itoa(i), strings.Repeat("x", size))))
+	}
+
+	return tables
+}
+
+func TestLeveledPolicyPick(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.L1Threshold = 1 << 6
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	lvl0 := sizedTables(t, tree, 1, 1, 1)
+	lvl1 := sizedTables(t, tree, 1<<6, 1<<6)
+	policy := NewLeveledPolicy()
+
+	// act
+	l0, l0ok := policy.Pick(Layout{L0: lvl0, Levels: [][]*SSTable{lvl1}, Opts: opts})
+	first, firstOk := policy.Pick(Layout{Levels: [][]*SSTable{lvl1}, Opts: opts})
+	second, secondOk := policy.Pick(Layout{Levels: [][]*SSTable{lvl1}, Opts: opts})
+	_, fitsOk := policy.Pick(Layout{L0: lvl0[:2], Opts: opts})
+
+	// assert
+	assert.True(t, l0ok)
+	assert.Equal(t, Compaction{Inputs: []LevelTables{{0, lvl0}}, Output: 1}, l0)
+
+	// tables of a level are picked round-robin
+	assert.True(t, firstOk)
+	assert.Equal(t, Compaction{Inputs: []LevelTables{{1, lvl1[:1]}}, Output: 2}, first)
+	assert.True(t, secondOk)
+	assert.Equal(t, Compaction{Inputs: []LevelTables{{1, lvl1[1:]}}, Output: 2}, second)
+
+	assert.False(t, fitsOk)
+}
+
+func TestTieredPolicyPick(t *testing.T) {
+	tests := []struct {
+		name   string
+		sizes  []int
+		merged int // the newest runs merged, 0 when nothing is
+	}{
+		{"too few runs", []int{1000, 100, 100}, 0},
+		{"similar newest runs", []int{5000, 1000, 100, 100}, 2},
+		{"size ratio adds up", []int{5000, 400, 200, 100, 100}, 4},
+		{"space amplification", []int{100, 300, 300, 300}, 4},
+		{"sizes far apart", []int{100000, 10000, 1000, 100, 10}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// arrange
+			tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+			assert.NoError(t, err)
+			defer tree.Close()
+
+			runs := sizedTables(t, tree, tt.sizes...)
+
+			// act
+			c, ok := TieredPolicy{}.Pick(Layout{L0: runs, Opts: tree.opt})
+
+			// assert
+			if tt.merged == 0 {
+				assert.False(t, ok)
+				return
+			}
+			assert.True(t, ok)
+			assert.Equal(t, Compaction{
+				Inputs: []LevelTables{{0, runs[len(runs)-tt.merged:]}},
+				Output: 0,
+			}, c)
+		})
+	}
+}
+
+func TestFIFOPolicyPick(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	lvl0 := sizedTables(t, tree, 1000, 1000, 1000)
+	capped := FIFOPolicy{MaxSize: levelSize(lvl0[1:])}
+
+	// act
+	c, ok := capped.Pick(Layout{L0: lvl0})
+	_, fitsOk := FIFOPolicy{MaxSize: levelSize(lvl0)}.Pick(Layout{L0: lvl0})
+	_, uncappedOk := FIFOPolicy{}.Pick(Layout{L0: lvl0})
+
+	// assert
+	assert.True(t, ok)
+	assert.Equal(t, Compaction{Inputs: []LevelTables{{0, lvl0[:1]}}, Drop: true}, c)
+	assert.False(t, fitsOk)
+	assert.False(t, uncappedOk)
+}
+
+func TestCompactionDropsTables(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	lvl0 := []*SSTable{
+		treeSSTable(t, tree, put("a", "1")),
+		treeSSTable(t, tree, put("b", "1")),
+	}
+	setLevels(t, tree, lvl0)
+	oldest := lvl0[0].Path()
+	c := newCompactor(tree, tree.opt)
+	c.opt.CompactionPolicy = FIFOPolicy{MaxSize: lvl0[1].Size()}
+
+	// act
+	err = c.compactL0(context.Background())
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, lvl0[1:], tree.lvl0)
+	_, err = os.Stat(oldest)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = tree.Get([]byte("a"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	v, err := tree.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestCompactionRejectsReorderingL0(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	lvl0 := sizedTables(t, tree, 1, 1)
+	setLevels(t, tree, lvl0)
+	c := newCompactor(tree, tree.opt)
+
+	// act
+	// the newest L0 table can't go below the oldest one
+	errDeeper := c.run(context.Background(), Compaction{Inputs: []LevelTables{{0, lvl0[1:]}}, Output: 1})
+	// nor the oldest one be merged ahead of the newest one
+	errL0 := c.run(context.Background(), Compaction{Inputs: []LevelTables{{0, lvl0[:1]}}, Output: 0})
+
+	// assert
+	assert.Error(t, errDeeper)
+	assert.Error(t, errL0)
+	assert.Equal(t, lvl0, tree.lvl0)
+}
+
+func TestTieredPolicyTree(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 6
+	opts.MaxMemroTables = 1
+	opts.CompactionPolicy = TieredPolicy{MaxRuns: 3}
+
+	tree, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+
+	// act
+	// every key is written 3 times, deleted keys are deleted at last
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			k := []byte("key" + strconv.Itoa(i))
+			if round == 2 && i%5 == 0 {
+				assert.NoError(t, tree.Del(k))
+				continue
+			}
+			assert.NoError(t, tree.Put(k, []byte(strconv.Itoa(round))))
+		}
+	}
+	assert.NoError(t, tree.compact.flush(context.Background()))
+	tree.compact.WaitBackground()
+	assert.NoError(t, tree.Close())
+
+	recovered, err := Recover(context.Background(), dir, &opts)
+	assert.NoError(t, err)
+	defer recovered.Close()
+
+	// assert
+	assert.Empty(t, recovered.lvln)
+	assert.LessOrEqual(t, len(recovered.lvl0), 4)
+	for i := 0; i < 50; i++ {
+		v, err := recovered.Get([]byte("key" + strconv.Itoa(i)))
+		if i%5 == 0 {
+			assert.ErrorIs(t, err, ErrKeyNotFound)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("2"), v)
+	}
+}
@@ -0,0 +1,183 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+)
+
+// rangeTombstone deletes versions of keys in [start, end) older than seq.
+// It's written as an entry of KindRangeDelete with start as the key and end
+// as the value.
+type rangeTombstone struct {
+	start []byte
+	end   []byte
+	seq   uint64
+}
+
+func rangeTombstoneFromEntry(e Entry) rangeTombstone {
+	return rangeTombstone{start: e.Key, end: e.Value, seq: e.Seq}
+}
+
+func (t rangeTombstone) entry() Entry {
+	return Entry{Key: t.start, Value: t.end, Kind: KindRangeDelete, Seq: t.seq}
+}
+
+func (t rangeTombstone) contains(k []byte) bool {
+	return bytes.Compare(k, t.start) >= 0 && bytes.Compare(k, t.end) < 0
+}
+
+// overlaps tells if the tombstone may cover keys of a table.
+func (t rangeTombstone) overlaps(sst *SSTable) bool {
+	return bytes.Compare(sst.FirstKey(), t.end) < 0 &&
+		bytes.Compare(sst.LastKey(), t.start) >= 0
+}
+
+// rangeTombstones are sorted by start keys.
+type rangeTombstones []rangeTombstone
+
+// cover returns the seq of the newest tombstone covering k which is visible
+// at seq, versions of k older than that are deleted. Zero means there's none.
+func (ts rangeTombstones) cover(k []byte, seq uint64) uint64 {
+	cover := uint64(0)
+	for _, t := range ts {
+		if bytes.Compare(t.start, k) > 0 {
+			break
+		}
+
+		if t.seq <= seq && t.seq > cover && t.contains(k) {
+			cover = t.seq
+		}
+	}
+
+	return cover
+}
+
+// insert adds t keeping tombstones sorted, ts is not modified.
+func (ts rangeTombstones) insert(t rangeTombstone) rangeTombstones {
+	i, _ := slices.BinarySearchFunc(ts, t.start, func(t rangeTombstone, k []byte) int {
+		return bytes.Compare(t.start, k)
+	})
+
+	return slices.Insert(slices.Clip(ts), i, t)
+}
+
+func sortRangeTombstones(ts rangeTombstones) {
+	slices.SortStableFunc(ts, func(a, b rangeTombstone) int {
+		return bytes.Compare(a.start, b.start)
+	})
+}
+
+// on disk range tombstone block representation since FormatV6:
+// ---------------------------------------------------------------
+// | entry | entry | ... | crc32c (4B) |
+// ---------------------------------------------------------------
+// entries are KindRangeDelete entries with full keys (see Entry), sorted by
+// start keys. The block is never compressed.
+func encodeRangeDelBlock(ts rangeTombstones, f FormatVersion) []byte {
+	var block []byte
+	for _, t := range ts {
+		block = appendEntry(block, t.entry(), nil, f)
+	}
+
+	return appendChecksum(block)
+}
+
+// rangeDelBlockFromBytes parses a range tombstone block, broken blocks are
+// reported with a *CorruptionError, its offset is relative to b.
+func rangeDelBlockFromBytes(b []byte, f FormatVersion) (rangeTombstones, error) {
+	b, ok := verifyChecksum(b)
+	if !ok {
+		return nil, &CorruptionError{Reason: "range tombstone block checksum mismatch"}
+	}
+
+	var ts rangeTombstones
+	for off := 0; off < len(b); {
+		e, read, err := entryFromBytes(b[off:], nil, f)
+		if err != nil || e.Kind != KindRangeDelete {
+			return nil, &CorruptionError{Offset: int64(off), Reason: "malformed range tombstone"}
+		}
+
+		ts = append(ts, rangeTombstoneFromEntry(e))
+		off += read
+	}
+
+	return ts, nil
+}
+
+// DeleteRange deletes all keys in [start, end) with a single range tombstone,
+// no matter how many keys there are. Keys written after it are not affected.
+func (tree *LSMTree) DeleteRange(start, end []byte) error {
+	return tree.DeleteRangeContext(context.Background(), start, end)
+}
+
+// DeleteRangeContext is DeleteRange which gives up like PutContext does.
+func (tree *LSMTree) DeleteRangeContext(ctx context.Context, start, end []byte) error {
+	if err := checkRange(start, end); err != nil {
+		return err
+	}
+
+	return tree.write(ctx, []Entry{{Key: start, Value: end, Kind: KindRangeDelete}})
+}
+
+func checkRange(start, end []byte) error {
+	if len(start) == 0 || bytes.Compare(start, end) >= 0 {
+		return fmt.Errorf("bad range [%q, %q): start must be a key before end", start, end)
+	}
+
+	return nil
+}
+
+// rangeCover is rangeTombstones.cover over all range tombstones of the tree.
+// Caller must hold rodataGuard.
+func (tree *LSMTree) rangeCover(k []byte, seq uint64) uint64 {
+	cover := tree.mem.rangeTombstones().cover(k, seq)
+	for _, m := range tree.memro {
+		cover = max(cover, m.table.rangeTombstones().cover(k, seq))
+	}
+
+	for _, sst := range tree.lvl0 {
+		cover = max(cover, sst.rangeDels.cover(k, seq))
+	}
+
+	for _, lvl := range tree.lvln {
+		for _, sst := range lvl {
+			cover = max(cover, sst.rangeDels.cover(k, seq))
+		}
+	}
+
+	return cover
+}
+
+// visibleRangeTombstones collects range tombstones of the tree visible at
+// seq. Caller must hold rodataGuard.
+func (tree *LSMTree) visibleRangeTombstones(seq uint64) rangeTombstones {
+	all := make([]rangeTombstones, 0)
+	all = append(all, tree.mem.rangeTombstones())
+	for _, m := range tree.memro {
+		all = append(all, m.table.rangeTombstones())
+	}
+
+	for _, sst := range tree.lvl0 {
+		all = append(all, sst.rangeDels)
+	}
+
+	for _, lvl := range tree.lvln {
+		for _, sst := range lvl {
+			all = append(all, sst.rangeDels)
+		}
+	}
+
+	var visible rangeTombstones
+	for _, ts := range all {
+		for _, t := range ts {
+			if t.seq <= seq {
+				visible = append(visible, t)
+			}
+		}
+	}
+	sortRangeTombstones(visible)
+
+	return visible
+}
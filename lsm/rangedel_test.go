@@ -0,0 +1,218 @@
+package lsm
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// arrangeRangeTree spreads keys of namespaces a and b over L1, L0 and the
+// memtable.
+func arrangeRangeTree(t *testing.T, dir string) *LSMTree {
+	tree, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, tree.Put([]byte("rec_a1"), []byte("1")))
+	assert.NoError(t, tree.Put([]byte("rec_b1"), []byte("1")))
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Put([]byte("rec_a2"), []byte("1")))
+	assert.NoError(t, tree.flushMemtable(context.Background()))
+	assert.NoError(t, tree.Put([]byte("rec_a3"), []byte("1")))
+	assert.NoError(t, tree.Put([]byte("rec_b2"), []byte("1")))
+
+	return tree
+}
+
+func TestDeleteRangeGet(t *testing.T) {
+	// arrange
+	tree := arrangeRangeTree(t, t.TempDir())
+	defer tree.Close()
+
+	// act
+	err := tree.DeleteRange([]byte("rec_a"), []byte("rec_b"))
+	assert.NoError(t, tree.Put([]byte("rec_a2"), []byte("2")))
+
+	// assert
+	assert.NoError(t, err)
+	for _, k := range []string{"rec_a1", "rec_a3"} {
+		_, err := tree.Get([]byte(k))
+		assert.ErrorIs(t, err, ErrKeyNotFound, k)
+	}
+
+	// written after the delete
+	v, err := tree.Get([]byte("rec_a2"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), v)
+
+	v, err = tree.Get([]byte("rec_b1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestDeleteRangeIterator(t *testing.T) {
+	// arrange
+	tree := arrangeRangeTree(t, t.TempDir())
+	defer tree.Close()
+
+	snap := tree.Snapshot()
+	defer snap.Release()
+	assert.NoError(t, tree.DeleteRange([]byte("rec_a2"), []byte("rec_b2")))
+
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+	snapIt := snap.NewIterator(nil, nil)
+	defer snapIt.Close()
+
+	// act
+	it.First()
+	forward := collectKeys(it, true)
+	it.Last()
+	backward := collectKeys(it, false)
+	snapIt.First()
+	snapshot := collectKeys(snapIt, true)
+
+	// assert
+	assert.Equal(t, []string{"rec_a1", "rec_b2"}, forward)
+	assert.Equal(t, []string{"rec_b2", "rec_a1"}, backward)
+	assert.Equal(t, []string{"rec_a1", "rec_a2", "rec_a3", "rec_b1", "rec_b2"}, snapshot)
+}
+
+func TestDeleteRangeRecover(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree := arrangeRangeTree(t, dir)
+	assert.NoError(t, tree.DeleteRange([]byte("rec_a"), []byte("rec_b")))
+
+	// act
+	// the tombstone comes back from the wal first, then from a table
+	assert.NoError(t, tree.Close())
+	recovered, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+	assert.NoError(t, recovered.flushMemtable(context.Background()))
+	assert.NoError(t, recovered.Close())
+	recovered, err = Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+	defer recovered.Close()
+
+	// assert
+	assert.Equal(t, 0, recovered.mem.Len())
+	for _, k := range []string{"rec_a1", "rec_a2", "rec_a3"} {
+		_, err := recovered.Get([]byte(k))
+		assert.ErrorIs(t, err, ErrKeyNotFound, k)
+	}
+	v, err := recovered.Get([]byte("rec_b1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestDeleteRangeCompaction(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	setLevels(t, tree, nil, nil,
+		[]*SSTable{treeSSTable(t, tree, put("rec_a1", "1"), put("rec_b1", "1"))})
+	assert.NoError(t, tree.Put([]byte("rec_a2"), []byte("1")))
+	assert.NoError(t, tree.DeleteRange([]byte("rec_a"), []byte("rec_b")))
+	assert.NoError(t, tree.flushMemtable(context.Background()))
+	c := newCompactor(tree, tree.opt)
+
+	// act
+	errL1 := c.run(context.Background(), Compaction{
+		Inputs: []LevelTables{{0, tree.lvl0}},
+		Output: 1,
+	})
+	l1 := tree.lvln[0]
+	errRange := tree.CompactRange(context.Background(), nil, nil)
+
+	// assert
+	// L2 still holds rec_a1, so the tombstone stays while the key it
+	// deletes in L1 is gone
+	assert.NoError(t, errL1)
+	assert.Len(t, l1, 1)
+	assert.Len(t, l1[0].rangeDels, 1)
+	assert.Equal(t, []byte("rec_a"), l1[0].FirstKey())
+
+	// once it reaches the bottom it's gone together with everything it
+	// deleted
+	assert.NoError(t, errRange)
+	entries := levelEntries(t, tree, 2)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "rec_b1", string(entries[0].Key))
+	for _, sst := range tree.lvln[1] {
+		assert.Empty(t, sst.rangeDels)
+	}
+}
+
+func TestDeleteRangeBadRange(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	var b WriteBatch
+	b.DeleteRange([]byte("b"), []byte("a"))
+
+	// act & assert
+	assert.Error(t, tree.DeleteRange([]byte("a"), []byte("a")))
+	assert.Error(t, tree.DeleteRange(nil, []byte("a")))
+	assert.Error(t, tree.Write(&b))
+}
+
+func TestSSTableRangeTombstones(t *testing.T) {
+	// arrange
+	p := path.Join(t.TempDir(), "rangedels.sst")
+	w, err := NewSSTableWriter(p, 0, *DefaultOptions)
+	assert.NoError(t, err)
+
+	w.AddRangeTombstone(rangeTombstone{[]byte("m"), []byte("p"), 3})
+	w.AddRangeTombstone(rangeTombstone{[]byte("c"), []byte("f"), 2})
+
+	// act
+	_, err = w.Finish()
+	assert.NoError(t, err)
+	f, err := os.Open(p)
+	assert.NoError(t, err)
+	sst, err := SSTableFromFile(f, nil)
+	assert.NoError(t, err)
+	defer sst.Unref()
+
+	// assert
+	// a table of range tombstones only is bounded by their starts
+	assert.Equal(t, rangeTombstones{
+		{[]byte("c"), []byte("f"), 2},
+		{[]byte("m"), []byte("p"), 3},
+	}, sst.rangeDels)
+	assert.Equal(t, []byte("c"), sst.FirstKey())
+	assert.Equal(t, []byte("m"), sst.LastKey())
+	assert.Equal(t, uint64(2), sst.rangeDels.cover([]byte("d"), 2))
+	assert.Equal(t, uint64(0), sst.rangeDels.cover([]byte("d"), 1))
+	assert.Equal(t, uint64(0), sst.rangeDels.cover([]byte("f"), 5))
+}
+
+func TestDeleteRangeGetBeforeFirstKey(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.BloomBitsPerKey = 0
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	assert.NoError(t, tree.DeleteRange([]byte("a"), []byte("z")))
+	assert.NoError(t, tree.Put([]byte("m"), []byte("1")))
+	assert.NoError(t, tree.flushMemtable(context.Background()))
+
+	// act
+	// c is within the table bounds, which start at the tombstone
+	_, err = tree.Get([]byte("c"))
+
+	// assert
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	v, err := tree.Get([]byte("m"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
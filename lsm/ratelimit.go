@@ -0,0 +1,114 @@
+package lsm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// IOPriority decides who goes first when writes wait for a RateLimiter.
+type IOPriority int
+
+const (
+	// IOPriorityLow is for compactions, they can wait
+	IOPriorityLow IOPriority = iota
+	// IOPriorityHigh is for flushes, writers stall while they lag behind
+	IOPriorityHigh
+)
+
+// rateLimiterMaxWait is the longest a waiter sleeps before looking at the
+// bucket again, so a new rate takes effect soon enough.
+const rateLimiterMaxWait = 100 * time.Millisecond
+
+// RateLimiter is a token bucket limiting bytes per second written to disk by
+// flushes and compactions, so they don't take all the disk bandwidth from
+// reads. The bucket holds up to 100ms worth of bytes. A write bigger than
+// what's in the bucket borrows from the future, and the writes after it wait
+// the debt off. High priority writes go ahead of low priority ones waiting.
+// One limiter may be shared by trees to limit all of them together.
+type RateLimiter struct {
+	mu          sync.Mutex
+	rate        int     // bytes per second, 0 means unlimited
+	tokens      float64 // bytes which may be written right away, negative is debt
+	last        time.Time
+	highWaiting int // high priority writes waiting for tokens
+}
+
+// NewRateLimiter returns a limiter of bytesPerSec, 0 means unlimited.
+func NewRateLimiter(bytesPerSec int) *RateLimiter {
+	return &RateLimiter{rate: max(bytesPerSec, 0), last: time.Now()}
+}
+
+// SetRate changes the limit, waiting writes pick it up within 100ms.
+func (r *RateLimiter) SetRate(bytesPerSec int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refill()
+	r.rate = max(bytesPerSec, 0)
+}
+
+// Rate is the limit in bytes per second, 0 means unlimited.
+func (r *RateLimiter) Rate() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rate
+}
+
+// Wait blocks until n bytes may be written, or ctx is done.
+func (r *RateLimiter) Wait(ctx context.Context, n int, pri IOPriority) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if pri == IOPriorityHigh {
+		r.highWaiting++
+		defer func() { r.highWaiting-- }()
+	}
+
+	for {
+		r.refill()
+		if r.rate == 0 {
+			return nil
+		}
+
+		if r.tokens > 0 && (pri == IOPriorityHigh || r.highWaiting == 0) {
+			r.tokens -= float64(n)
+			return nil
+		}
+
+		// sleep until the debt is paid off, low priority writes waiting for
+		// high priority ones just look again later
+		wait := rateLimiterMaxWait
+		if r.tokens <= 0 {
+			wait = min(wait, time.Duration((1-r.tokens)/float64(r.rate)*float64(time.Second)))
+		}
+
+		r.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			r.mu.Lock()
+			return ctx.Err()
+		}
+		r.mu.Lock()
+	}
+}
+
+// refill adds tokens for the time passed since the last refill. Caller must
+// hold mu.
+func (r *RateLimiter) refill() {
+	now := time.Now()
+	elapsed := now.Sub(r.last)
+	r.last = now
+
+	if r.rate == 0 {
+		r.tokens = 0
+		return
+	}
+
+	burst := float64(r.rate) * rateLimiterMaxWait.Seconds()
+	r.tokens = min(r.tokens+elapsed.Seconds()*float64(r.rate), burst)
+}
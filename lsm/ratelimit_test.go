@@ -0,0 +1,121 @@
+package lsm
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterLimits(t *testing.T) {
+	// arrange
+	r := NewRateLimiter(100_000)
+	start := time.Now()
+
+	// act
+	for i := 0; i < 30; i++ {
+		assert.NoError(t, r.Wait(context.Background(), 1000, IOPriorityLow))
+	}
+
+	// assert
+	// 100ms worth of bytes may come at once, the rest takes 200ms
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	// arrange
+	r := NewRateLimiter(0)
+	start := time.Now()
+
+	// act
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, r.Wait(context.Background(), 1<<20, IOPriorityLow))
+	}
+
+	// assert
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	// arrange
+	r := NewRateLimiter(1)
+	assert.NoError(t, r.Wait(context.Background(), 1<<20, IOPriorityLow))
+
+	done := make(chan error)
+	go func() {
+		done <- r.Wait(context.Background(), 1, IOPriorityLow)
+	}()
+
+	// act
+	time.Sleep(10 * time.Millisecond)
+	r.SetRate(0)
+
+	// assert
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("wait didn't pick the new rate up")
+	}
+	assert.Equal(t, 0, r.Rate())
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	// arrange
+	r := NewRateLimiter(10_000)
+	// 100ms of debt
+	assert.NoError(t, r.Wait(context.Background(), 1000, IOPriorityLow))
+
+	order := make(chan IOPriority, 2)
+	wait := func(pri IOPriority) {
+		assert.NoError(t, r.Wait(context.Background(), 1000, pri))
+		order <- pri
+	}
+
+	// act
+	go wait(IOPriorityLow)
+	time.Sleep(10 * time.Millisecond)
+	go wait(IOPriorityHigh)
+
+	// assert
+	assert.Equal(t, IOPriorityHigh, <-order)
+	assert.Equal(t, IOPriorityLow, <-order)
+}
+
+func TestRateLimiterCanceled(t *testing.T) {
+	// arrange
+	r := NewRateLimiter(1)
+	assert.NoError(t, r.Wait(context.Background(), 1<<20, IOPriorityLow))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// act
+	err := r.Wait(ctx, 1, IOPriorityHigh)
+
+	// assert
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestSSTableWriterRateLimited(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.RateLimiter = NewRateLimiter(100_000)
+	mem := NewMemtable()
+	for i := 0; i < 30; i++ {
+		mem.Apply(put("key"+strconv.Itoa(i), strings.Repeat("x", 1000)))
+	}
+	start := time.Now()
+
+	// act
+	sst, err := SSTableFromReadonlyMemtable(mem.AsReadonly(),
+		filepath.Join(t.TempDir(), "000001.sst"), opts)
+
+	// assert
+	assert.NoError(t, err)
+	defer sst.Unref()
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
@@ -0,0 +1,218 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrReadOnly is returned by writes and compactions of a tree opened with
+// OpenReadOnly.
+var ErrReadOnly = errors.New("lsm tree is read-only")
+
+// OpenReadOnly opens the tree in dir for reads next to the process writing it
+// (the primary), e.g. for reporting. Nothing in dir is modified or locked:
+// there's no compactor, the wal is only read and no new manifest is started.
+//
+// The tree sees what the primary had written at the last TryCatchUp,
+// OpenReadOnly makes the first one. Iterators keep reading the tables they
+// were created with, but snapshots don't hold the primary's compactions
+// back, so versions only they see may be gone after a catch-up.
+func OpenReadOnly(dir string, opts *Options) (*LSMTree, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+
+	opt := *opts
+	if opt.BlockCache == nil && opt.BlockCacheSize > 0 {
+		opt.BlockCache = NewBlockCache(opt.BlockCacheSize)
+	}
+
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &LSMTree{
+		dir:         absdir,
+		mem:         NewMemtable(),
+		writeGuard:  new(sync.Mutex),
+		rodataGuard: new(sync.RWMutex),
+		memro:       make([]*ReadonlyMemtable, 0),
+		lvl0:        make([]*SSTable, 0),
+		lvln:        make([][]*SSTable, 0),
+		blobs:       newBlobSet(),
+		nextFile:    new(atomic.Uint64),
+		opt:         opt,
+		readOnly:    true,
+		seq:         new(atomic.Uint64),
+		snapshots:   newSnapshotList(),
+		stalls:      new(stallStats),
+	}
+
+	if err := tree.TryCatchUp(); err != nil {
+		return nil, err
+	}
+
+	return tree, nil
+}
+
+// TryCatchUp brings a tree opened with OpenReadOnly up to date with the
+// primary: tables and blob files of its current manifest, and writes in its
+// wal which are not in tables yet. The memtable is rebuilt from the wal every
+// time, it's as big as the primary's memtables.
+//
+// It fails when the primary removes files it's about to open, e.g. tables of
+// a compaction which just finished. The tree is left as it was then and
+// trying again is fine.
+func (tree *LSMTree) TryCatchUp() error {
+	if !tree.readOnly {
+		return errors.New("catching up a tree which is not read-only")
+	}
+
+	tree.writeGuard.Lock()
+	defer tree.writeGuard.Unlock()
+
+	v, err := loadVersion(tree.dir)
+	if err != nil {
+		return fmt.Errorf("loading version: %w", err)
+	}
+
+	// the wal is read before the manifest: a segment is released once
+	// its writes are in tables of the manifest, so writes gone from the wal
+	// by now are in the version loaded next
+	walPath := v.walDir
+	if !filepath.IsAbs(walPath) {
+		walPath = path.Join(tree.dir, walPath)
+	}
+	logged, err := readWalDir(walPath, v.lastSeq)
+	if err != nil {
+		return err
+	}
+
+	if v, err = loadVersion(tree.dir); err != nil {
+		return fmt.Errorf("loading version: %w", err)
+	}
+
+	tree.rodataGuard.RLock()
+	tables := make(map[uint64]*SSTable)
+	for _, sst := range tree.lvl0 {
+		tables[sstFileNum(sst.Path())] = sst
+	}
+	for _, lvl := range tree.lvln {
+		for _, sst := range lvl {
+			tables[sstFileNum(sst.Path())] = sst
+		}
+	}
+	tree.rodataGuard.RUnlock()
+
+	tree.blobs.mu.Lock()
+	blobs := maps.Clone(tree.blobs.files)
+	tree.blobs.mu.Unlock()
+
+	l, err := openVersion(tree.dir, v, tables, blobs, tree.opt.BlockCache)
+	if err != nil {
+		return err
+	}
+
+	// writes of the wal which are in tables already are left out, merge
+	// operands must not be there twice
+	mem := NewMemtable()
+	seq := v.lastSeq
+	for _, e := range logged {
+		if e.Seq <= v.lastSeq {
+			continue
+		}
+
+		if err := mem.Apply(e); err != nil {
+			l.release()
+			return err
+		}
+		seq = max(seq, e.Seq)
+	}
+
+	tree.rodataGuard.Lock()
+	if tree.closed {
+		tree.rodataGuard.Unlock()
+		l.release()
+		return ErrClosed
+	}
+
+	oldLvl0, oldLvln := tree.lvl0, tree.lvln
+	tree.mem = mem
+	tree.lvl0, tree.lvln = l.split()
+	tree.blobs.mu.Lock()
+	oldBlobs := tree.blobs.files
+	tree.blobs.files, tree.blobs.garbage = l.blobs, l.garbage
+	tree.blobs.mu.Unlock()
+	tree.nextFile.Store(v.nextFile)
+	tree.seq.Store(max(tree.seq.Load(), seq))
+	tree.rodataGuard.Unlock()
+
+	// files the new version doesn't have anymore are closed once nobody reads
+	// them, the primary removes them
+	for _, sst := range oldLvl0 {
+		sst.Unref()
+	}
+	for _, lvl := range oldLvln {
+		for _, sst := range lvl {
+			sst.Unref()
+		}
+	}
+	for _, f := range oldBlobs {
+		f.Unref()
+	}
+
+	return nil
+}
+
+// readWalDir reads writes of all segments of the wal in dir without opening
+// it, segments removed meanwhile are skipped. Writes made before sequence
+// numbers existed are numbered from lastSeq on, like Recover does.
+func readWalDir(dir string, lastSeq uint64) ([]Entry, error) {
+	segs, err := walSegments(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	seq := lastSeq
+	for _, s := range segs {
+		err := replayWalSegment(walSegmentPath(dir, s), func(e Entry) error {
+			if e.Seq == 0 {
+				e.Seq = seq + 1
+			}
+			seq = max(seq, e.Seq)
+			entries = append(entries, e)
+			return nil
+		})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("replaying wal: %w", err)
+		}
+	}
+
+	return entries, nil
+}
+
+// closeReadOnly is Close of a read-only tree, it only has files to close.
+func (tree *LSMTree) closeReadOnly() error {
+	var errs []error
+	for _, sst := range tree.lvl0 {
+		errs = append(errs, sst.Unref())
+	}
+	for _, lvl := range tree.lvln {
+		for _, sst := range lvl {
+			errs = append(errs, sst.Unref())
+		}
+	}
+
+	return errors.Join(append(errs, tree.blobs.close())...)
+}
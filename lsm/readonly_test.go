@@ -0,0 +1,129 @@
+package lsm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	primary, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+	defer primary.Close()
+
+	assert.NoError(t, primary.Put([]byte("a"), []byte("1")))
+	flushAndCompact(t, primary)
+	assert.NoError(t, primary.Put([]byte("b"), []byte("1")))
+	assert.NoError(t, primary.flushMemtable(context.Background()))
+	// left in the wal
+	assert.NoError(t, primary.Put([]byte("c"), []byte("1")))
+
+	// act
+	tree, err := OpenReadOnly(dir, nil)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	// assert
+	for _, k := range []string{"a", "b", "c"} {
+		v, err := tree.Get([]byte(k))
+		assert.NoError(t, err, k)
+		assert.Equal(t, []byte("1"), v, k)
+	}
+
+	assert.ErrorIs(t, tree.Put([]byte("d"), []byte("1")), ErrReadOnly)
+	assert.ErrorIs(t, tree.Del([]byte("a")), ErrReadOnly)
+	assert.ErrorIs(t, tree.CompactRange(context.Background(), nil, nil), ErrReadOnly)
+	assert.ErrorIs(t, tree.PauseCompaction(context.Background()), ErrReadOnly)
+
+	// nothing of the primary was touched
+	v, err := primary.Get([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+}
+
+func TestTryCatchUp(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	primary, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+	defer primary.Close()
+
+	assert.NoError(t, primary.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, primary.Put([]byte("b"), []byte("1")))
+	flushAndCompact(t, primary)
+
+	tree, err := OpenReadOnly(dir, nil)
+	assert.NoError(t, err)
+	defer tree.Close()
+	it := tree.NewIterator(nil, nil)
+	defer it.Close()
+
+	// the primary rewrites the tables the read-only tree has open
+	assert.NoError(t, primary.Put([]byte("a"), []byte("2")))
+	assert.NoError(t, primary.Del([]byte("b")))
+	flushAndCompact(t, primary)
+	assert.NoError(t, primary.Put([]byte("c"), []byte("2")))
+
+	// act
+	_, errBefore := tree.Get([]byte("c"))
+	errCatchUp := tree.TryCatchUp()
+
+	// assert
+	assert.ErrorIs(t, errBefore, ErrKeyNotFound)
+	assert.NoError(t, errCatchUp)
+
+	v, err := tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), v)
+	_, err = tree.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	v, err = tree.Get([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), v)
+
+	// the iterator still reads what it started with
+	it.First()
+	assert.Equal(t, []string{"a", "b"}, collectKeys(it, true))
+	assert.NoError(t, it.Err())
+}
+
+func TestTryCatchUpMergeOperands(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	primary := counterTree(t, dir)
+	defer primary.Close()
+
+	assert.NoError(t, primary.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, primary.Merge([]byte("a"), []byte("2")))
+
+	opts := *DefaultOptions
+	opts.MergeOperator = counter{}
+	tree, err := OpenReadOnly(dir, &opts)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	// act
+	// operands are spread over a table and the wal
+	assert.NoError(t, primary.flushMemtable(context.Background()))
+	assert.NoError(t, primary.Merge([]byte("a"), []byte("3")))
+	err = tree.TryCatchUp()
+
+	// assert
+	assert.NoError(t, err)
+	v, err := tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("6"), v)
+}
+
+func TestTryCatchUpPrimary(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	// act & assert
+	assert.Error(t, tree.TryCatchUp())
+}
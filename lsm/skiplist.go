@@ -0,0 +1,138 @@
+package lsm
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+const skiplistMaxHeight = 12
+
+// skiplist keeps versions of keys in key order. One writer at a time inserts
+// into it while readers walk it without locking. Keys are never removed, so
+// a node stays where it is once it's linked.
+type skiplist struct {
+	head   *skipNode
+	height atomic.Int32
+	length atomic.Int64
+}
+
+type skipNode struct {
+	key  string
+	vs   *memVersions
+	next []atomic.Pointer[skipNode]
+}
+
+func newSkiplist() *skiplist {
+	s := &skiplist{
+		head: &skipNode{next: make([]atomic.Pointer[skipNode], skiplistMaxHeight)},
+	}
+	s.height.Store(1)
+	return s
+}
+
+// load returns versions of k, if k is there.
+func (s *skiplist) load(k string) (*memVersions, bool) {
+	n := s.findGreaterOrEqual(k, nil)
+	if n == nil || n.key != k {
+		return nil, false
+	}
+
+	return n.vs, true
+}
+
+// loadOrStore returns versions of k, adding k with no versions first if it's
+// not there yet. Callers must not run it concurrently.
+func (s *skiplist) loadOrStore(k string) *memVersions {
+	var prev [skiplistMaxHeight]*skipNode
+	if n := s.findGreaterOrEqual(k, &prev); n != nil && n.key == k {
+		return n.vs
+	}
+
+	height := 1
+	for height < skiplistMaxHeight && rand.Intn(4) == 0 {
+		height++
+	}
+
+	n := &skipNode{
+		key:  k,
+		vs:   new(memVersions),
+		next: make([]atomic.Pointer[skipNode], height),
+	}
+	n.vs.versions.Store(new([]memValue))
+
+	// the node is linked bottom up, so readers that reach it at some level
+	// can always go on below
+	for i := 0; i < height; i++ {
+		if prev[i] == nil {
+			prev[i] = s.head
+		}
+		n.next[i].Store(prev[i].next[i].Load())
+		prev[i].next[i].Store(n)
+	}
+
+	if int(s.height.Load()) < height {
+		s.height.Store(int32(height))
+	}
+	s.length.Add(1)
+
+	return n.vs
+}
+
+// findGreaterOrEqual returns the first node with key >= k, nil if there is
+// none. Nodes right before it at every level are put into prev unless it's
+// nil.
+func (s *skiplist) findGreaterOrEqual(k string, prev *[skiplistMaxHeight]*skipNode) *skipNode {
+	x := s.head
+	for i := int(s.height.Load()) - 1; i >= 0; i-- {
+		for next := x.next[i].Load(); next != nil && next.key < k; next = x.next[i].Load() {
+			x = next
+		}
+
+		if prev != nil {
+			prev[i] = x
+		}
+	}
+
+	return x.next[0].Load()
+}
+
+// findLess returns the last node with key < k, nil if there is none.
+func (s *skiplist) findLess(k string) *skipNode {
+	x := s.head
+	for i := int(s.height.Load()) - 1; i >= 0; i-- {
+		for next := x.next[i].Load(); next != nil && next.key < k; next = x.next[i].Load() {
+			x = next
+		}
+	}
+
+	if x == s.head {
+		return nil
+	}
+
+	return x
+}
+
+// findLast returns the last node, nil if the list is empty.
+func (s *skiplist) findLast() *skipNode {
+	x := s.head
+	for i := int(s.height.Load()) - 1; i >= 0; i-- {
+		for next := x.next[i].Load(); next != nil; next = x.next[i].Load() {
+			x = next
+		}
+	}
+
+	if x == s.head {
+		return nil
+	}
+
+	return x
+}
+
+// first returns the first node, nil if the list is empty.
+func (s *skiplist) first() *skipNode {
+	return s.head.next[0].Load()
+}
+
+func (s *skiplist) len() int {
+	return int(s.length.Load())
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"slices"
+	"sync"
+)
+
+// Snapshot is a consistent read-only view of the tree as of the moment it was
+// taken: its reads see every write made before it and none made after.
+// Compaction keeps versions of keys live snapshots may read, so a snapshot
+// must be released once done.
+type Snapshot struct {
+	tree     *LSMTree
+	seq      uint64
+	released sync.Once
+}
+
+// Snapshot takes a snapshot of the tree.
+func (tree *LSMTree) Snapshot() *Snapshot {
+	tree.snapshots.mu.Lock()
+	defer tree.snapshots.mu.Unlock()
+
+	s := &Snapshot{tree: tree, seq: tree.seq.Load()}
+	tree.snapshots.seqs[s.seq]++
+	return s
+}
+
+// Seq is the sequence number of the last write visible to the snapshot.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+func (s *Snapshot) Get(k []byte) ([]byte, error) {
+	return s.tree.get(k, s.seq)
+}
+
+// NewIterator is LSMTree.NewIterator reading the snapshot.
+func (s *Snapshot) NewIterator(lower, upper []byte) *Iterator {
+	return s.tree.newIterator(lower, upper, s.seq)
+}
+
+// Release lets compaction drop versions only the snapshot could see.
+// Releasing a snapshot twice is a no-op.
+func (s *Snapshot) Release() {
+	s.released.Do(func() { s.tree.snapshots.release(s.seq) })
+}
+
+// snapshotList counts live snapshots per sequence number.
+type snapshotList struct {
+	mu   sync.Mutex
+	seqs map[uint64]int
+}
+
+func newSnapshotList() *snapshotList {
+	return &snapshotList{seqs: make(map[uint64]int)}
+}
+
+func (l *snapshotList) release(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seqs[seq]--; l.seqs[seq] <= 0 {
+		delete(l.seqs, seq)
+	}
+}
+
+// live returns sequence numbers of live snapshots in ascending order.
+func (l *snapshotList) live() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(l.seqs))
+	for seq := range l.seqs {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+
+	return seqs
+}
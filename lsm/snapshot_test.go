@@ -0,0 +1,179 @@
+package lsm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flushAndCompact moves the memtable to memro, flushes it and merges L0 into
+// L1, like the background compaction would.
+func flushAndCompact(t *testing.T, tree *LSMTree) {
+	tree.rodataGuard.Lock()
+	assert.NoError(t, tree.rotateMemtable())
+	tree.rodataGuard.Unlock()
+
+	c := newCompactor(tree, tree.opt)
+	c.opt.MaxL0Tables = 0
+	assert.NoError(t, c.flush())
+	assert.NoError(t, c.compactL0(context.Background()))
+}
+
+// versionsOf counts versions of k stored in L1.
+func versionsOf(t *testing.T, tree *LSMTree, k string) int {
+	n := 0
+	for _, sst := range tree.lvln[0] {
+		it := sst.Iter()
+		for ok := it.First(); ok; ok = it.Next() {
+			if string(it.Value().Key) == k {
+				n++
+			}
+		}
+		assert.NoError(t, it.Err())
+	}
+
+	return n
+}
+
+func TestSnapshotGet(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, tree.Put([]byte("b"), []byte("1")))
+
+	// act
+	snap := tree.Snapshot()
+	defer snap.Release()
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("2")))
+	assert.NoError(t, tree.Del([]byte("b")))
+	assert.NoError(t, tree.Put([]byte("c"), []byte("2")))
+
+	// assert
+	v, err := snap.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+	v, err = snap.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+	_, err = snap.Get([]byte("c"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	v, err = tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), v)
+	_, err = tree.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestSnapshotIterator(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		assert.NoError(t, tree.Put([]byte(k), []byte("1")))
+	}
+	snap := tree.Snapshot()
+	defer snap.Release()
+
+	// older versions end up in tables, newer ones stay in the memtable
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Put([]byte("a"), []byte("2")))
+	assert.NoError(t, tree.Del([]byte("b")))
+	assert.NoError(t, tree.Put([]byte("d"), []byte("2")))
+
+	// act
+	it := snap.NewIterator(nil, nil)
+	defer it.Close()
+	it.First()
+	forward := collectKeys(it, true)
+	it.Last()
+	backward := collectKeys(it, false)
+
+	it.Seek([]byte("a"))
+	first := string(it.Value())
+
+	// assert
+	assert.Equal(t, []string{"a", "b", "c"}, forward)
+	assert.Equal(t, []string{"c", "b", "a"}, backward)
+	assert.Equal(t, "1", first)
+
+	latest := tree.NewIterator(nil, nil)
+	defer latest.Close()
+	latest.First()
+	assert.Equal(t, []string{"a", "c", "d"}, collectKeys(latest, true))
+}
+
+func TestCompactionKeepsSnapshotVersions(t *testing.T) {
+	// arrange
+	tree, err := Recover(context.Background(), t.TempDir(), DefaultOptions)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, tree.Put([]byte("b"), []byte("1")))
+	snap := tree.Snapshot()
+	assert.NoError(t, tree.Put([]byte("a"), []byte("2")))
+	assert.NoError(t, tree.Put([]byte("a"), []byte("3")))
+	assert.NoError(t, tree.Del([]byte("b")))
+
+	// act
+	flushAndCompact(t, tree)
+
+	// assert
+	// the snapshot needs a=1 and b=1, the tree needs a=3 and the tombstone
+	assert.Equal(t, 2, versionsOf(t, tree, "a"))
+	assert.Equal(t, 2, versionsOf(t, tree, "b"))
+
+	v, err := snap.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+	v, err = snap.Get([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), v)
+
+	// once released, only the newest versions are left
+	snap.Release()
+	assert.NoError(t, tree.Put([]byte("a"), []byte("4")))
+	flushAndCompact(t, tree)
+
+	assert.Equal(t, 1, versionsOf(t, tree, "a"))
+	assert.Equal(t, 0, versionsOf(t, tree, "b"))
+	v, err = tree.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("4"), v)
+}
+
+func TestLSMTreeRecoverSeq(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	tree, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, tree.Put([]byte("a"), []byte("1")))
+	assert.NoError(t, tree.Put([]byte("a"), []byte("2")))
+	flushAndCompact(t, tree)
+	assert.NoError(t, tree.Put([]byte("b"), []byte("1")))
+	seq := tree.Snapshot().Seq()
+	assert.NoError(t, tree.Close())
+
+	// act
+	recovered, err := Recover(context.Background(), dir, DefaultOptions)
+	assert.NoError(t, err)
+	defer recovered.Close()
+
+	// assert
+	assert.Equal(t, uint64(3), seq)
+	assert.Equal(t, seq, recovered.Snapshot().Seq())
+
+	assert.NoError(t, recovered.Put([]byte("a"), []byte("3")))
+	v, err := recovered.Get([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), v)
+}
@@ -3,41 +3,134 @@ package lsm
 import (
 	"birb/pkg/byteutil"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"slices"
+	"sort"
+	"sync/atomic"
 )
 
 var (
 	ErrKeyNotFound = errors.New("no such key found")
+	// ErrKeyDeleted is returned by memtables and sstables when the key is
+	// shadowed by a tombstone, LSMTree reports such keys as ErrKeyNotFound.
+	ErrKeyDeleted = errors.New("key is deleted")
 )
 
 // SSTable is a inmem view over on disk sstable.
 // SSTable has the following layout:
-// 1. blocks of data (blocks which contain keys and values),
-// 2. block index (first keys of each block for doing binary search when
+// 1. blocks of data (blocks which contain keys and values), followed by
+// range tombstones of the table since FormatV6 (see encodeRangeDelBlock),
+// 2. bloom filter of all keys in the table (lies between the end of data and
+// the start of block index, so tables written without it have it empty),
+// 3. block index (first keys of each block for doing binary search when
 // needed to find a block with particular key),
-// 3. table metadata (data and index offsets and length in the file).
-// SSTable is lazy, which means only block index is loaded into memory, data
-// blocks are accessed when a particular key is requested.
+// 4. table metadata (data and index offsets and length in the file).
+// Blocks, block index and table metadata end with a crc32c checksum, so does
+// the bloom filter since FormatV7. Data which doesn't match it is reported as
+// ErrCorruption. Table metadata is a
+// part of the footer, which also tells the format version (see format.go).
+// SSTable is lazy, which means only block index and bloom filter are loaded
+// into memory, data blocks are accessed when a particular key is requested
+// and go through the block cache.
 type SSTable struct {
-	file  *os.File
-	index SSTIndex // is nil when not loaded
-	meta  Meta
+	id     uint64 // unique for each opened table, used as block cache key
+	file   *os.File
+	index  SSTIndex    // is nil when not loaded
+	filter BloomFilter // is nil when the table has none
+	// range tombstones are few, so they're always in memory
+	rangeDels rangeTombstones
+	meta      Meta
+	format    FormatVersion
+	cache     *BlockCache // may be nil
+	// the tree holds one reference, every open iterator holds another one.
+	// The file is closed when the last reference is dropped, and removed
+	// as well if the table was compacted away by then.
+	refs     *atomic.Int32
+	obsolete *atomic.Bool
+}
+
+var nextTableID atomic.Uint64
+
+func newSSTable(
+	file *os.File,
+	index SSTIndex,
+	filter BloomFilter,
+	meta Meta,
+	format FormatVersion,
+	cache *BlockCache,
+) SSTable {
+	refs := new(atomic.Int32)
+	refs.Store(1)
+	return SSTable{
+		id:       nextTableID.Add(1),
+		file:     file,
+		index:    index,
+		filter:   filter,
+		meta:     meta,
+		format:   format,
+		cache:    cache,
+		refs:     refs,
+		obsolete: new(atomic.Bool),
+	}
+}
+
+func (t *SSTable) Ref() {
+	t.refs.Add(1)
+}
+
+func (t *SSTable) Unref() error {
+	if t.refs.Add(-1) > 0 {
+		return nil
+	}
+
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+
+	if t.obsolete.Load() {
+		return os.Remove(t.file.Name())
+	}
+
+	return nil
+}
+
+// MarkObsolete makes the file go away together with the last reference.
+func (t *SSTable) MarkObsolete() {
+	t.obsolete.Store(true)
+}
+
+func (t *SSTable) Path() string {
+	return t.file.Name()
 }
 
 func (t *SSTable) Size() uint {
-	return uint(t.meta.DataLen) + uint(t.meta.IndexLen) + MetaSize
+	return uint(t.meta.IndexOffset+t.meta.IndexLen) + uint(t.format.footerSize())
 }
 
+// FirstKey and LastKey are bounds of keys in the table. Range tombstones count
+// by their start keys, so they keep tables of a level apart just like keys
+// do, while a table may hold nothing but range tombstones.
 func (t *SSTable) FirstKey() []byte {
+	if len(t.rangeDels) > 0 &&
+		(len(t.index) == 0 || bytes.Compare(t.rangeDels[0].start, t.index[0].firstKey) < 0) {
+		return t.rangeDels[0].start
+	}
+
 	return t.index[0].firstKey
 }
 
 func (t *SSTable) LastKey() []byte {
+	if n := len(t.rangeDels); n > 0 &&
+		(len(t.index) == 0 || bytes.Compare(t.rangeDels[n-1].start, t.index[len(t.index)-1].lastKey) > 0) {
+		return t.rangeDels[n-1].start
+	}
+
 	return t.index[len(t.index)-1].lastKey
 }
 
@@ -47,196 +140,676 @@ func (t *SSTable) InRange(k []byte) bool {
 	return moreThanFirst && lessThanLast
 }
 
+// MayContain checks key against the table key range and bloom filter, it's
+// never false for a key stored in the table.
+func (t *SSTable) MayContain(key []byte) bool {
+	if len(t.index) == 0 || !t.InRange(key) {
+		return false
+	}
+
+	return t.filter == nil || t.filter.MayContain(key)
+}
+
+// Exist tells whether the table holds an entry for key, a tombstone is an
+// entry too. A table which can't be read is assumed to hold the key, so the
+// caller gets to see the error from Get.
 func (t *SSTable) Exist(key []byte) bool {
-	panic("unimpl")
+	_, err := t.Get(key)
+	return !errors.Is(err, ErrKeyNotFound)
 }
 
-// TODO implement Get for []SSTable, and bloom filter (for blocks and sstables?)
-// TODO implement block cache??
+// Get returns the newest version of key.
 func (t *SSTable) Get(key []byte) ([]byte, error) {
+	return t.GetAt(key, math.MaxUint64)
+}
+
+// GetAt returns the newest version of key not newer than seq. Merge operands
+// and pointers to blob files are returned as they are, LSMTree.Get combines
+// and reads them.
+// TODO implement Get for []SSTable
+func (t *SSTable) GetAt(key []byte, seq uint64) ([]byte, error) {
+	var newest Entry
+	done, err := t.versions(key, seq, func(e Entry) bool { newest = e; return true })
+	if err != nil {
+		return nil, err
+	}
+
+	if !done {
+		return nil, ErrKeyNotFound
+	}
+
+	if newest.Kind == KindTombstone {
+		return nil, ErrKeyDeleted
+	}
+
+	return newest.Value, nil
+}
+
+// versions calls f with versions of key not newer than seq, the newest first,
+// until f returns true. done tells whether f did.
+func (t *SSTable) versions(key []byte, seq uint64, f func(e Entry) bool) (done bool, err error) {
 	if t.index == nil {
-		sst, err := SSTableFromFile(t.file) // this func looks bad here honestly
+		sst, err := SSTableFromFile(t.file, t.cache) // this func looks bad here honestly
 		if err != nil {
-			return nil, err
+			return false, err
 		}
 
 		t.index = sst.index
+		t.filter = sst.filter
+		t.rangeDels = sst.rangeDels
+		t.format = sst.format
+	}
+
+	// no need to touch data blocks if the key is for sure not here
+	if !t.MayContain(key) {
+		return false, nil
 	}
 
 	// find block in sst index
-	i, found := slices.BinarySearchFunc(t.index, key, func(e SSTIndexEntry, t []byte) int {
+	blk, found := slices.BinarySearchFunc(t.index, key, func(e SSTIndexEntry, t []byte) int {
 		return bytes.Compare(e.firstKey, t)
 	})
 
 	if !found {
-		i -= 1
+		blk -= 1
+	}
+
+	// the key is before the first data block, the table bounds take range
+	// tombstones into account and may start earlier
+	if blk < 0 {
+		return false, nil
+	}
+
+	block, err := t.readBlock(blk)
+	if err != nil {
+		return false, err
 	}
 
+	// binary search over restart points, then scan forward from there. All
+	// versions of a key are in the same block, newer ones first
+	it := NewBlockIter(block)
+	for ok := it.Seek(key); ok; ok = it.Next() {
+		entry := it.Value()
+		if !bytes.Equal(entry.Key, key) {
+			break
+		}
+
+		if entry.Seq > seq {
+			continue
+		}
+
+		if f(entry) {
+			return true, nil
+		}
+	}
+
+	if it.Err() != nil {
+		return false, withBlockLocation(it.Err(), t.Path(), int64(t.index[blk].offset))
+	}
+
+	return false, nil
+}
+
+func (t *SSTable) Iter() *SSTableIter {
+	return &SSTableIter{table: t, blk: -1}
+}
+
+// readBlock returns i-th block from the cache, or reads it whole into memory
+// and caches it.
+func (t *SSTable) readBlock(i int) (*Block, error) {
 	blockIdx := t.index[i]
 
-	reader := io.NewSectionReader(
-		t.file,
-		int64(blockIdx.offset),
-		int64(blockIdx.len))
+	key := blockCacheKey{table: t.id, offset: blockIdx.offset}
+	if block, ok := t.cache.Get(key); ok {
+		return block, nil
+	}
 
-	block, err := BlockFromSectReader(reader)
+	buf := make([]byte, blockIdx.len)
+	if _, err := t.file.ReadAt(buf, int64(blockIdx.offset)); err != nil {
+		return nil, fmt.Errorf("reading block: %w", err)
+	}
+
+	block, err := BlockFromSectReader(
+		io.NewSectionReader(bytes.NewReader(buf), 0, int64(len(buf))), t.format)
 	if err != nil {
-		return nil, err
+		return nil, withBlockLocation(err, t.Path(), int64(blockIdx.offset))
 	}
 
-	// find entry in block index
-	i, found = slices.BinarySearchFunc(block.index, key,
-		func(e *BlockIndexValue, t []byte) int {
-			sr := io.NewSectionReader(block.file, int64(e.offset), int64(e.len))
-			key := keyFromSect(sr)
-			e.r = sr
-			return bytes.Compare(t, key)
-		})
+	t.cache.Put(key, &block, block.size())
+	return &block, nil
+}
 
-	if !found {
-		return nil, ErrKeyNotFound
+// SSTableIter walks all entries of a table, reading one block at a time.
+type SSTableIter struct {
+	table *SSTable
+	blk   int
+	it    *BlockIter // nil when not positioned
+	err   error
+}
+
+func (it *SSTableIter) First() bool {
+	return it.loadBlock(0) && it.it.First()
+}
+
+func (it *SSTableIter) Last() bool {
+	return it.loadBlock(len(it.table.index)-1) && it.it.Last()
+}
+
+func (it *SSTableIter) Seek(k []byte) bool {
+	// last block starting with a key <= k, it's the only one which may hold k
+	i := sort.Search(len(it.table.index), func(i int) bool {
+		return bytes.Compare(it.table.index[i].firstKey, k) > 0
+	}) - 1
+
+	if !it.loadBlock(max(i, 0)) {
+		return false
+	}
+
+	if it.it.Seek(k) {
+		return true
+	}
+
+	if it.it.Err() != nil {
+		return false
 	}
 
-	entryIdx := block.index[i]
+	return it.loadBlock(it.blk+1) && it.it.First()
+}
 
-	entryBuf := make([]byte, entryIdx.len)
-	_, err = entryIdx.r.Read(entryBuf)
+func (it *SSTableIter) Next() bool {
+	if it.it == nil {
+		return false
+	}
+
+	if it.it.Next() {
+		return true
+	}
+
+	if it.it.Err() != nil {
+		return false
+	}
+
+	return it.loadBlock(it.blk+1) && it.it.First()
+}
+
+func (it *SSTableIter) Prev() bool {
+	if it.it == nil {
+		return false
+	}
+
+	if it.it.Prev() {
+		return true
+	}
+
+	if it.it.Err() != nil {
+		return false
+	}
+
+	return it.loadBlock(it.blk-1) && it.it.Last()
+}
+
+func (it *SSTableIter) Valid() bool {
+	return it.err == nil && it.it != nil && it.it.Valid()
+}
+
+func (it *SSTableIter) Value() Entry {
+	return it.it.Value()
+}
+
+func (it *SSTableIter) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	if it.it != nil {
+		return withBlockLocation(it.it.Err(), it.table.Path(),
+			int64(it.table.index[it.blk].offset))
+	}
+
+	return nil
+}
+
+func (it *SSTableIter) loadBlock(i int) bool {
+	it.blk = i
+	it.it = nil
+	if i < 0 || i >= len(it.table.index) {
+		return false
+	}
+
+	block, err := it.table.readBlock(i)
 	if err != nil {
-		return nil, err
+		it.err = err
+		return false
 	}
 
-	return EntryFromBytes(entryBuf).Value, nil
+	it.it = NewBlockIter(block)
+	return true
 }
 
+// SSTableFromReadonlyMemtable flushes memro into a L0 table.
 // TODO: localize Options
 func SSTableFromReadonlyMemtable(
 	memro ReadonlyMemtable,
 	path string,
 	opts Options,
 ) (SSTable, error) {
-	table := byteutil.NewSeqWriter[byte]()
-	tableIndex := byteutil.NewSeqWriter[byte]()
+	return flushMemtable(memro, path, opts, nil)
+}
+
+// flushMemtable is SSTableFromReadonlyMemtable which moves big values to blob
+// files of blobs, nil keeps them in the table.
+func flushMemtable(
+	memro ReadonlyMemtable,
+	path string,
+	opts Options,
+	blobs *blobWriter,
+) (SSTable, error) {
+	w, err := NewSSTableWriter(path, 0, opts)
+	if err != nil {
+		return SSTable{}, err
+	}
+	w.priority = IOPriorityHigh
+	w.blobs = blobs
+
+	memro.Range(func(entry Entry) bool {
+		err = w.Add(entry)
+		return err == nil
+	})
+	for _, t := range memro.table.rangeTombstones() {
+		w.AddRangeTombstone(t)
+	}
+
+	if err != nil {
+		w.Abort()
+		return SSTable{}, err
+	}
+
+	return w.Finish()
+}
+
+// SSTableWriter builds a sstable out of entries added in key order, versions
+// of a key from the newest to the oldest. Blocks are written to the file as
+// soon as they fill up, only the table index is kept in memory until Finish.
+// Versions of a key are never split between blocks, so lookups only ever
+// need one block.
+type SSTableWriter struct {
+	file       *os.File
+	opts       Options
+	format     FormatVersion // always the latest one, but tests need to write older ones
+	compressor Compressor    // nil when blocks are not compressed
+
+	// writes wait for the limiter of options, with ctx they give up
+	ctx      context.Context
+	priority IOPriority
+	// values of at least Options.BlobThreshold bytes go to blob files of
+	// blobs, nil keeps them in the table
+	blobs *blobWriter
+
+	offset     int // bytes written to the file so far
+	tableIndex byteutil.SeqWriter[byte]
+	keyHashes  []uint32 // for bloom filter
+
+	block               byteutil.SeqWriter[byte]
+	blockIndex          byteutil.SeqWriter[byte] // formats before FormatV3 only
+	restarts            []uint32                 // FormatV3 and later
+	entriesSinceRestart int
+	firstBlockKey       []byte
+	lastBlockKey        []byte
+	rangeDels           rangeTombstones
+}
+
+// NewSSTableWriter creates a table going to level (L0 is 0), which decides
+// how its blocks are compressed. Its writes are limited by
+// Options.RateLimiter with low priority.
+func NewSSTableWriter(path string, level int, opts Options) (*SSTableWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSTableWriter{
+		file:       file,
+		opts:       opts,
+		format:     formatLatest,
+		compressor: opts.compressor(level),
+		ctx:        context.Background(),
+		tableIndex: byteutil.NewSeqWriter[byte](),
+		block:      byteutil.NewSeqWriter[byte](),
+		blockIndex: byteutil.NewSeqWriter[byte](),
+	}, nil
+}
 
-	block := byteutil.NewSeqWriter[byte]()
-	blockIndex := byteutil.NewSeqWriter[byte]()
-	var firstBlockKey *string
+// Add appends an entry, its key must be greater than keys added before, or
+// equal to the last one for an older version of it.
+func (w *SSTableWriter) Add(entry Entry) error {
+	if len(entry.Key) == 0 {
+		return errors.New("sstable entry key cannot be empty")
+	}
 
-	memro.Range(func(key string, value []byte) bool {
-		if firstBlockKey == nil {
-			firstBlockKey = &key
+	if w.blobs != nil && w.opts.BlobThreshold > 0 && entry.Kind == KindValue &&
+		len(entry.Value) >= w.opts.BlobThreshold {
+		p, err := w.blobs.add(entry.Value)
+		if err != nil {
+			return err
 		}
+		entry.Kind, entry.Value = KindBlobIndex, p.Bytes()
+	}
 
-		startOffset := block.Offset()
+	if w.block.Len() == 0 || !bytes.Equal(entry.Key, w.lastBlockKey) {
+		// a full block is cut only once a new key comes
+		if w.block.Len() >= w.opts.BlockThreshold {
+			if err := w.flushBlock(); err != nil {
+				return err
+			}
+		}
+
+		if w.opts.BloomBitsPerKey > 0 {
+			w.keyHashes = append(w.keyHashes, bloomHash(entry.Key))
+		}
+	}
+
+	if w.block.Len() == 0 {
+		w.firstBlockKey = slices.Clone(entry.Key)
+		w.lastBlockKey = w.lastBlockKey[:0]
+	}
+
+	startOffset := w.block.Offset()
+	if w.format.prefixCompressed() {
+		// every BlockRestartInterval-th entry holds its key in full
+		prevKey := w.lastBlockKey
+		if len(w.restarts) == 0 || w.entriesSinceRestart >= w.opts.BlockRestartInterval {
+			w.restarts = append(w.restarts, uint32(startOffset))
+			w.entriesSinceRestart = 0
+			prevKey = nil
+		}
+		w.block.Write(appendEntry(nil, entry, prevKey, w.format))
+		w.entriesSinceRestart++
+	} else {
+		width := w.format.blockWidth()
 		// write entry
-		block.Write(byteutil.Uint16ToByteSlice(uint16(len(key))))
-		block.Write([]byte(key))
-		block.Write(byteutil.Uint16ToByteSlice(uint16(len(value))))
-		block.Write(value)
+		w.block.Write(appendEntry(nil, entry, nil, w.format))
 		// write index
-		blockIndex.Write(byteutil.Uint16ToByteSlice(
-			uint16(table.Offset() + block.Offset())))
-		blockIndex.Write(byteutil.Uint16ToByteSlice(
-			uint16(block.Offset() - startOffset)))
-
-		if block.Len() >= opts.BlockThreshold {
-			tableStartOffset := table.Offset()
-			meta := Meta{
-				DataOffset:  uint16(tableStartOffset),
-				DataLen:     uint16(block.Len()),
-				IndexOffset: uint16(tableStartOffset + block.Len()),
-				IndexLen:    uint16(blockIndex.Len()),
-			}
-			// write block data
-			table.Write(block.Slice())
-			// write block index
-			table.Write(blockIndex.Slice())
-			// write block meta
-			table.Write(byteutil.Uint16ToByteSlice(meta.DataOffset))
-			table.Write(byteutil.Uint16ToByteSlice(meta.DataLen))
-			table.Write(byteutil.Uint16ToByteSlice(meta.IndexOffset))
-			table.Write(byteutil.Uint16ToByteSlice(meta.IndexLen))
-
-			// write entry to table index: offset, len, first key, last key
-			tableIndex.Write(byteutil.Uint16ToByteSlice(uint16(tableStartOffset)))
-			tableIndex.Write(byteutil.Uint16ToByteSlice(uint16(block.Len())))
-
-			tableIndex.Write(
-				byteutil.Uint16ToByteSlice(uint16(len(*firstBlockKey))))
-			tableIndex.Write([]byte(*firstBlockKey))
-
-			tableIndex.Write(byteutil.Uint16ToByteSlice(uint16(len(key))))
-			tableIndex.Write([]byte(key))
-
-			firstBlockKey = nil
-			block = byteutil.NewSeqWriter[byte]()
-			blockIndex = byteutil.NewSeqWriter[byte]()
+		w.blockIndex.Write(appendUint(nil, uint64(startOffset), width))
+		w.blockIndex.Write(appendUint(nil, uint64(w.block.Offset()-startOffset), width))
+	}
+	w.lastBlockKey = append(w.lastBlockKey[:0], entry.Key...)
+	return nil
+}
+
+// AddRangeTombstone adds a range tombstone, they may come in any order and
+// along with entries in any order.
+func (w *SSTableWriter) AddRangeTombstone(t rangeTombstone) {
+	w.rangeDels = w.rangeDels.insert(t)
+}
+
+// Size is the number of bytes the table takes so far.
+func (w *SSTableWriter) Size() int {
+	size := w.offset + w.block.Len() + w.blockIndex.Len() + 4*len(w.restarts) +
+		w.tableIndex.Len() +
+		len(w.keyHashes)*w.opts.BloomBitsPerKey/8
+	for _, t := range w.rangeDels {
+		size += len(t.start) + len(t.end)
+	}
+
+	return size
+}
+
+// Finish writes the pending block, bloom filter, table index and meta, and
+// syncs the file.
+func (w *SSTableWriter) Finish() (SSTable, error) {
+	if w.block.Len() > 0 {
+		if err := w.flushBlock(); err != nil {
+			w.Abort()
+			return SSTable{}, err
 		}
+	}
 
-		return true
-	})
+	if len(w.rangeDels) > 0 {
+		if !w.format.hasRangeDels() {
+			w.Abort()
+			return SSTable{}, fmt.Errorf("format %d has no range tombstones", w.format)
+		}
 
-	file, err := os.Create(path)
-	if err != nil {
+		if err := w.write(encodeRangeDelBlock(w.rangeDels, w.format)); err != nil {
+			w.Abort()
+			return SSTable{}, err
+		}
+	}
+
+	dataLen := w.offset
+
+	var filter BloomFilter
+	if w.opts.BloomBitsPerKey > 0 {
+		filter = NewBloomFilter(w.keyHashes, w.opts.BloomBitsPerKey)
+		buf := []byte(filter)
+		if w.format.filterChecksummed() {
+			buf = appendChecksum(slices.Clip(buf))
+		}
+		if err := w.write(buf); err != nil {
+			w.Abort()
+			return SSTable{}, err
+		}
+	}
+
+	tableIndex := appendChecksum(w.tableIndex.Slice())
+	meta := Meta{
+		DataOffset:  0,
+		DataLen:     uint64(dataLen),
+		IndexOffset: uint64(w.offset),
+		IndexLen:    uint64(len(tableIndex)),
+	}
+
+	if err := w.write(tableIndex, appendFooter(nil, meta, w.format)); err != nil {
+		w.Abort()
 		return SSTable{}, err
 	}
 
-	r := bytes.NewReader(tableIndex.Slice())
+	if err := w.file.Sync(); err != nil {
+		w.Abort()
+		return SSTable{}, fmt.Errorf("syncing sstable: %w", err)
+	}
+
+	r := bytes.NewReader(tableIndex)
 	sr := io.NewSectionReader(r, 0, int64(r.Len()))
-	index, err := SSTIndexFromSectReader(sr, opts.BlockThreshold)
+	index, err := SSTIndexFromSectReader(sr, w.format)
 	if err != nil {
+		w.Abort()
 		return SSTable{}, err
 	}
 
-	meta := Meta{
-		DataOffset:  0,
-		DataLen:     uint16(table.Len()),
-		IndexOffset: uint16(table.Len()),
-		IndexLen:    uint16(tableIndex.Len()),
+	sst := newSSTable(w.file, index, filter, meta, w.format, w.opts.BlockCache)
+	sst.rangeDels = w.rangeDels
+	return sst, nil
+}
+
+// Abort drops the unfinished table.
+func (w *SSTableWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (w *SSTableWriter) flushBlock() error {
+	tableStartOffset := w.offset
+	if w.format.prefixCompressed() {
+		// write restart points and their number, then checksum of it all
+		for _, restart := range w.restarts {
+			w.block.Write(binary.LittleEndian.AppendUint32(nil, restart))
+		}
+		w.block.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(w.restarts))))
+	} else {
+		// offsets inside of a block are relative to the block start
+		meta := Meta{
+			DataOffset:  0,
+			DataLen:     uint64(w.block.Len()),
+			IndexOffset: uint64(w.block.Len()),
+			IndexLen:    uint64(w.blockIndex.Len()),
+		}
+		// write block data, block index and block meta, then checksum of it all
+		w.block.Write(w.blockIndex.Slice())
+		w.block.Write(appendMeta(nil, meta, w.format.blockWidth()))
+	}
+	block := w.block.Slice()
+	if w.format.compressed() {
+		var err error
+		if block, err = compressBlock(nil, block, w.compressor); err != nil {
+			return err
+		}
+	}
+
+	err := w.write(appendChecksum(block))
+	if err != nil {
+		return err
+	}
+
+	// write entry to table index: offset, len, first key, last key
+	w.tableIndex.Write(appendSSTIndexEntry(nil, SSTIndexEntry{
+		offset:   uint64(tableStartOffset),
+		len:      uint64(w.offset - tableStartOffset),
+		firstKey: w.firstBlockKey,
+		lastKey:  w.lastBlockKey,
+	}, w.format))
+
+	w.block = byteutil.NewSeqWriter[byte]()
+	w.blockIndex = byteutil.NewSeqWriter[byte]()
+	w.restarts = w.restarts[:0]
+	return nil
+}
+
+func (w *SSTableWriter) write(bufs ...[]byte) error {
+	if w.opts.RateLimiter != nil {
+		n := 0
+		for _, buf := range bufs {
+			n += len(buf)
+		}
+		if err := w.opts.RateLimiter.Wait(w.ctx, n, w.priority); err != nil {
+			return err
+		}
+	}
+
+	for _, buf := range bufs {
+		n, err := w.file.Write(buf)
+		w.offset += n
+		if err != nil {
+			return fmt.Errorf("writing sstable: %w", err)
+		}
 	}
 
-	return SSTable{file, index, meta}, nil
+	return nil
 }
 
-func SSTableFromFile(file *os.File) (SSTable, error) {
+// SSTableFromFile loads a table of any format version, its blocks are going
+// to be cached in cache (which may be nil).
+func SSTableFromFile(file *os.File, cache *BlockCache) (SSTable, error) {
 	stat, err := file.Stat()
 	if err != nil {
 		return SSTable{}, err
 	}
 
-	meta, err := MetaFromSectReader(
-		io.NewSectionReader(file, stat.Size()-MetaSize, MetaSize))
+	tail := make([]byte, min(stat.Size(), v2FooterSize))
+	tailOffset := stat.Size() - int64(len(tail))
+	if _, err := file.ReadAt(tail, tailOffset); err != nil {
+		return SSTable{}, fmt.Errorf("reading footer: %w", err)
+	}
+
+	meta, format, err := footerFromBytes(tail)
 	if err != nil {
-		return SSTable{}, err
+		return SSTable{}, withLocation(err, file.Name(), tailOffset)
+	}
+
+	footerOffset := stat.Size() - int64(format.footerSize())
+	if meta.IndexOffset+meta.IndexLen != uint64(footerOffset) ||
+		meta.DataOffset+meta.DataLen > meta.IndexOffset {
+		return SSTable{}, &CorruptionError{
+			File:   file.Name(),
+			Offset: footerOffset,
+			Reason: "footer doesn't match file layout",
+		}
 	}
 
 	index, err := SSTIndexFromSectReader(
-		io.NewSectionReader(file, int64(meta.IndexOffset), int64(meta.IndexLen)), 0)
+		io.NewSectionReader(file, int64(meta.IndexOffset), int64(meta.IndexLen)),
+		format)
 	if err != nil {
-		return SSTable{}, err
+		return SSTable{}, withLocation(err, file.Name(), int64(meta.IndexOffset))
 	}
 
-	return SSTable{file, index, meta}, nil
+	var filter BloomFilter
+	filterOffset := int64(meta.DataOffset + meta.DataLen)
+	if filterLen := int64(meta.IndexOffset) - filterOffset; filterLen > 0 {
+		filter = make(BloomFilter, filterLen)
+		if _, err := file.ReadAt(filter, filterOffset); err != nil {
+			return SSTable{}, fmt.Errorf("reading bloom filter: %w", err)
+		}
+
+		if format.filterChecksummed() {
+			body, ok := verifyChecksum(filter)
+			if !ok {
+				return SSTable{}, &CorruptionError{
+					File:   file.Name(),
+					Offset: filterOffset,
+					Reason: "bloom filter checksum mismatch",
+				}
+			}
+			filter = body
+		}
+	}
+
+	var rangeDels rangeTombstones
+	if format.hasRangeDels() {
+		// range tombstones take the rest of data after the last block
+		offset := meta.DataOffset
+		if len(index) > 0 {
+			offset = index[len(index)-1].offset + index[len(index)-1].len
+		}
+		if offset > meta.DataOffset+meta.DataLen {
+			return SSTable{}, &CorruptionError{
+				File:   file.Name(),
+				Offset: int64(offset),
+				Reason: "index doesn't match table meta",
+			}
+		}
+
+		if n := meta.DataOffset + meta.DataLen - offset; n > 0 {
+			buf := make([]byte, n)
+			if _, err := file.ReadAt(buf, int64(offset)); err != nil {
+				return SSTable{}, fmt.Errorf("reading range tombstones: %w", err)
+			}
+
+			if rangeDels, err = rangeDelBlockFromBytes(buf, format); err != nil {
+				return SSTable{}, withLocation(err, file.Name(), int64(offset))
+			}
+		}
+	}
+
+	sst := newSSTable(file, index, filter, meta, format, cache)
+	sst.rangeDels = rangeDels
+	return sst, nil
 }
 
-// TODO: blocksLen (pass it as opts?)
-func SSTIndexFromSectReader(r *io.SectionReader, blocksLen int) (SSTIndex, error) {
-	buf := make([]byte, 0, r.Size())
-	_, err := r.Read(buf)
+// SSTIndexFromSectReader verifies the index checksum and parses the index.
+// Broken index is reported with a *CorruptionError, its offset is relative to
+// r.
+func SSTIndexFromSectReader(r *io.SectionReader, format FormatVersion) (SSTIndex, error) {
+	buf := make([]byte, r.Size())
+	_, err := io.ReadFull(r, buf)
 	if err != nil {
 		return nil, err
 	}
 
-	// FIXME: count by blocksLen
+	buf, ok := verifyChecksum(buf)
+	if !ok {
+		return nil, &CorruptionError{Reason: "index checksum mismatch"}
+	}
+
 	indexVals := make(SSTIndex, 0)
-	for left := r.Size(); left > 0; {
-		val, read, err := SSTIndexValueFromBytes(buf)
+	for off := 0; off < len(buf); {
+		val, read, err := SSTIndexValueFromBytes(buf[off:], format)
 		if err != nil {
-			return nil, err
+			return nil, &CorruptionError{Offset: int64(off), Reason: err.Error()}
 		}
 
 		indexVals = append(indexVals, val)
-		buf = buf[read:]
-		left -= int64(read)
+		off += read
 	}
 
 	return indexVals, nil
@@ -244,65 +817,74 @@ func SSTIndexFromSectReader(r *io.SectionReader, blocksLen int) (SSTIndex, error
 
 type SSTIndex []SSTIndexEntry
 
+// on disk SSTIndexEntry representation:
+// ---------------------------------------------------------------------
+// | offset | len | first_key_len | first_key | last_key_len | last_key |
+// ---------------------------------------------------------------------
+// numbers are 2B in FormatV1 and uvarints since FormatV2.
 type SSTIndexEntry struct {
-	offset   uint16
-	len      uint16
+	offset   uint64
+	len      uint64
 	firstKey []byte
 	lastKey  []byte
 }
 
-func SSTIndexValueFromBytes(b []byte) (idxval SSTIndexEntry, read int, err error) {
-	idxval = SSTIndexEntry{}
-
-	// read offset and len
-	idxval.offset = binary.LittleEndian.Uint16(b)
-	b = b[2:]
-	idxval.len = binary.LittleEndian.Uint16(b)
-	b = b[2:]
-
-	// read first and last keys
-	firstKey, fread := keyFromBytes(b)
-	b = b[read:]
-	lastKey, lread := keyFromBytes(b)
+var errBadIndexEntry = errors.New("malformed index entry")
 
-	idxval.firstKey = firstKey
-	idxval.lastKey = lastKey
+func appendSSTIndexEntry(buf []byte, e SSTIndexEntry, f FormatVersion) []byte {
+	if f == FormatV1 {
+		buf = appendUint(buf, e.offset, 2)
+		buf = appendUint(buf, e.len, 2)
+	} else {
+		buf = binary.AppendUvarint(buf, e.offset)
+		buf = binary.AppendUvarint(buf, e.len)
+	}
 
-	return idxval, int(fread + lread + 2 + 2), nil
+	buf = appendLen(buf, len(e.firstKey), f)
+	buf = append(buf, e.firstKey...)
+	buf = appendLen(buf, len(e.lastKey), f)
+	return append(buf, e.lastKey...)
 }
 
-const MetaSize = 8
-
-type Meta struct {
-	DataOffset  uint16
-	DataLen     uint16
-	IndexOffset uint16
-	IndexLen    uint16
-	//LastKeyOffset uint16
-}
+func SSTIndexValueFromBytes(b []byte, f FormatVersion) (idxval SSTIndexEntry, read int, err error) {
+	idxval = SSTIndexEntry{}
+	rest := b
 
-func MetaFromSectReader(r *io.SectionReader) (Meta, error) {
-	if r.Size() != MetaSize {
-		return Meta{}, fmt.Errorf("meta must be 8 bytes long")
+	// read offset and len
+	if f == FormatV1 {
+		if len(rest) < 4 {
+			return SSTIndexEntry{}, 0, errBadIndexEntry
+		}
+		idxval.offset = uintFromBytes(rest, 2)
+		idxval.len = uintFromBytes(rest[2:], 2)
+		rest = rest[4:]
+	} else {
+		var n int
+		if idxval.offset, n = binary.Uvarint(rest); n <= 0 {
+			return SSTIndexEntry{}, 0, errBadIndexEntry
+		}
+		rest = rest[n:]
+		if idxval.len, n = binary.Uvarint(rest); n <= 0 {
+			return SSTIndexEntry{}, 0, errBadIndexEntry
+		}
+		rest = rest[n:]
 	}
 
-	buf := make([]byte, 0, MetaSize)
-	_, err := r.Read(buf)
-	if err != nil {
-		return Meta{}, err
+	// read first and last keys
+	if idxval.firstKey, rest, err = lenPrefixed(rest, f); err != nil {
+		return SSTIndexEntry{}, 0, errBadIndexEntry
+	}
+	if idxval.lastKey, rest, err = lenPrefixed(rest, f); err != nil {
+		return SSTIndexEntry{}, 0, errBadIndexEntry
 	}
 
-	meta := Meta{}
-
-	meta.DataOffset = binary.LittleEndian.Uint16(buf)
-	buf = buf[2:]
-	meta.DataLen = binary.LittleEndian.Uint16(buf)
-	buf = buf[2:]
-	meta.IndexOffset = binary.LittleEndian.Uint16(buf)
-	buf = buf[2:]
-	meta.IndexLen = binary.LittleEndian.Uint16(buf)
-	//buf = buf[2:]
-	//meta.LastKeyOffset = binary.LittleEndian.Uint16(buf)
+	return idxval, len(b) - len(rest), nil
+}
 
-	return meta, nil
+// Meta holds offsets and lengths of data and index of a block or a table.
+type Meta struct {
+	DataOffset  uint64
+	DataLen     uint64
+	IndexOffset uint64
+	IndexLen    uint64
 }
@@ -0,0 +1,329 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flipByte corrupts one byte of the file at off.
+func flipByte(t *testing.T, p string, off int64) {
+	f, err := os.OpenFile(p, os.O_RDWR, 0666)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, off)
+	assert.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, off)
+	assert.NoError(t, err)
+}
+
+func TestSSTableGetCorruptedBlock(t *testing.T) {
+	// arrange
+	sst := testSSTable(t, "corrupted.sst", put("a", "1"), put("b", "2"))
+	flipByte(t, sst.Path(), 3)
+
+	// act
+	_, err := sst.Get([]byte("a"))
+
+	// assert
+	assert.ErrorIs(t, err, ErrCorruption)
+
+	var cerr *CorruptionError
+	assert.ErrorAs(t, err, &cerr)
+	assert.Equal(t, sst.Path(), cerr.File)
+	assert.Equal(t, int64(0), cerr.Offset)
+}
+
+func TestSSTableGetCorruptedEntry(t *testing.T) {
+	// arrange
+	entries := prefixedEntries(50)
+	sst := testSSTable(t, "corrupted.sst", entries...)
+
+	// the block passes its checksum, but its second entry makes no sense
+	block, err := sst.readBlock(0)
+	assert.NoError(t, err)
+	it := NewBlockIter(block)
+	assert.True(t, it.First())
+	assert.True(t, it.Next())
+	corrupted := Block{
+		data:     bytes.Clone(block.data),
+		restarts: block.restarts,
+		format:   block.format,
+	}
+	corrupted.data[it.off] = 0xff
+	sst.cache = NewBlockCache(1 << 20)
+	sst.cache.Put(blockCacheKey{sst.id, sst.index[0].offset}, &corrupted,
+		corrupted.size())
+
+	// act
+	_, err = sst.Get(entries[1].Key)
+
+	// assert
+	// the offset within the block is of its decompressed body, the file
+	// offset is the block's
+	assert.ErrorIs(t, err, ErrCorruption)
+
+	var cerr *CorruptionError
+	assert.ErrorAs(t, err, &cerr)
+	assert.Equal(t, sst.Path(), cerr.File)
+	assert.Equal(t, int64(sst.index[0].offset), cerr.Offset)
+	assert.Contains(t, cerr.Reason, fmt.Sprintf("at %d in the block", it.off))
+}
+
+func TestSSTableFromFileCorruptedFooter(t *testing.T) {
+	// arrange
+	sst := testSSTable(t, "corrupted.sst", put("a", "1"))
+	flipByte(t, sst.Path(), int64(sst.Size())-v2FooterSize+1)
+
+	f, err := os.Open(sst.Path())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// act
+	_, err = SSTableFromFile(f, nil)
+
+	// assert
+	assert.ErrorIs(t, err, ErrCorruption)
+
+	var cerr *CorruptionError
+	assert.ErrorAs(t, err, &cerr)
+	assert.Equal(t, sst.Path(), cerr.File)
+	assert.Equal(t, int64(sst.Size())-v2FooterSize, cerr.Offset)
+}
+
+func TestSSTableFromFileCorruptedIndex(t *testing.T) {
+	// arrange
+	sst := testSSTable(t, "corrupted.sst", put("a", "1"))
+	flipByte(t, sst.Path(), int64(sst.meta.IndexOffset)+1)
+
+	f, err := os.Open(sst.Path())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// act
+	_, err = SSTableFromFile(f, nil)
+
+	// assert
+	assert.ErrorIs(t, err, ErrCorruption)
+
+	var cerr *CorruptionError
+	assert.ErrorAs(t, err, &cerr)
+	assert.Equal(t, int64(sst.meta.IndexOffset), cerr.Offset)
+}
+
+func TestSSTableFromFileCorruptedFilter(t *testing.T) {
+	// arrange
+	sst := testSSTable(t, "corrupted.sst", put("a", "1"))
+	filterOffset := int64(sst.meta.DataOffset + sst.meta.DataLen)
+	flipByte(t, sst.Path(), filterOffset)
+
+	f, err := os.Open(sst.Path())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// act
+	_, err = SSTableFromFile(f, nil)
+
+	// assert
+	assert.ErrorIs(t, err, ErrCorruption)
+
+	var cerr *CorruptionError
+	assert.ErrorAs(t, err, &cerr)
+	assert.Equal(t, sst.Path(), cerr.File)
+	assert.Equal(t, filterOffset, cerr.Offset)
+}
+
+func TestSSTableReadsUnchecksummedFilter(t *testing.T) {
+	// arrange
+	w, err := NewSSTableWriter(path.Join(t.TempDir(), "v6.sst"), 0, *DefaultOptions)
+	assert.NoError(t, err)
+	w.format = FormatV6
+	assert.NoError(t, w.Add(put("a", "1")))
+	sst, err := w.Finish()
+	assert.NoError(t, err)
+
+	f, err := os.Open(sst.Path())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// act
+	reopened, err := SSTableFromFile(f, nil)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, sst.filter, reopened.filter)
+	assert.True(t, reopened.MayContain([]byte("a")))
+}
+
+func TestSSTableLargeValues(t *testing.T) {
+	// arrange
+	big := bytes.Repeat([]byte("v"), 1<<17)
+	entries := make([]Entry, 0, 4)
+	for i := 0; i < 4; i++ {
+		entries = append(entries, put("key"+strconv.Itoa(i), string(big)))
+	}
+	sst := testSSTable(t, "large.sst", entries...)
+
+	f, err := os.Open(sst.Path())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// act
+	reopened, err := SSTableFromFile(f, nil)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, formatLatest, reopened.format)
+	assert.Greater(t, reopened.Size(), uint(4<<17))
+
+	for i := 0; i < 4; i++ {
+		v, err := reopened.Get([]byte("key" + strconv.Itoa(i)))
+		assert.NoError(t, err)
+		assert.Equal(t, big, v)
+	}
+}
+
+func TestSSTableReadsFormatV1(t *testing.T) {
+	// arrange
+	w, err := NewSSTableWriter(path.Join(t.TempDir(), "v1.sst"), 0, *DefaultOptions)
+	assert.NoError(t, err)
+	w.format = FormatV1
+
+	for _, e := range []Entry{put("a", "1"), del("b"), put("c", "3")} {
+		assert.NoError(t, w.Add(e))
+	}
+	sst, err := w.Finish()
+	assert.NoError(t, err)
+
+	f, err := os.Open(sst.Path())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// act
+	reopened, err := SSTableFromFile(f, nil)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, FormatV1, reopened.format)
+
+	v, err := reopened.Get([]byte("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), v)
+	_, err = reopened.Get([]byte("b"))
+	assert.ErrorIs(t, err, ErrKeyDeleted)
+
+	keys := make([]string, 0)
+	it := reopened.Iter()
+	for ok := it.First(); ok; ok = it.Next() {
+		keys = append(keys, string(it.Value().Key))
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{"a", "b", "c"}, keys)
+}
+
+// writeSSTable writes entries into a table of format f, with one block
+// holding many restart points.
+func writeSSTable(t *testing.T, name string, f FormatVersion, entries ...Entry) *SSTable {
+	opts := *DefaultOptions
+	opts.BlockThreshold = 1 << 12
+	opts.BlockRestartInterval = 4
+
+	w, err := NewSSTableWriter(path.Join(t.TempDir(), name), 0, opts)
+	assert.NoError(t, err)
+	w.format = f
+
+	for _, e := range entries {
+		assert.NoError(t, w.Add(e))
+	}
+	sst, err := w.Finish()
+	assert.NoError(t, err)
+
+	return &sst
+}
+
+func prefixedEntries(n int) []Entry {
+	entries := make([]Entry, 0, n)
+	for i := 0; i < n; i++ {
+		entries = append(entries, put(fmt.Sprintf("rec_com_ns_pk_%04d", i), strconv.Itoa(i)))
+	}
+
+	return entries
+}
+
+func TestSSTablePrefixCompression(t *testing.T) {
+	// arrange
+	entries := prefixedEntries(50)
+
+	// act
+	v2 := writeSSTable(t, "v2.sst", FormatV2, entries...)
+	v3 := writeSSTable(t, "v3.sst", FormatV3, entries...)
+
+	// assert
+	assert.Less(t, v3.meta.DataLen, v2.meta.DataLen)
+
+	for _, e := range entries {
+		v, err := v3.Get(e.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, e.Value, v)
+	}
+
+	_, err := v3.Get([]byte("rec_com_ns_pk_0010a"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
+
+func TestSSTableIterAcrossRestartPoints(t *testing.T) {
+	// arrange
+	entries := prefixedEntries(10)
+	sst := writeSSTable(t, "restarts.sst", FormatV3, entries...)
+	it := sst.Iter()
+
+	// act & assert
+	assert.True(t, it.Last())
+	assert.Equal(t, entries[9].Key, it.Value().Key)
+
+	keys := make([]string, 0)
+	for ok := it.Seek([]byte("rec_com_ns_pk_0005")); ok; ok = it.Prev() {
+		keys = append(keys, string(it.Value().Key))
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{
+		"rec_com_ns_pk_0005", "rec_com_ns_pk_0004", "rec_com_ns_pk_0003",
+		"rec_com_ns_pk_0002", "rec_com_ns_pk_0001", "rec_com_ns_pk_0000",
+	}, keys)
+
+	assert.True(t, it.Seek([]byte("rec_com_ns_pk_0003a")))
+	assert.Equal(t, entries[4].Key, it.Value().Key)
+	assert.True(t, it.Next())
+	assert.Equal(t, entries[5].Key, it.Value().Key)
+}
+
+func TestSSTableReadsFormatV2(t *testing.T) {
+	// arrange
+	entries := prefixedEntries(10)
+	sst := writeSSTable(t, "v2.sst", FormatV2, entries...)
+
+	f, err := os.Open(sst.Path())
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// act
+	reopened, err := SSTableFromFile(f, nil)
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, FormatV2, reopened.format)
+
+	for _, e := range entries {
+		v, err := reopened.Get(e.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, e.Value, v)
+	}
+}
@@ -0,0 +1,104 @@
+package lsm
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// writeStall is how much writes are held back for compaction to catch up.
+type writeStall int
+
+const (
+	writeOK writeStall = iota
+	// each write waits for Options.SlowdownDelay
+	writeSlowdown
+	// writes wait until flushes or compactions make room
+	writeStop
+)
+
+// WriteStallStats counts writes held back for compaction to catch up since the
+// tree was opened.
+type WriteStallStats struct {
+	Slowdowns    uint64 // writes delayed by Options.SlowdownDelay
+	Stops        uint64 // writes which waited for compaction
+	SlowdownTime time.Duration
+	StopTime     time.Duration
+}
+
+type stallStats struct {
+	slowdowns    atomic.Uint64
+	stops        atomic.Uint64
+	slowdownTime atomic.Int64
+	stopTime     atomic.Int64
+}
+
+// stall tells how much writes should be held back now. Writes stop when the
+// memtable is full and there is no room in memro to make it readonly, as well
+// as when L0 has StopL0Tables tables. Caller must hold rodataGuard, the
+// memtable size may be read alongside writers applying to it.
+func (tree *LSMTree) stall() writeStall {
+	o := tree.opt
+	memFull := tree.mem.Size() >= o.MemtableThreshold
+
+	switch {
+	case memFull && len(tree.memro) >= o.MaxMemroTables,
+		o.StopL0Tables > 0 && len(tree.lvl0) >= o.StopL0Tables:
+		return writeStop
+	case o.SlowdownMemroTables > 0 && len(tree.memro) >= o.SlowdownMemroTables,
+		o.SlowdownL0Tables > 0 && len(tree.lvl0) >= o.SlowdownL0Tables:
+		return writeSlowdown
+	}
+
+	return writeOK
+}
+
+// waitStall holds a write back: a slowed down write just sleeps, a stopped
+// one waits for the tree to change, changed is closed then.
+func (tree *LSMTree) waitStall(
+	ctx context.Context,
+	stall writeStall,
+	changed <-chan struct{},
+) error {
+	start := time.Now()
+
+	if stall == writeSlowdown {
+		tree.stalls.slowdowns.Add(1)
+		defer func() { tree.stalls.slowdownTime.Add(int64(time.Since(start))) }()
+
+		timer := time.NewTimer(tree.opt.SlowdownDelay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	slog.Debug("writes stopped, waiting on compaction")
+	tree.stalls.stops.Add(1)
+	defer func() { tree.stalls.stopTime.Add(int64(time.Since(start))) }()
+
+	// compaction may be idle when L0 is over the limit, make sure it runs
+	tree.compact.trigger()
+	select {
+	case <-changed:
+		return nil
+	case <-tree.compact.stopc:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriteStallStats reports how much writes were held back for compaction.
+func (tree *LSMTree) WriteStallStats() WriteStallStats {
+	return WriteStallStats{
+		Slowdowns:    tree.stalls.slowdowns.Load(),
+		Stops:        tree.stalls.stops.Load(),
+		SlowdownTime: time.Duration(tree.stalls.slowdownTime.Load()),
+		StopTime:     time.Duration(tree.stalls.stopTime.Load()),
+	}
+}
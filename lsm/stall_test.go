@@ -0,0 +1,157 @@
+package lsm
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stoppedCompactorTree opens a tree which compactor is gone, so nothing is
+// ever flushed.
+func stoppedCompactorTree(t *testing.T, opts *Options) *LSMTree {
+	ctx, cancel := context.WithCancel(context.Background())
+	tree, err := Recover(ctx, t.TempDir(), opts)
+	assert.NoError(t, err)
+	cancel()
+	<-tree.compact.donec
+
+	return tree
+}
+
+func TestPutContextStopped(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 5
+	opts.MaxMemroTables = 1
+	tree := stoppedCompactorTree(t, &opts)
+	defer tree.Close()
+
+	full := bytes.Repeat([]byte("x"), 1<<5)
+	// the first memtable goes to memro, the second one has nowhere to go
+	assert.NoError(t, tree.Put([]byte("a"), full))
+	assert.NoError(t, tree.Put([]byte("b"), full))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// act
+	err := tree.PutContext(ctx, []byte("c"), []byte("1"))
+
+	// assert
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = tree.Get([]byte("c"))
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+
+	stats := tree.WriteStallStats()
+	assert.Equal(t, uint64(1), stats.Stops)
+	assert.GreaterOrEqual(t, stats.StopTime, 20*time.Millisecond)
+}
+
+func TestPutSlowdown(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 5
+	opts.MaxMemroTables = 2
+	opts.SlowdownMemroTables = 1
+	opts.SlowdownDelay = 10 * time.Millisecond
+	tree := stoppedCompactorTree(t, &opts)
+	defer tree.Close()
+
+	assert.NoError(t, tree.Put([]byte("a"), bytes.Repeat([]byte("x"), 1<<5)))
+	assert.NoError(t, tree.Put([]byte("b"), []byte("1")))
+	slowdowns := tree.WriteStallStats().Slowdowns
+
+	// act
+	start := time.Now()
+	err := tree.Put([]byte("c"), []byte("1"))
+
+	// assert
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+	assert.Equal(t, uint64(0), slowdowns)
+
+	stats := tree.WriteStallStats()
+	assert.Equal(t, uint64(1), stats.Slowdowns)
+	assert.GreaterOrEqual(t, stats.SlowdownTime, 10*time.Millisecond)
+	assert.Zero(t, stats.Stops)
+}
+
+func TestWritesResumeOnceL0Shrinks(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 5
+	opts.MaxMemroTables = 1
+	opts.MaxL0Tables = 0
+	opts.SlowdownL0Tables = 0
+	opts.StopL0Tables = 2
+
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	// flushes go on while compaction is paused, so L0 grows until writes
+	// stop, then compaction is resumed
+	assert.NoError(t, tree.PauseCompaction(context.Background()))
+	go func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for tree.WriteStallStats().Stops == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		tree.ResumeCompaction()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// act
+	for i := 0; i < 50; i++ {
+		k := []byte("key" + strconv.Itoa(i))
+		assert.NoError(t, tree.PutContext(ctx, k, bytes.Repeat([]byte("x"), 1<<5)))
+	}
+
+	// assert
+	assert.NotZero(t, tree.WriteStallStats().Stops)
+	assert.NotZero(t, tree.CompactionProgress().Compactions)
+	for i := 0; i < 50; i++ {
+		_, err := tree.Get([]byte("key" + strconv.Itoa(i)))
+		assert.NoError(t, err)
+	}
+}
+
+func TestConcurrentWritesStall(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.MemtableThreshold = 1 << 8
+	opts.MaxMemroTables = 2
+	opts.SlowdownMemroTables = 1
+	opts.SlowdownDelay = time.Millisecond
+	tree, err := Recover(context.Background(), t.TempDir(), &opts)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	// act
+	// writers tell whether to stall while others fill the memtable
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				k := []byte(strconv.Itoa(w) + "_" + strconv.Itoa(i))
+				assert.NoError(t, tree.Put(k, bytes.Repeat([]byte("x"), 32)))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// assert
+	for w := 0; w < 4; w++ {
+		_, err := tree.Get([]byte(strconv.Itoa(w) + "_49"))
+		assert.NoError(t, err)
+	}
+}
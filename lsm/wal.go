@@ -1,3 +1,478 @@
 package lsm
 
-type Wal struct{}
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WalSyncPolicy int
+
+const (
+	// fsync after every append, nothing acknowledged is ever lost
+	WalSyncAlways WalSyncPolicy = iota
+	// fsync at most once per Options.WalSyncInterval, a crash of the machine
+	// (not just the process) may lose the writes of the last interval. Appends
+	// are fsynced in the background once the interval passes, even when
+	// nothing is appended after them
+	WalSyncBatch
+	// never fsync explicitly, leave it to the os
+	WalSyncNone
+)
+
+const (
+	walSegmentExt = ".log"
+	walHeaderSize = 8 // len (4B) + crc (4B)
+)
+
+type walRecordType byte
+
+const (
+	walRecordPut walRecordType = iota + 1
+	walRecordDel
+	walRecordBatch    // see encodeWalBatch
+	walRecordSeqBatch // a batch with sequence numbers
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Wal is a segmented write-ahead log sitting in front of the active memtable.
+// Every Put is appended to the active segment before it touches the memtable,
+// so an acknowledged write survives a crash and is replayed by Recover.
+//
+// Segments are files named by an increasing number inside the wal directory.
+// When the memtable is rotated to memro the active segment is sealed and a
+// new one is started. Once that memtable is flushed to an L0 sstable, the
+// sealed segment and everything before it is removed.
+//
+// on disk record representation:
+// ------------------------------------------------------------
+// |                       Record #1                    | ... |
+// ------------------------------------------------------------
+// | payload_len (4B) | crc32c (4B) | payload (varlen) | ... |
+// ------------------------------------------------------------
+// | type (1B) | key_len (uvarint) | key | value_len (uvarint) | value |
+// ------------------------------------------------------------
+// deletions are stored with an empty value. A WriteBatch is a single record
+// holding all of its writes (see encodeWalBatch), the tree writes even
+// single writes as batches as they carry sequence numbers.
+// the checksum covers the payload only. A record which is cut short or doesn't
+// match its checksum is treated as a torn tail, replay of the segment stops
+// there.
+type Wal struct {
+	dir    string
+	mu     sync.Mutex
+	f      *os.File
+	seg    uint64 // number of the active segment
+	size   int    // bytes written to the active segment
+	dirty  bool   // there are appends not yet fsynced
+	synced time.Time
+	opt    Options
+	// the background sync of WalSyncBatch, nil with other policies
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+// OpenWal opens the wal in dir, creating it when needed. Segments which are
+// already in dir are left for Replay, appends go to a fresh segment.
+func OpenWal(dir string, opts Options) (*Wal, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("making wal dir: %w", err)
+	}
+
+	segs, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Wal{dir: dir, opt: opts, synced: time.Now()}
+	if len(segs) > 0 {
+		w.seg = segs[len(segs)-1]
+	}
+
+	if err := w.open(w.seg + 1); err != nil {
+		return nil, err
+	}
+
+	if opts.WalSync == WalSyncBatch && opts.WalSyncInterval > 0 {
+		w.stopSync = make(chan struct{})
+		w.syncDone = make(chan struct{})
+		go w.syncPeriodically()
+	}
+
+	return w, nil
+}
+
+// syncPeriodically fsyncs appends of WalSyncBatch every WalSyncInterval, so
+// the last appends before writes go quiet don't wait for the next append.
+func (w *Wal) syncPeriodically() {
+	defer close(w.syncDone)
+
+	ticker := time.NewTicker(w.opt.WalSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopSync:
+			return
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				slog.Error("syncing wal in background", "err", err)
+			}
+		}
+	}
+}
+
+func (w *Wal) Append(k, v []byte) error {
+	return w.append(encodeWalRecord(walRecordPut, k, v))
+}
+
+func (w *Wal) AppendDelete(k []byte) error {
+	return w.append(encodeWalRecord(walRecordDel, k, nil))
+}
+
+// AppendBatch appends entries as a single record, so they are replayed
+// either all or none. Entries must be numbered by consecutive seqs.
+func (w *Wal) AppendBatch(entries []Entry) error {
+	return w.append(encodeWalBatch(entries))
+}
+
+func (w *Wal) append(rec []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.opt.WalSegmentSize > 0 && w.size > 0 &&
+		w.size+len(rec) > w.opt.WalSegmentSize {
+		if err := w.roll(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.f.Write(rec); err != nil {
+		return fmt.Errorf("appending to wal: %w", err)
+	}
+	w.size += len(rec)
+	w.dirty = true
+
+	switch w.opt.WalSync {
+	case WalSyncAlways:
+		return w.sync()
+	case WalSyncBatch:
+		if time.Since(w.synced) >= w.opt.WalSyncInterval {
+			return w.sync()
+		}
+	}
+
+	return nil
+}
+
+// Rotate seals the active segment and starts a new one. Returned is the number
+// of the sealed segment: once everything written before the rotation is
+// persisted elsewhere, it can be passed to Release.
+func (w *Wal) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sealed := w.seg
+	return sealed, w.roll()
+}
+
+// Release removes every sealed segment up to and including seg.
+func (w *Wal) Release(seg uint64) error {
+	w.mu.Lock()
+	active := w.seg
+	w.mu.Unlock()
+
+	segs, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segs {
+		if s > seg || s >= active {
+			break
+		}
+
+		if err := os.Remove(w.segmentPath(s)); err != nil {
+			return fmt.Errorf("removing wal segment: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Replay feeds every record of the segments left by a previous run to f, in
+// the order they were appended.
+func (w *Wal) Replay(f func(e Entry) error) error {
+	w.mu.Lock()
+	active := w.seg
+	w.mu.Unlock()
+
+	segs, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segs {
+		if s >= active {
+			break
+		}
+
+		if err := replayWalSegment(w.segmentPath(s), f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.sync()
+}
+
+// Close syncs and closes the active segment, it's removed if nothing was
+// written to it.
+func (w *Wal) Close() error {
+	if w.stopSync != nil {
+		close(w.stopSync)
+		<-w.syncDone
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	if w.size == 0 {
+		return os.Remove(w.segmentPath(w.seg))
+	}
+
+	return nil
+}
+
+func replayWalSegment(p string, f func(e Entry) error) error {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("reading wal segment: %w", err)
+	}
+
+	for off := 0; off < len(buf); {
+		payload, read, ok := walRecordFromBytes(buf[off:])
+		if !ok {
+			slog.Warn("torn wal record, skipping the rest of segment",
+				"segment", p, "offset", off)
+			return nil
+		}
+
+		entries, err := decodeWalRecord(payload)
+		if err != nil {
+			return fmt.Errorf("wal segment %s at %d: %w", p, off, err)
+		}
+
+		for _, entry := range entries {
+			if err := f(entry); err != nil {
+				return err
+			}
+		}
+
+		off += read
+	}
+
+	return nil
+}
+
+func (w *Wal) roll() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	return w.open(w.seg + 1)
+}
+
+func (w *Wal) open(seg uint64) error {
+	f, err := os.OpenFile(w.segmentPath(seg),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("opening wal segment: %w", err)
+	}
+
+	// fsyncing appends doesn't persist the dir entry of the new segment,
+	// without it the segment may be gone after a crash
+	if err := syncDir(w.dir); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing wal dir: %w", err)
+	}
+
+	w.f = f
+	w.seg = seg
+	w.size = 0
+	return nil
+}
+
+func (w *Wal) sync() error {
+	if !w.dirty {
+		return nil
+	}
+
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("syncing wal: %w", err)
+	}
+
+	w.dirty = false
+	w.synced = time.Now()
+	return nil
+}
+
+func (w *Wal) segmentPath(seg uint64) string {
+	return walSegmentPath(w.dir, seg)
+}
+
+func walSegmentPath(dir string, seg uint64) string {
+	return path.Join(dir, fmt.Sprintf("%06d%s", seg, walSegmentExt))
+}
+
+// walSegments lists segment numbers found in dir in ascending order.
+func walSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing wal dir: %w", err)
+	}
+
+	segs := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), walSegmentExt)
+		if !ok {
+			continue
+		}
+
+		seg, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segs = append(segs, seg)
+	}
+
+	slices.Sort(segs)
+	return segs, nil
+}
+
+func encodeWalRecord(typ walRecordType, k, v []byte) []byte {
+	payload := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(k)+len(v))
+
+	payload = append(payload, byte(typ))
+	payload = binary.AppendUvarint(payload, uint64(len(k)))
+	payload = append(payload, k...)
+	payload = binary.AppendUvarint(payload, uint64(len(v)))
+	payload = append(payload, v...)
+
+	return frameRecord(payload)
+}
+
+// frameRecord prepends payload with its length and checksum, the manifest
+// uses the same framing.
+func frameRecord(payload []byte) []byte {
+	rec := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(rec, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(payload, crcTable))
+
+	return append(rec, payload...)
+}
+
+// walRecordFromBytes cuts the first record off b. ok is false when the record
+// is incomplete or its checksum doesn't match.
+func walRecordFromBytes(b []byte) (payload []byte, read int, ok bool) {
+	if len(b) < walHeaderSize {
+		return nil, 0, false
+	}
+
+	plen := int(binary.LittleEndian.Uint32(b))
+	crc := binary.LittleEndian.Uint32(b[4:])
+	if len(b)-walHeaderSize < plen {
+		return nil, 0, false
+	}
+
+	payload = b[walHeaderSize : walHeaderSize+plen]
+	if crc32.Checksum(payload, crcTable) != crc {
+		return nil, 0, false
+	}
+
+	return payload, walHeaderSize + plen, true
+}
+
+var errBadWalPayload = errors.New("malformed wal record")
+
+// decodeWalRecord decodes the payload of a record of any type into entries.
+func decodeWalRecord(p []byte) ([]Entry, error) {
+	if len(p) > 0 && (walRecordType(p[0]) == walRecordBatch ||
+		walRecordType(p[0]) == walRecordSeqBatch) {
+		return decodeWalBatch(walRecordType(p[0]), p[1:])
+	}
+
+	typ, k, v, err := decodeWalPayload(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case walRecordPut:
+		return []Entry{{Key: k, Value: v, Kind: KindValue}}, nil
+	case walRecordDel:
+		return []Entry{{Key: k, Kind: KindTombstone}}, nil
+	default:
+		return nil, fmt.Errorf("unknown record type %d", typ)
+	}
+}
+
+func decodeWalPayload(p []byte) (typ walRecordType, k, v []byte, err error) {
+	if len(p) == 0 {
+		return 0, nil, nil, errBadWalPayload
+	}
+
+	typ = walRecordType(p[0])
+	p = p[1:]
+
+	k, p, err = uvarintPrefixed(p)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	v, _, err = uvarintPrefixed(p)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	return typ, k, v, nil
+}
+
+func uvarintPrefixed(p []byte) (field, rest []byte, err error) {
+	n, read := binary.Uvarint(p)
+	if read <= 0 || uint64(len(p)-read) < n {
+		return nil, nil, errBadWalPayload
+	}
+
+	p = p[read:]
+	return p[:n], p[n:], nil
+}
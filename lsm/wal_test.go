@@ -0,0 +1,137 @@
+package lsm
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalReplay(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	wal, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Append([]byte("a"), []byte("1")))
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Append([]byte("b"), []byte("")))
+	assert.NoError(t, wal.Close())
+
+	// act
+	reopened, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	replayed := make(map[string]string)
+	err = reopened.Replay(func(e Entry) error {
+		replayed[string(e.Key)] = string(e.Value)
+		return nil
+	})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": ""}, replayed)
+}
+
+func TestWalReplayDelete(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	wal, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Append([]byte("a"), []byte("1")))
+	assert.NoError(t, wal.AppendDelete([]byte("a")))
+	assert.NoError(t, wal.Close())
+
+	// act
+	reopened, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	replayed := make([]Entry, 0)
+	err = reopened.Replay(func(e Entry) error {
+		replayed = append(replayed, e)
+		return nil
+	})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Len(t, replayed, 2)
+	assert.Equal(t, KindValue, replayed[0].Kind)
+	assert.Equal(t, KindTombstone, replayed[1].Kind)
+	assert.Equal(t, []byte("a"), replayed[1].Key)
+}
+
+func TestWalTornTail(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	wal, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Append([]byte("a"), []byte("1")))
+	assert.NoError(t, wal.Append([]byte("b"), []byte("2")))
+	assert.NoError(t, wal.Close())
+
+	// cut the last record in half
+	p := wal.segmentPath(wal.seg)
+	stat, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(p, stat.Size()-3))
+
+	// act
+	reopened, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	keys := make([]string, 0)
+	err = reopened.Replay(func(e Entry) error {
+		keys = append(keys, string(e.Key))
+		return nil
+	})
+
+	// assert
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, keys)
+}
+
+func TestWalRelease(t *testing.T) {
+	// arrange
+	dir := t.TempDir()
+	wal, err := OpenWal(dir, *DefaultOptions)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wal.Append([]byte("a"), []byte("1")))
+	sealed, err := wal.Rotate()
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Append([]byte("b"), []byte("2")))
+
+	// act
+	err = wal.Release(sealed)
+
+	// assert
+	assert.NoError(t, err)
+	segs, err := walSegments(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{wal.seg}, segs)
+}
+
+func TestWalSyncBatchInBackground(t *testing.T) {
+	// arrange
+	opts := *DefaultOptions
+	opts.WalSync = WalSyncBatch
+	opts.WalSyncInterval = 10 * time.Millisecond
+	wal, err := OpenWal(t.TempDir(), opts)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// act
+	// the interval hasn't passed, so the append isn't synced right away
+	assert.NoError(t, wal.Append([]byte("a"), []byte("1")))
+
+	// assert
+	assert.Eventually(t, func() bool {
+		wal.mu.Lock()
+		defer wal.mu.Unlock()
+		return !wal.dirty
+	}, time.Second, time.Millisecond)
+}
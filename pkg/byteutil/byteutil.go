@@ -10,9 +10,9 @@ type SeqWriter[T any] struct {
 }
 
 func (w *SeqWriter[T]) Write(p []T) (n int, err error) {
-	copied := copy(w.buf[w.off:], p)
-	w.off += copied
-	return copied, nil
+	w.buf = append(w.buf[:w.off], p...)
+	w.off += len(p)
+	return len(p), nil
 }
 
 func (w *SeqWriter[T]) Slice() []T {
@@ -28,6 +28,6 @@ func (w *SeqWriter[T]) Len() int {
 }
 
 func Uint16ToByteSlice(n uint16) []byte {
-	arr := [2]byte{byte(n), byte(n << 8)}
+	arr := [2]byte{byte(n), byte(n >> 8)}
 	return arr[:]
 }